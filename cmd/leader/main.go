@@ -1,35 +1,59 @@
 package main
 
 import (
-	"log/slog"
+	"fmt"
+	"memdb/pkg/config"
 	"memdb/pkg/db"
 	"memdb/pkg/server"
 	"os"
+	"path"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		panic("no port supplied on cmd arguments")
+	cfg, err := config.Load(config.RoleLeader, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
 	}
 
-	port := os.Args[1]
-
-	if len(os.Args) < 3 {
-		panic("no replicas args supplied, can not run without a minimum of 1 replica")
+	logger, err := cfg.Logger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
 	}
 
-	rootDir := "/tmp/memdb"
+	opts, err := cfg.DBOptions()
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(2)
+	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-	}))
+	leaderDB, err := db.NewLeader(cfg.Dir(), logger, opts...)
+	if err != nil {
+		logger.Error("failed to open database", "error", err)
+		os.Exit(1)
+	}
 
-	db := db.NewLeader(rootDir, logger)
-	leaderServer := server.NewLeaderServer(db, port, logger)
+	leaderServer := server.NewLeaderServer(leaderDB, cfg.Port, logger)
+	leaderServer.SetMaxTextLength(cfg.MaxTextLength)
+	leaderServer.SetMaxBodySize(cfg.MaxBodySize)
+	leaderServer.SetQueueLimit(cfg.QueueLimit)
+	leaderServer.SetBatching(cfg.BatchInterval, cfg.BatchSize)
+	leaderServer.SetAckLevel(cfg.AckLevel)
+	leaderServer.SetAckTimeout(cfg.AckTimeout)
+	leaderServer.SetHeartbeat(cfg.HeartbeatInterval, cfg.HeartbeatMisses)
+
+	if cfg.DurableQueues {
+		leaderServer.SetQueueDir(path.Join(cfg.Dir(), db.QueueDir), opts...)
+	}
 
-	replicas := os.Args[2:]
+	// replicas that joined at runtime, then the ones of the configuration
+	if err := leaderServer.SetMembersFile(path.Join(cfg.Dir(), db.MembersFile)); err != nil {
+		logger.Error("failed to load replicas", "error", err)
+		os.Exit(1)
+	}
 
-	for _, replica := range replicas {
+	for _, replica := range cfg.Replicas {
 		leaderServer.AddReplica(replica)
 	}
 
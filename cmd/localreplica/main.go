@@ -1,28 +1,34 @@
 package main
 
 import (
-	"log/slog"
+	"fmt"
+	"memdb/pkg/config"
 	"memdb/pkg/db"
 	"memdb/pkg/server"
 	"os"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		panic("no port supplied on cmd arguments")
+	cfg, err := config.Load(config.RoleLocalReplica, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
 	}
 
-	port := os.Args[1]
-
-	// Make it an argument
-	rootDir := "/tmp/memdb"
+	logger, err := cfg.Logger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-	}))
+	keyring, err := cfg.Keyring()
+	if err != nil {
+		logger.Error("failed to load encryption keys", "error", err)
+		os.Exit(2)
+	}
 
-	db := db.NewLocalReplica(rootDir, logger)
-	localReplicaServer := server.NewLocalReplica(db, port, logger)
+	db := db.NewLocalReplica(cfg.Dir(), logger, db.WithKeyring(keyring))
+	localReplicaServer := server.NewLocalReplica(db, cfg.Port, logger)
 
 	localReplicaServer.RunServer()
 }
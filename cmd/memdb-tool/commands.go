@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"memdb/pkg/db"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func (t *tool) dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := flags.String("format", "json", "output format: json, csv or ndjson")
+	output := flags.String("o", "", "output file, stdout by default")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("dump takes a single snapshot file")
+	}
+
+	snap, err := t.open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	writer := bufio.NewWriter(out)
+
+	switch *format {
+	case "json":
+		err = writeJSON(writer, snap)
+	case "csv":
+		err = writeCSV(writer, snap)
+	case "ndjson":
+		err = writeNDJSON(writer, snap)
+	default:
+		return fmt.Errorf("unknown dump format %q, expected one of json, csv, ndjson", *format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// rangeEntries calls fn for every entry of snap, stopping at the first error.
+func rangeEntries(snap db.Snapshot, fn func(word string, count int) error) error {
+	var fnErr error
+
+	err := snap.Entries()(func(word string, count int) bool {
+		fnErr = fn(word, count)
+		return fnErr == nil
+	})
+
+	return errors.Join(err, fnErr)
+}
+
+// writeJSON writes the word counts as a JSON object, in key order.
+func writeJSON(w io.Writer, snap db.Snapshot) error {
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+
+	first := true
+
+	err := rangeEntries(snap, func(word string, count int) error {
+		key, err := json.Marshal(word)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		first = false
+
+		_, err = fmt.Fprintf(w, "%s:%d", key, count)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "}\n")
+
+	return err
+}
+
+func writeCSV(w io.Writer, snap db.Snapshot) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{"word", "count"}); err != nil {
+		return err
+	}
+
+	if err := rangeEntries(snap, func(word string, count int) error {
+		return writer.Write([]string{word, strconv.Itoa(count)})
+	}); err != nil {
+		return err
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+func writeNDJSON(w io.Writer, snap db.Snapshot) error {
+	encoder := json.NewEncoder(w)
+
+	return rangeEntries(snap, func(word string, count int) error {
+		return encoder.Encode(struct {
+			Word  string `json:"word"`
+			Count int    `json:"count"`
+		}{word, count})
+	})
+}
+
+func encodeJSON(snap db.Snapshot) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := writeJSON(&buf, snap); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (t *tool) verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("verify takes at least one file or directory")
+	}
+
+	failed := 0
+
+	for _, name := range flags.Args() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+
+		files := []string{name}
+		if info.IsDir() {
+			if files, err = nodeFiles(name); err != nil {
+				return err
+			}
+		}
+
+		for _, file := range files {
+			if err := t.verifyFile(file); err != nil {
+				fmt.Printf("FAIL %s: %v\n", file, err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed verification", failed)
+	}
+
+	return nil
+}
+
+// nodeFiles lists the persistence files of a node rootDir.
+func nodeFiles(rootDir string) ([]string, error) {
+	patterns := []string{
+		path.Join(rootDir, db.BackupFile),
+		path.Join(rootDir, db.ReplicaFile),
+		path.Join(rootDir, db.SnapshotsDir, "*.db"),
+		path.Join(rootDir, db.LogFile),
+		path.Join(rootDir, db.LogFile+".*"),
+		path.Join(rootDir, db.EngineDir, db.ManifestFile),
+		path.Join(rootDir, db.EngineDir, "run-*.db"),
+		path.Join(rootDir, db.QueueDir, "*"+db.QueueSuffix),
+	}
+
+	files := []string{}
+	for _, pattern := range patterns {
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, names...)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no persistence files found", rootDir)
+	}
+
+	return files, nil
+}
+
+func (t *tool) verifyFile(name string) error {
+	switch {
+	case strings.HasPrefix(path.Base(name), db.LogFile):
+		return t.verifyLog(name, "log segment")
+	case strings.HasSuffix(name, db.QueueSuffix):
+		return t.verifyLog(name, "replication queue")
+	case path.Base(name) == db.ManifestFile:
+		return verifyManifest(name)
+	case path.Base(path.Dir(name)) == db.EngineDir:
+		entries, err := db.InspectRun(name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("OK   %s: lsm run, %d words\n", name, entries)
+
+		return nil
+	}
+
+	snap, err := t.open(name)
+	if err != nil {
+		return err
+	}
+
+	words := 0
+	if err := rangeEntries(snap, func(string, int) error {
+		words++
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("OK   %s: snapshot version %d, seq %d, %d words\n", name, snap.Version(), snap.Seq, words)
+
+	return nil
+}
+
+// verifyLog checks the records of a file in the write-ahead log record
+// format, a log segment or a replication queue.
+func (t *tool) verifyLog(name string, kind string) error {
+	info, err := db.InspectLogSegment(name, db.WithKeyring(t.keyring))
+	if err != nil {
+		return err
+	}
+
+	if info.IntactSize != info.Size {
+		return fmt.Errorf("torn or corrupt tail: %d of %d bytes intact, %d records up to seq %d",
+			info.IntactSize, info.Size, info.Records, info.LastSeq)
+	}
+
+	fmt.Printf("OK   %s: %s, %d records, seq %d-%d\n", name, kind, info.Records, info.FirstSeq, info.LastSeq)
+
+	return nil
+}
+
+// verifyManifest checks that the manifest of an lsm engine parses and that
+// the runs it lists exist, the runs themselves are verified on their own.
+func verifyManifest(name string) error {
+	manifest, err := db.ReadLSMManifest(path.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	for _, run := range manifest.Runs {
+		if _, err := os.Stat(run); err != nil {
+			return fmt.Errorf("run listed by the manifest: %w", err)
+		}
+	}
+
+	fmt.Printf("OK   %s: lsm manifest, seq %d, %d runs\n", name, manifest.Seq, len(manifest.Runs))
+
+	return nil
+}
+
+func (t *tool) stats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	top := flags.Int("top", 10, "number of most frequent words to print")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("stats takes a single snapshot file")
+	}
+
+	snap, err := t.open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var (
+		words  int
+		tokens int
+		most   = &topWords{}
+	)
+
+	if err := rangeEntries(snap, func(word string, count int) error {
+		words++
+		tokens += count
+
+		heap.Push(most, wordCount{word, count})
+		if most.Len() > *top {
+			heap.Pop(most)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("version:        %d\n", snap.Version())
+	fmt.Printf("seq:            %d\n", snap.Seq)
+	fmt.Printf("term:           %d\n", snap.Term)
+	fmt.Printf("compression:    %s\n", snap.Compression())
+	fmt.Printf("encrypted:      %t\n", snap.Encrypted())
+	fmt.Printf("distinct words: %d\n", words)
+	fmt.Printf("total tokens:   %d\n", tokens)
+
+	sorted := make([]wordCount, most.Len())
+	copy(sorted, *most)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[j].less(sorted[i]) })
+
+	fmt.Printf("top %d words:\n", len(sorted))
+	for _, entry := range sorted {
+		fmt.Printf("  %-20s %d\n", entry.word, entry.count)
+	}
+
+	return nil
+}
+
+type wordCount struct {
+	word  string
+	count int
+}
+
+// less orders by count, then alphabetically so that ties are stable.
+func (w wordCount) less(other wordCount) bool {
+	if w.count != other.count {
+		return w.count < other.count
+	}
+
+	return w.word > other.word
+}
+
+// topWords is a min-heap keeping the most frequent words seen so far.
+type topWords []wordCount
+
+func (h topWords) Len() int           { return len(h) }
+func (h topWords) Less(i, j int) bool { return h[i].less(h[j]) }
+func (h topWords) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *topWords) Push(x any)        { *h = append(*h, x.(wordCount)) }
+
+func (h *topWords) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return last
+}
+
+func (t *tool) merge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := newOutputFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		return fmt.Errorf("merge takes at least two snapshot files")
+	}
+
+	merged := make(map[string]int)
+
+	for _, name := range flags.Args() {
+		snap, err := t.open(name)
+		if err != nil {
+			return err
+		}
+
+		if err := rangeEntries(snap, func(word string, count int) error {
+			merged[word] += count
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	// the merged counts don't match any position in a leader's history
+	return t.write(out, db.Snapshot{WordCount: merged})
+}
+
+func (t *tool) convert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	out := newOutputFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("convert takes a single snapshot file")
+	}
+
+	snap, err := t.open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return t.write(out, snap)
+}
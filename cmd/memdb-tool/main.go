@@ -0,0 +1,192 @@
+// memdb-tool inspects, verifies and converts the persistence files of memdb
+// nodes without a running server.
+//
+// Encrypted files are read with the keys of MEMDB_ENCRYPTION_KEY_FILE or
+// MEMDB_ENCRYPTION_KEY, like the servers do.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"memdb/pkg/db"
+	"os"
+	"path"
+)
+
+const usage = `usage: memdb-tool <command> [flags] [files]
+
+commands:
+  dump     [-format json|csv|ndjson] [-o out] FILE      print the word counts of a snapshot
+  verify   FILE|DIR...                                  check snapshots, write-ahead logs, lsm
+                                                        runs and replication queues, a DIR is
+                                                        a node rootDir
+  stats    [-top n] FILE                                print snapshot format and word statistics
+  merge    -o out [-compression c] [-encrypt] FILE...   sum the word counts of several snapshots
+  convert  -o out [-format snapshot|json] [-compression c] [-encrypt] FILE
+                                                        rewrite a snapshot in another format
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	keyring, err := db.KeyringFromEnv()
+	if err != nil {
+		fail(fmt.Errorf("failed to load encryption keys: %w", err))
+	}
+
+	tool := &tool{keyring: keyring}
+
+	commands := map[string]func(args []string) error{
+		"dump":    tool.dump,
+		"verify":  tool.verify,
+		"stats":   tool.stats,
+		"merge":   tool.merge,
+		"convert": tool.convert,
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := command(os.Args[2:]); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "memdb-tool: %v\n", err)
+	os.Exit(1)
+}
+
+type tool struct {
+	keyring *db.Keyring
+}
+
+// open reads a snapshot file in any of the snapshot formats, the entries are
+// read from the file content rather than loaded in a map.
+func (t *tool) open(name string) (db.Snapshot, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return db.Snapshot{}, err
+	}
+
+	snap, err := db.OpenSnapshot(data, db.WithKeyring(t.keyring))
+	if err != nil {
+		return db.Snapshot{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return snap, nil
+}
+
+// outputFlags registers the flags shared by the commands writing a snapshot.
+type outputFlags struct {
+	output      *string
+	format      *string
+	compression *string
+	encrypt     *bool
+}
+
+func newOutputFlags(flags *flag.FlagSet) outputFlags {
+	return outputFlags{
+		output:      flags.String("o", "", "output file"),
+		format:      flags.String("format", "snapshot", "output format: snapshot or json (bare JSON map)"),
+		compression: flags.String("compression", "none", "snapshot compression: none, gzip or flate"),
+		encrypt:     flags.Bool("encrypt", false, "encrypt the snapshot with the current key"),
+	}
+}
+
+// write atomically writes snap to the output file.
+func (t *tool) write(out outputFlags, snap db.Snapshot) error {
+	if *out.output == "" {
+		return fmt.Errorf("no output file, set -o")
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	switch *out.format {
+	case "snapshot":
+		compression, parseErr := db.ParseCompression(*out.compression)
+		if parseErr != nil {
+			return parseErr
+		}
+
+		opts := []db.Option{db.WithCompression(compression)}
+		if *out.encrypt {
+			if t.keyring == nil {
+				return fmt.Errorf("-encrypt needs %s or %s", db.EnvEncryptionKeyFile, db.EnvEncryptionKey)
+			}
+
+			opts = append(opts, db.WithKeyring(t.keyring))
+		}
+
+		data, err = db.EncodeSnapshot(snap, opts...)
+	case "json":
+		if *out.encrypt || *out.compression != "none" {
+			return fmt.Errorf("the json format can't be compressed or encrypted")
+		}
+
+		data, err = encodeJSON(snap)
+	default:
+		return fmt.Errorf("unknown output format %q, expected one of snapshot, json", *out.format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// durable once written, like the files of the nodes
+	tmp := path.Join(path.Dir(*out.output), "."+path.Base(*out.output)+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	if err := os.Rename(tmp, *out.output); err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	return syncDir(path.Dir(*out.output))
+}
+
+func writeFileSync(name string, data []byte) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir flushes the rename of the output file to stable storage.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	wrongKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func testKeyring(t *testing.T, key string) *db.Keyring {
+	t.Helper()
+
+	keyring, err := db.ParseKeyring(key)
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	return keyring
+}
+
+// writeFixture writes snap to name in dir with db.EncodeSnapshot and returns
+// its path.
+func writeFixture(t *testing.T, dir string, name string, snap db.Snapshot, opts ...db.Option) string {
+	t.Helper()
+
+	data, err := db.EncodeSnapshot(snap, opts...)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+
+	file := path.Join(dir, name)
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", file, err)
+	}
+
+	return file
+}
+
+// writeEngine writes the word counts of snap to the lsm engine of the node
+// rootDir dir, as a single run listed by its manifest.
+func writeEngine(t *testing.T, dir string, snap db.Snapshot) {
+	t.Helper()
+
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	engine, err := db.OpenLSMEngine(path.Join(dir, db.EngineDir), db.DefaultLSMConfig, logger)
+	if err != nil {
+		t.Fatalf("failed to open lsm engine: %v", err)
+	}
+
+	if err := engine.Add(snap.WordCount); err != nil {
+		t.Fatalf("failed to add word counts: %v", err)
+	}
+
+	engine.SetPosition(snap.Seq, snap.Term)
+
+	if err := engine.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint lsm engine: %v", err)
+	}
+
+	if err := engine.Close(); err != nil {
+		t.Fatalf("failed to close lsm engine: %v", err)
+	}
+}
+
+// writeQueue writes the word counts of snap as a change to a replication
+// queue of the node rootDir dir and returns its path.
+func writeQueue(t *testing.T, dir string, snap db.Snapshot) string {
+	t.Helper()
+
+	if err := os.MkdirAll(path.Join(dir, db.QueueDir), 0700); err != nil {
+		t.Fatalf("failed to create queue directory: %v", err)
+	}
+
+	file := path.Join(dir, db.QueueDir, "replica"+db.QueueSuffix)
+
+	queue, err := db.OpenQueue(file)
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+
+	if err := queue.Push(db.Change{Seq: snap.Seq, Term: snap.Term, Updates: snap.WordCount}); err != nil {
+		t.Fatalf("failed to push change: %v", err)
+	}
+
+	if err := queue.Close(); err != nil {
+		t.Fatalf("failed to close queue: %v", err)
+	}
+
+	return file
+}
+
+// corrupt flips the byte at offset of file, counted from its end when
+// negative.
+func corrupt(t *testing.T, file string, offset int) {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", file, err)
+	}
+
+	if offset < 0 {
+		offset += len(data)
+	}
+
+	data[offset] ^= 0xff
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("failed to corrupt %s: %v", file, err)
+	}
+}
+
+// captureStdout runs fn and returns what it printed on stdout.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatalf("failed to create stdout file: %v", err)
+	}
+
+	defer out.Close()
+
+	stdout := os.Stdout
+	os.Stdout = out
+
+	fnErr := fn()
+
+	os.Stdout = stdout
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("failed to rewind stdout file: %v", err)
+	}
+
+	data, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("failed to read stdout file: %v", err)
+	}
+
+	return string(data), fnErr
+}
+
+// readSnapshot returns the word counts of a snapshot file written by a
+// command.
+func readSnapshot(t *testing.T, file string, opts ...db.Option) db.Snapshot {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", file, err)
+	}
+
+	snap, err := db.DecodeSnapshot(data, opts...)
+	if err != nil {
+		t.Fatalf("failed to decode %s: %v", file, err)
+	}
+
+	return snap
+}
+
+func TestCommands(t *testing.T) {
+	keyring := testKeyring(t, testKey)
+
+	words := db.Snapshot{Seq: 42, Term: 3, WordCount: map[string]int{"hello": 2, "world": 1}}
+	others := db.Snapshot{Seq: 7, Term: 1, WordCount: map[string]int{"hello": 1, "again": 4}}
+
+	tests := []struct {
+		name    string
+		keyring *db.Keyring
+		// returns the command and its arguments, given the fixtures directory
+		command func(t *testing.T, tl *tool, dir string) (func([]string) error, []string)
+		// checked against the command output on stdout
+		wantOut []string
+		wantErr error
+		// an error message, when there is no sentinel to check against
+		wantErrText string
+		// checks the files written by the command
+		check func(t *testing.T, dir string)
+	}{
+		{
+			name: "dump json",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.dump, []string{writeFixture(t, dir, "words.db", words)}
+			},
+			wantOut: []string{`{"hello":2,"world":1}` + "\n"},
+		},
+		{
+			name: "dump csv",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.dump, []string{"-format", "csv", writeFixture(t, dir, "words.db", words)}
+			},
+			wantOut: []string{"word,count\nhello,2\nworld,1\n"},
+		},
+		{
+			name: "dump ndjson to a file",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.dump, []string{"-format", "ndjson", "-o", path.Join(dir, "words.ndjson"), writeFixture(t, dir, "words.db", words)}
+			},
+			check: func(t *testing.T, dir string) {
+				data, err := os.ReadFile(path.Join(dir, "words.ndjson"))
+				if err != nil {
+					t.Fatalf("failed to read dump: %v", err)
+				}
+
+				if want := "{\"word\":\"hello\",\"count\":2}\n{\"word\":\"world\",\"count\":1}\n"; string(data) != want {
+					t.Errorf("expected dump %q, got %q", want, data)
+				}
+			},
+		},
+		{
+			name: "dump unknown format",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.dump, []string{"-format", "xml", writeFixture(t, dir, "words.db", words)}
+			},
+			wantErrText: `unknown dump format "xml"`,
+		},
+		{
+			name:    "dump encrypted",
+			keyring: keyring,
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.dump, []string{writeFixture(t, dir, "words.db", words, db.WithKeyring(keyring))}
+			},
+			wantOut: []string{`{"hello":2,"world":1}` + "\n"},
+		},
+		{
+			name:    "dump encrypted with the wrong key",
+			keyring: testKeyring(t, wrongKey),
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.dump, []string{writeFixture(t, dir, "words.db", words, db.WithKeyring(keyring))}
+			},
+			wantErr: dbErrs.ErrEncryptionKey,
+		},
+		{
+			name: "verify",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.verify, []string{writeFixture(t, dir, "words.db", words, db.WithCompression(db.CompressionGzip))}
+			},
+			wantOut: []string{"OK", "seq 42, 2 words"},
+		},
+		{
+			name: "verify a node rootDir",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				writeFixture(t, dir, db.ReplicaFile, words)
+				writeEngine(t, dir, words)
+				writeQueue(t, dir, others)
+
+				return tl.verify, []string{dir}
+			},
+			wantOut: []string{
+				"OK   ", db.ReplicaFile + ": snapshot version", "seq 42, 2 words",
+				db.ManifestFile + ": lsm manifest, seq 42, 1 runs",
+				": lsm run, 2 words",
+				db.QueueSuffix + ": replication queue, 1 records, seq 7-7",
+			},
+		},
+		{
+			name: "verify a corrupted lsm manifest",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				writeEngine(t, dir, words)
+				corrupt(t, path.Join(dir, db.EngineDir, db.ManifestFile), 0)
+
+				return tl.verify, []string{dir}
+			},
+			wantOut:     []string{"FAIL", db.ManifestFile, "OK", ": lsm run"},
+			wantErrText: "1 file(s) failed verification",
+		},
+		{
+			name: "verify a manifest listing a missing run",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				writeEngine(t, dir, words)
+
+				runs, _ := filepath.Glob(path.Join(dir, db.EngineDir, "run-*.db"))
+				for _, run := range runs {
+					os.Remove(run)
+				}
+
+				return tl.verify, []string{dir}
+			},
+			wantOut:     []string{"FAIL", db.ManifestFile, "run listed by the manifest"},
+			wantErrText: "1 file(s) failed verification",
+		},
+		{
+			name: "verify a corrupted lsm run",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				writeEngine(t, dir, words)
+
+				runs, _ := filepath.Glob(path.Join(dir, db.EngineDir, "run-*.db"))
+				if len(runs) != 1 {
+					t.Fatalf("expected a single run, got %v", runs)
+				}
+
+				corrupt(t, runs[0], -1)
+
+				return tl.verify, []string{dir}
+			},
+			wantOut:     []string{"OK", db.ManifestFile, "FAIL", "run-"},
+			wantErrText: "1 file(s) failed verification",
+		},
+		{
+			name: "verify a corrupted replication queue",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				writeFixture(t, dir, db.BackupFile, words)
+				corrupt(t, writeQueue(t, dir, others), -1)
+
+				return tl.verify, []string{dir}
+			},
+			wantOut:     []string{"OK", db.BackupFile, "FAIL", db.QueueSuffix, "torn or corrupt tail"},
+			wantErrText: "1 file(s) failed verification",
+		},
+		{
+			name: "verify a corrupted file",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				file := writeFixture(t, dir, "words.db", words)
+				corrupt(t, file, -1)
+
+				return tl.verify, []string{writeFixture(t, dir, "intact.db", others), file}
+			},
+			wantOut:     []string{"OK", "intact.db", "FAIL", "words.db"},
+			wantErrText: "1 file(s) failed verification",
+		},
+		{
+			name:    "verify encrypted with the wrong key",
+			keyring: testKeyring(t, wrongKey),
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.verify, []string{writeFixture(t, dir, "words.db", words, db.WithKeyring(keyring))}
+			},
+			wantOut:     []string{"FAIL", "words.db"},
+			wantErrText: "1 file(s) failed verification",
+		},
+		{
+			name:    "stats",
+			keyring: keyring,
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.stats, []string{"-top", "1", writeFixture(t, dir, "words.db", words, db.WithKeyring(keyring), db.WithCompression(db.CompressionFlate))}
+			},
+			wantOut: []string{
+				"seq:            42\n",
+				"term:           3\n",
+				"compression:    flate\n",
+				"encrypted:      true\n",
+				"distinct words: 2\n",
+				"total tokens:   3\n",
+				"top 1 words:\n  hello                2\n",
+			},
+		},
+		{
+			name: "stats of a missing file",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.stats, []string{path.Join(dir, "missing.db")}
+			},
+			wantErr: os.ErrNotExist,
+		},
+		{
+			name: "merge",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.merge, []string{
+					"-o", path.Join(dir, "merged.db"),
+					writeFixture(t, dir, "words.db", words),
+					writeFixture(t, dir, "others.db", others, db.WithCompression(db.CompressionGzip)),
+				}
+			},
+			check: func(t *testing.T, dir string) {
+				snap := readSnapshot(t, path.Join(dir, "merged.db"))
+
+				want := map[string]int{"hello": 3, "world": 1, "again": 4}
+				if len(snap.WordCount) != len(want) {
+					t.Errorf("expected %d merged words, got %v", len(want), snap.WordCount)
+				}
+
+				for word, count := range want {
+					if snap.WordCount[word] != count {
+						t.Errorf("expected %d for %s, got %d", count, word, snap.WordCount[word])
+					}
+				}
+
+				if snap.Seq != 0 || snap.Term != 0 {
+					t.Errorf("expected merged snapshot without a position, got seq %d term %d", snap.Seq, snap.Term)
+				}
+			},
+		},
+		{
+			name: "merge a single file",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.merge, []string{"-o", path.Join(dir, "merged.db"), writeFixture(t, dir, "words.db", words)}
+			},
+			wantErrText: "merge takes at least two snapshot files",
+		},
+		{
+			name:    "merge encrypted with the wrong key",
+			keyring: testKeyring(t, wrongKey),
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.merge, []string{
+					"-o", path.Join(dir, "merged.db"),
+					writeFixture(t, dir, "words.db", words),
+					writeFixture(t, dir, "others.db", others, db.WithKeyring(keyring)),
+				}
+			},
+			wantErr: dbErrs.ErrEncryptionKey,
+			check: func(t *testing.T, dir string) {
+				if _, err := os.Stat(path.Join(dir, "merged.db")); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("expected no merged file after a failure, got %v", err)
+				}
+			},
+		},
+		{
+			name:    "convert to compressed and encrypted",
+			keyring: keyring,
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.convert, []string{"-o", path.Join(dir, "converted.db"), "-compression", "gzip", "-encrypt", writeFixture(t, dir, "words.db", words)}
+			},
+			check: func(t *testing.T, dir string) {
+				snap := readSnapshot(t, path.Join(dir, "converted.db"), db.WithKeyring(keyring))
+
+				if snap.Compression() != db.CompressionGzip || !snap.Encrypted() {
+					t.Errorf("expected a gzip encrypted snapshot, got %s encrypted %t", snap.Compression(), snap.Encrypted())
+				}
+
+				if snap.Seq != 42 || snap.Term != 3 || snap.WordCount["hello"] != 2 || snap.WordCount["world"] != 1 {
+					t.Errorf("unexpected converted snapshot: %+v", snap)
+				}
+			},
+		},
+		{
+			name:    "convert encrypted to json",
+			keyring: keyring,
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.convert, []string{"-o", path.Join(dir, "words.json"), "-format", "json", writeFixture(t, dir, "words.db", words, db.WithKeyring(keyring))}
+			},
+			check: func(t *testing.T, dir string) {
+				data, err := os.ReadFile(path.Join(dir, "words.json"))
+				if err != nil {
+					t.Fatalf("failed to read converted file: %v", err)
+				}
+
+				if want := `{"hello":2,"world":1}` + "\n"; string(data) != want {
+					t.Errorf("expected %q, got %q", want, data)
+				}
+			},
+		},
+		{
+			name:    "convert encrypted with the wrong key",
+			keyring: testKeyring(t, wrongKey),
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.convert, []string{"-o", path.Join(dir, "converted.db"), writeFixture(t, dir, "words.db", words, db.WithKeyring(keyring))}
+			},
+			wantErr: dbErrs.ErrEncryptionKey,
+		},
+		{
+			name: "convert to encrypted without a key",
+			command: func(t *testing.T, tl *tool, dir string) (func([]string) error, []string) {
+				return tl.convert, []string{"-o", path.Join(dir, "converted.db"), "-encrypt", writeFixture(t, dir, "words.db", words)}
+			},
+			wantErrText: "-encrypt needs " + db.EnvEncryptionKeyFile,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			command, args := test.command(t, &tool{keyring: test.keyring}, dir)
+
+			out, err := captureStdout(t, func() error { return command(args) })
+
+			switch {
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("expected error %v, got %v", test.wantErr, err)
+				}
+			case test.wantErrText != "":
+				if err == nil || !strings.Contains(err.Error(), test.wantErrText) {
+					t.Errorf("expected error %q, got %v", test.wantErrText, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, want := range test.wantOut {
+				if !strings.Contains(out, want) {
+					t.Errorf("expected output to contain %q, got %q", want, out)
+				}
+			}
+
+			if test.check != nil {
+				test.check(t, dir)
+			}
+		})
+	}
+}
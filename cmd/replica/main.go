@@ -1,32 +1,62 @@
 package main
 
 import (
-	"log/slog"
+	"context"
+	"fmt"
+	"memdb/pkg/config"
 	"memdb/pkg/db"
 	"memdb/pkg/server"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		panic("no port supplied on cmd arguments")
+	cfg, err := config.Load(config.RoleReplica, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
 	}
 
-	port := os.Args[1]
+	logger, err := cfg.Logger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+
+	opts, err := cfg.DBOptions()
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(2)
+	}
 
-	if len(os.Args) < 3 {
-		panic("no leader arg supplied, can not run without a leader")
+	db, err := db.OpenReplica(cfg.Dir(), logger, opts...)
+	if err != nil {
+		logger.Error("failed to open database", "error", err)
+		os.Exit(1)
 	}
 
-	leader := os.Args[2]
+	replicaServer := server.NewReplicaServer(db, cfg.Port, cfg.Leader, logger)
+	replicaServer.SetAdvertiseURL(cfg.AdvertiseURL)
+	replicaServer.SetReplicationMode(cfg.ReplicationMode)
+	replicaServer.SetAntiEntropyInterval(cfg.AntiEntropyInterval)
+	replicaServer.SetServeDownstream(cfg.ServeDownstream)
+	replicaServer.SetMaxBodySize(cfg.MaxBodySize)
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-	}))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	db := db.NewReplica(logger)
+	go func() {
+		<-ctx.Done()
 
-	replicaServer := server.NewReplicaServer(db, port, leader, logger)
+		if err := replicaServer.Shutdown(context.Background()); err != nil {
+			logger.Error("failed to shut down server", "error", err)
+		}
+	}()
 
 	replicaServer.RunServer()
+
+	if err := db.Close(); err != nil {
+		logger.Error("failed to persist replica state", "error", err)
+	}
 }
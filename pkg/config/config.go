@@ -0,0 +1,658 @@
+// Package config loads the configuration of the memdb binaries from command
+// line flags, environment variables and a config file, in this order of
+// precedence.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"memdb/pkg/db"
+	"memdb/pkg/server"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Role is the binary being configured, it decides which settings apply.
+type Role string
+
+const (
+	RoleLeader       Role = "leader"
+	RoleReplica      Role = "replica"
+	RoleLocalReplica Role = "localreplica"
+
+	// names the config file when the -config flag is not set
+	EnvConfigFile = "MEMDB_CONFIG"
+
+	DefaultRootDir        = "/tmp/memdb"
+	DefaultBackupInterval = time.Second
+	DefaultMaxTextLength  = 65535
+	DefaultQueueLimit     = 10000
+)
+
+type Config struct {
+	Role Role
+
+	Port string
+	// base URLs of the replicas the leader pushes updates to
+	Replicas []string
+	// base URL of the leader a replica syncs from
+	Leader string
+	// base URL the leader reaches a replica at, the replica joins the leader
+	// with it when set
+	AdvertiseURL string
+	// whether the leader pushes the changes to a replica or it pulls them
+	ReplicationMode server.ReplicationMode
+	// how often a replica compares its word counts with the leader ones,
+	// never when 0
+	AntiEntropyInterval time.Duration
+	// whether a replica serves other replicas, which pull the changes from it
+	ServeDownstream bool
+	RootDir         string
+	// how often the leader writes a snapshot and a replica persists its state
+	BackupInterval time.Duration
+	// longest text accepted by the leader
+	MaxTextLength int
+	// largest request body accepted, once decompressed: the updates pushed to
+	// a replica and the snapshots uploaded to the leader
+	MaxBodySize int64
+	// most changes queued by the leader for a replica before resyncing it
+	QueueLimit int
+	// whether the leader keeps the replication queues on disk
+	DurableQueues bool
+	// most recent changes the leader, or a replica serving downstream
+	// replicas, keeps for the incremental sync of replicas
+	ChangelogSize int
+	// how long the leader waits to merge changes into a single update to the
+	// replicas, and the most changes merged
+	BatchInterval time.Duration
+	BatchSize     int
+	// how far writes go before the leader replies, and its longest wait for
+	// the replicas
+	AckLevel   server.AckLevel
+	AckTimeout time.Duration
+	// how often the leader checks the replicas, never when 0, and the checks
+	// a replica misses in a row before it stops receiving the writes
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+	// debug, info, warn or error
+	LogLevel string
+	// stdout, stderr or the path of a file logs are appended to
+	LogOutput           string
+	SnapshotCompression db.Compression
+	StorageEngine       db.StorageEngine
+	EncryptionKeyFile   string
+}
+
+// setting is a configuration value, read from the config file key, the
+// environment variable env or the flag named like the key with dashes.
+type setting struct {
+	key   string
+	env   string
+	usage string
+	roles []Role
+	set   func(c *Config, value string) error
+}
+
+var allRoles = []Role{RoleLeader, RoleReplica, RoleLocalReplica}
+
+var settings = []setting{
+	{
+		key: "port", env: "MEMDB_PORT", roles: allRoles,
+		usage: "port to listen on",
+		set: func(c *Config, value string) error {
+			c.Port = value
+			return nil
+		},
+	},
+	{
+		key: "replicas", env: "MEMDB_REPLICAS", roles: []Role{RoleLeader},
+		usage: "comma separated base URLs of the replicas",
+		set: func(c *Config, value string) error {
+			c.Replicas = splitList(value)
+			return nil
+		},
+	},
+	{
+		key: "leader", env: "MEMDB_LEADER", roles: []Role{RoleReplica},
+		usage: "base URL of the leader",
+		set: func(c *Config, value string) error {
+			c.Leader = value
+			return nil
+		},
+	},
+	{
+		key: "advertise_url", env: "MEMDB_ADVERTISE_URL", roles: []Role{RoleReplica},
+		usage: "base URL the leader reaches the replica at, the replica joins the leader with it when set",
+		set: func(c *Config, value string) error {
+			c.AdvertiseURL = value
+			return nil
+		},
+	},
+	{
+		key: "replication_mode", env: "MEMDB_REPLICATION_MODE", roles: []Role{RoleReplica},
+		usage: "push, the leader sends the changes, or pull, the replica streams them from the leader",
+		set: func(c *Config, value string) (err error) {
+			c.ReplicationMode, err = server.ParseReplicationMode(value)
+			return err
+		},
+	},
+	{
+		key: "anti_entropy_interval", env: "MEMDB_ANTI_ENTROPY_INTERVAL", roles: []Role{RoleReplica},
+		usage: "how often the replica compares its word counts with the leader ones, e.g. 1m, 0 disables it",
+		set: func(c *Config, value string) (err error) {
+			c.AntiEntropyInterval, err = time.ParseDuration(value)
+			return err
+		},
+	},
+	{
+		key: "serve_downstream", env: "MEMDB_SERVE_DOWNSTREAM", roles: []Role{RoleReplica},
+		usage: "serve /sync and /stream to other replicas, which pull the changes from this one, true or false",
+		set: func(c *Config, value string) (err error) {
+			c.ServeDownstream, err = strconv.ParseBool(value)
+			return err
+		},
+	},
+	{
+		key: "root_dir", env: "MEMDB_ROOT_DIR", roles: allRoles,
+		usage: "directory holding the node's files, the local replica reads the leader's",
+		set: func(c *Config, value string) error {
+			c.RootDir = value
+			return nil
+		},
+	},
+	{
+		key: "backup_interval", env: "MEMDB_BACKUP_INTERVAL", roles: []Role{RoleLeader, RoleReplica},
+		usage: "how often the state is written to disk, e.g. 1s or 500ms",
+		set: func(c *Config, value string) (err error) {
+			c.BackupInterval, err = time.ParseDuration(value)
+			return err
+		},
+	},
+	{
+		key: "max_text_length", env: "MEMDB_MAX_TEXT_LENGTH", roles: []Role{RoleLeader},
+		usage: "longest text accepted by POST /post, in bytes",
+		set: func(c *Config, value string) (err error) {
+			c.MaxTextLength, err = strconv.Atoi(value)
+			return err
+		},
+	},
+	{
+		key: "max_body_size", env: "MEMDB_MAX_BODY_SIZE", roles: []Role{RoleLeader, RoleReplica},
+		usage: "largest update pushed to a replica or snapshot uploaded to the leader, in bytes once decompressed",
+		set: func(c *Config, value string) (err error) {
+			c.MaxBodySize, err = strconv.ParseInt(value, 10, 64)
+			return err
+		},
+	},
+	{
+		key: "queue_limit", env: "MEMDB_QUEUE_LIMIT", roles: []Role{RoleLeader},
+		usage: "most changes queued for an unreachable replica before it is resynced instead",
+		set: func(c *Config, value string) (err error) {
+			c.QueueLimit, err = strconv.Atoi(value)
+			return err
+		},
+	},
+	{
+		key: "durable_queues", env: "MEMDB_DURABLE_QUEUES", roles: []Role{RoleLeader},
+		usage: "keep the replication queues in root_dir so that they survive a restart, true or false",
+		set: func(c *Config, value string) (err error) {
+			c.DurableQueues, err = strconv.ParseBool(value)
+			return err
+		},
+	},
+	{
+		key: "changelog_size", env: "MEMDB_CHANGELOG_SIZE", roles: []Role{RoleLeader, RoleReplica},
+		usage: "most recent changes kept for replicas to catch up incrementally, 0 to always send full snapshots",
+		set: func(c *Config, value string) (err error) {
+			c.ChangelogSize, err = strconv.Atoi(value)
+			return err
+		},
+	},
+	{
+		key: "batch_interval", env: "MEMDB_BATCH_INTERVAL", roles: []Role{RoleLeader},
+		usage: "how long changes wait to be sent to the replicas along with the next ones, e.g. 10ms, 0 to send them right away",
+		set: func(c *Config, value string) (err error) {
+			c.BatchInterval, err = time.ParseDuration(value)
+			return err
+		},
+	},
+	{
+		key: "batch_size", env: "MEMDB_BATCH_SIZE", roles: []Role{RoleLeader},
+		usage: "most changes sent to a replica in a single update",
+		set: func(c *Config, value string) (err error) {
+			c.BatchSize, err = strconv.Atoi(value)
+			return err
+		},
+	},
+	{
+		key: "ack_level", env: "MEMDB_ACK_LEVEL", roles: []Role{RoleLeader},
+		usage: "default ack level of writes: none, leader, one, quorum or all",
+		set: func(c *Config, value string) (err error) {
+			c.AckLevel, err = server.ParseAckLevel(value)
+			return err
+		},
+	},
+	{
+		key: "ack_timeout", env: "MEMDB_ACK_TIMEOUT", roles: []Role{RoleLeader},
+		usage: "longest a write waits for the replicas acknowledgements, e.g. 5s",
+		set: func(c *Config, value string) (err error) {
+			c.AckTimeout, err = time.ParseDuration(value)
+			return err
+		},
+	},
+	{
+		key: "heartbeat_interval", env: "MEMDB_HEARTBEAT_INTERVAL", roles: []Role{RoleLeader},
+		usage: "how often the leader checks the replicas, e.g. 1s, 0 disables the checks",
+		set: func(c *Config, value string) (err error) {
+			c.HeartbeatInterval, err = time.ParseDuration(value)
+			return err
+		},
+	},
+	{
+		key: "heartbeat_misses", env: "MEMDB_HEARTBEAT_MISSES", roles: []Role{RoleLeader},
+		usage: "checks a replica misses in a row before it stops receiving the writes",
+		set: func(c *Config, value string) (err error) {
+			c.HeartbeatMisses, err = strconv.Atoi(value)
+			return err
+		},
+	},
+	{
+		key: "log_level", env: "MEMDB_LOG_LEVEL", roles: allRoles,
+		usage: "debug, info, warn or error",
+		set: func(c *Config, value string) error {
+			c.LogLevel = value
+			return nil
+		},
+	},
+	{
+		key: "log_output", env: "MEMDB_LOG_OUTPUT", roles: allRoles,
+		usage: "stdout, stderr or a file path logs are appended to",
+		set: func(c *Config, value string) error {
+			c.LogOutput = value
+			return nil
+		},
+	},
+	{
+		key: "snapshot_compression", env: "MEMDB_SNAPSHOT_COMPRESSION", roles: []Role{RoleLeader, RoleReplica},
+		usage: "compression of the snapshot files: none, gzip or flate",
+		set: func(c *Config, value string) (err error) {
+			c.SnapshotCompression, err = db.ParseCompression(value)
+			return err
+		},
+	},
+	{
+		key: "storage_engine", env: "MEMDB_STORAGE_ENGINE", roles: []Role{RoleLeader, RoleReplica},
+		usage: "storage engine: map or lsm",
+		set: func(c *Config, value string) (err error) {
+			c.StorageEngine, err = db.ParseStorageEngine(value)
+			return err
+		},
+	},
+	{
+		key: "encryption_key_file", env: db.EnvEncryptionKeyFile, roles: allRoles,
+		usage: "file with the encryption keys, see MEMDB_ENCRYPTION_KEY",
+		set: func(c *Config, value string) error {
+			c.EncryptionKeyFile = value
+			return nil
+		},
+	},
+}
+
+func (s setting) flag() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+func (s setting) appliesTo(role Role) bool {
+	for _, r := range s.roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func defaults(role Role) *Config {
+	return &Config{
+		Role:                role,
+		BackupInterval:      DefaultBackupInterval,
+		MaxTextLength:       DefaultMaxTextLength,
+		MaxBodySize:         server.DefaultMaxBodySize,
+		QueueLimit:          DefaultQueueLimit,
+		ChangelogSize:       db.DefaultChangelogSize,
+		BatchInterval:       server.DefaultBatchInterval,
+		BatchSize:           server.DefaultBatchSize,
+		AckLevel:            server.DefaultAckLevel,
+		AckTimeout:          server.DefaultAckTimeout,
+		HeartbeatInterval:   server.DefaultHeartbeatInterval,
+		HeartbeatMisses:     server.DefaultHeartbeatMisses,
+		ReplicationMode:     server.DefaultReplicationMode,
+		AntiEntropyInterval: server.DefaultAntiEntropyInterval,
+		LogLevel:            "info",
+		LogOutput:           "stdout",
+		SnapshotCompression: db.CompressionNone,
+		StorageEngine:       db.StorageEngineMap,
+	}
+}
+
+// Load reads the configuration of role from the command line args (without
+// the program name), the environment and the config file named by -config or
+// MEMDB_CONFIG, and validates it. Every problem found is reported in the
+// returned error.
+func Load(role Role, args []string) (*Config, error) {
+	// like the standard flags, -h prints the usage and malformed flags exit
+	flags := flag.NewFlagSet(string(role), flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), Usage(role))
+	}
+
+	configFile := flags.String("config", os.Getenv(EnvConfigFile), "config file, JSON or key = value lines")
+
+	values := map[string]*string{}
+	for _, s := range settings {
+		if s.appliesTo(role) {
+			values[s.key] = flags.String(s.flag(), "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+		}
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q, settings are passed as flags\n%s", flags.Arg(0), Usage(role))
+	}
+
+	cfg := defaults(role)
+
+	// a setting that fails to parse keeps its previous value, so that the
+	// other ones are still read and checked
+	var errs []error
+
+	if *configFile != "" {
+		file, err := readFile(*configFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		for _, key := range slices.Sorted(maps.Keys(file)) {
+			s, ok := lookup(key)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", *configFile, key))
+				continue
+			}
+
+			// a config file may be shared by nodes of different roles
+			if !s.appliesTo(role) {
+				continue
+			}
+
+			if err := s.set(cfg, file[key]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid %s: %w", *configFile, key, err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if !s.appliesTo(role) {
+			continue
+		}
+
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			if err := s.set(cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", s.env, err))
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag() == f.Name && s.appliesTo(role) {
+				if err := s.set(cfg, *values[s.key]); err != nil {
+					errs = append(errs, fmt.Errorf("invalid -%s: %w", f.Name, err))
+				}
+			}
+		}
+	})
+
+	if err := errors.Join(append(errs, cfg.validate()...)...); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Usage describes the flags of role.
+func Usage(role Role) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "usage of %s:\n  -config\n\tconfig file, JSON or key = value lines (env %s)\n", role, EnvConfigFile)
+
+	for _, s := range settings {
+		if s.appliesTo(role) {
+			fmt.Fprintf(&b, "  -%s\n\t%s (env %s, config file key %s)\n", s.flag(), s.usage, s.env, s.key)
+		}
+	}
+
+	return b.String()
+}
+
+func lookup(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+
+	return setting{}, false
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// validate returns every problem found in the settings.
+func (c *Config) validate() []error {
+	var errs []error
+
+	if port, err := strconv.Atoi(c.Port); c.Port == "" {
+		errs = append(errs, errors.New("port is required"))
+	} else if err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port %q is not a number between 1 and 65535", c.Port))
+	}
+
+	switch c.Role {
+	case RoleLeader:
+		for _, replica := range c.Replicas {
+			if err := validateURL(replica); err != nil {
+				errs = append(errs, fmt.Errorf("replica %w", err))
+			}
+		}
+
+		if c.MaxTextLength <= 0 {
+			errs = append(errs, fmt.Errorf("max_text_length must be positive, got %d", c.MaxTextLength))
+		}
+
+		if c.QueueLimit <= 0 {
+			errs = append(errs, fmt.Errorf("queue_limit must be positive, got %d", c.QueueLimit))
+		}
+
+		if c.BatchInterval < 0 {
+			errs = append(errs, fmt.Errorf("batch_interval must not be negative, got %s", c.BatchInterval))
+		}
+
+		if c.BatchSize <= 0 {
+			errs = append(errs, fmt.Errorf("batch_size must be positive, got %d", c.BatchSize))
+		}
+
+		if c.AckTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("ack_timeout must be positive, got %s", c.AckTimeout))
+		}
+
+		if c.HeartbeatInterval < 0 {
+			errs = append(errs, fmt.Errorf("heartbeat_interval must not be negative, got %s", c.HeartbeatInterval))
+		}
+
+		if c.HeartbeatMisses <= 0 {
+			errs = append(errs, fmt.Errorf("heartbeat_misses must be positive, got %d", c.HeartbeatMisses))
+		}
+	case RoleReplica:
+		if c.Leader == "" {
+			errs = append(errs, errors.New("leader is required, a replica can not run without a leader"))
+		} else if err := validateURL(c.Leader); err != nil {
+			errs = append(errs, fmt.Errorf("leader %w", err))
+		}
+
+		if c.AdvertiseURL != "" {
+			if err := validateURL(c.AdvertiseURL); err != nil {
+				errs = append(errs, fmt.Errorf("advertise_url %w", err))
+			}
+
+			if c.ReplicationMode == server.ReplicationPull {
+				errs = append(errs, errors.New("advertise_url is only used in push replication mode, a pulling replica doesn't join the leader"))
+			}
+		}
+
+		if c.AntiEntropyInterval < 0 {
+			errs = append(errs, fmt.Errorf("anti_entropy_interval must not be negative, got %s", c.AntiEntropyInterval))
+		}
+	}
+
+	if c.Role != RoleLocalReplica && c.MaxBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("max_body_size must be positive, got %d", c.MaxBodySize))
+	}
+
+	if c.ChangelogSize < 0 {
+		errs = append(errs, fmt.Errorf("changelog_size must not be negative, got %d", c.ChangelogSize))
+	}
+
+	if c.BackupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("backup_interval must be positive, got %s", c.BackupInterval))
+	}
+
+	if c.StorageEngine == db.StorageEngineLSM && (c.EncryptionKeyFile != "" || os.Getenv(db.EnvEncryptionKey) != "") {
+		errs = append(errs, errors.New("storage_engine lsm doesn't encrypt its runs, it can not be used with an encryption key"))
+	}
+
+	if _, err := c.level(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("URL %q: %w", raw, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL %q must be an absolute http(s) URL, e.g. http://localhost:8081", raw)
+	}
+
+	return nil
+}
+
+// Dir returns the root directory of the node. Replicas default to one per
+// port so that several of them can run on the same host, the local replica
+// defaults to the leader's.
+func (c *Config) Dir() string {
+	if c.RootDir != "" {
+		return c.RootDir
+	}
+
+	if c.Role == RoleReplica {
+		return fmt.Sprintf("/tmp/memdb-replica-%s", c.Port)
+	}
+
+	return DefaultRootDir
+}
+
+func (c *Config) level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return 0, fmt.Errorf("log_level %q must be one of debug, info, warn, error", c.LogLevel)
+	}
+
+	return level, nil
+}
+
+// Logger returns the logger writing to the configured output and level.
+func (c *Config) Logger() (*slog.Logger, error) {
+	level, err := c.level()
+	if err != nil {
+		return nil, err
+	}
+
+	var output io.Writer
+
+	switch c.LogOutput {
+	case "", "stdout":
+		output = os.Stdout
+	case "stderr":
+		output = os.Stderr
+	default:
+		// kept open for the lifetime of the process
+		file, err := os.OpenFile(c.LogOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log output: %w", err)
+		}
+
+		output = file
+	}
+
+	return slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     level,
+	})), nil
+}
+
+// Keyring loads the encryption keys from the configured key file, or from
+// MEMDB_ENCRYPTION_KEY. It returns nil when neither is set.
+func (c *Config) Keyring() (*db.Keyring, error) {
+	if c.EncryptionKeyFile != "" {
+		return db.LoadKeyring(c.EncryptionKeyFile)
+	}
+
+	if keys := os.Getenv(db.EnvEncryptionKey); keys != "" {
+		return db.ParseKeyring(keys)
+	}
+
+	return nil, nil
+}
+
+// DBOptions returns the database options of the node.
+func (c *Config) DBOptions() ([]db.Option, error) {
+	keyring, err := c.Keyring()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+
+	changelogSize := c.ChangelogSize
+	if c.Role == RoleReplica && !c.ServeDownstream {
+		// only served to downstream replicas
+		changelogSize = 0
+	}
+
+	return []db.Option{
+		db.WithKeyring(keyring),
+		db.WithCompression(c.SnapshotCompression),
+		db.WithStorageEngine(c.StorageEngine),
+		db.WithBackupInterval(c.BackupInterval),
+		db.WithChangelogSize(changelogSize),
+	}, nil
+}
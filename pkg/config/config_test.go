@@ -0,0 +1,189 @@
+package config_test
+
+import (
+	"memdb/pkg/config"
+	"memdb/pkg/db"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	file := path.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	return file
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfig(t, "leader.conf", `
+# shared by the leader and the replicas
+port = 8080
+replicas = ["http://localhost:8081", "http://localhost:8082"]
+leader = "http://localhost:8080"
+backup_interval = "5s"
+max_text_length = 100 # bytes
+storage_engine = "lsm"
+`)
+
+	t.Setenv(config.EnvConfigFile, file)
+	t.Setenv("MEMDB_BACKUP_INTERVAL", "2s")
+	t.Setenv("MEMDB_MAX_TEXT_LENGTH", "200")
+
+	cfg, err := config.Load(config.RoleLeader, []string{"-max-text-length", "300"})
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if cfg.Port != "8080" {
+		t.Errorf("expected port from file, got %q", cfg.Port)
+	}
+
+	if expected := []string{"http://localhost:8081", "http://localhost:8082"}; !reflect.DeepEqual(cfg.Replicas, expected) {
+		t.Errorf("expected replicas %v from file, got %v", expected, cfg.Replicas)
+	}
+
+	if cfg.StorageEngine != db.StorageEngineLSM {
+		t.Errorf("expected storage engine from file, got %q", cfg.StorageEngine)
+	}
+
+	if cfg.BackupInterval != 2*time.Second {
+		t.Errorf("expected backup interval from env, got %s", cfg.BackupInterval)
+	}
+
+	if cfg.MaxTextLength != 300 {
+		t.Errorf("expected max text length from flag, got %d", cfg.MaxTextLength)
+	}
+
+	if cfg.LogLevel != "info" || cfg.SnapshotCompression != db.CompressionNone {
+		t.Errorf("expected defaults for unset settings, got log level %q and compression %q", cfg.LogLevel, cfg.SnapshotCompression)
+	}
+
+	if cfg.Dir() != config.DefaultRootDir {
+		t.Errorf("expected default root dir, got %q", cfg.Dir())
+	}
+}
+
+func TestLoadJSONFile(t *testing.T) {
+	file := writeConfig(t, "replica.json", `{"port": 8081, "leader": "http://localhost:8080", "replicas": ["http://localhost:8081"], "snapshot_compression": "gzip"}`)
+
+	cfg, err := config.Load(config.RoleReplica, []string{"-config", file})
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if cfg.Port != "8081" || cfg.Leader != "http://localhost:8080" {
+		t.Errorf("expected port and leader from file, got %q and %q", cfg.Port, cfg.Leader)
+	}
+
+	if cfg.Dir() != "/tmp/memdb-replica-8081" {
+		t.Errorf("expected a root dir per replica port, got %q", cfg.Dir())
+	}
+
+	if cfg.SnapshotCompression != db.CompressionGzip {
+		t.Errorf("expected snapshot compression from file, got %q", cfg.SnapshotCompression)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     config.Role
+		args     []string
+		file     string
+		env      map[string]string
+		expected []string
+	}{
+		{
+			name:     "missing settings",
+			role:     config.RoleLeader,
+			expected: []string{"port is required"},
+		},
+		{
+			name:     "invalid values",
+			role:     config.RoleLeader,
+			args:     []string{"-port", "99999", "-replicas", "localhost:8081", "-log-level", "loud"},
+			expected: []string{"port \"99999\"", "replica URL \"localhost:8081\"", "log_level \"loud\""},
+		},
+		{
+			name:     "unparsable value",
+			role:     config.RoleReplica,
+			args:     []string{"-port", "8081", "-leader", "http://localhost:8080", "-backup-interval", "often"},
+			expected: []string{"invalid -backup-interval"},
+		},
+		{
+			name:     "pulling replica joining",
+			role:     config.RoleReplica,
+			args:     []string{"-port", "8081", "-leader", "http://localhost:8080", "-replication-mode", "pull", "-advertise-url", "http://localhost:8081"},
+			expected: []string{"advertise_url is only used in push replication mode"},
+		},
+		{
+			name:     "lsm engine with encryption",
+			role:     config.RoleLeader,
+			args:     []string{"-port", "8080", "-storage-engine", "lsm", "-encryption-key-file", "/etc/memdb/keys"},
+			expected: []string{"storage_engine lsm doesn't encrypt its runs"},
+		},
+		{
+			name:     "positional argument",
+			role:     config.RoleReplica,
+			args:     []string{"8081"},
+			expected: []string{"unexpected argument \"8081\""},
+		},
+		{
+			name:     "unknown file setting",
+			role:     config.RoleReplica,
+			file:     "port = 8081\nreplica_count = 3\n",
+			expected: []string{"unknown setting \"replica_count\""},
+		},
+		{
+			name: "errors of every source",
+			role: config.RoleReplica,
+			args: []string{"-backup-interval", "often", "-leader", "localhost:8080"},
+			file: "port = 8081\nreplica_count = 3\n",
+			env:  map[string]string{"MEMDB_CHANGELOG_SIZE": "many"},
+			expected: []string{
+				"unknown setting \"replica_count\"",
+				"invalid MEMDB_CHANGELOG_SIZE",
+				"invalid -backup-interval",
+				"leader URL \"localhost:8080\"",
+			},
+		},
+		{
+			name:     "malformed file",
+			role:     config.RoleReplica,
+			file:     "port 8081\n",
+			expected: []string{"line 1: expected key = value"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"-config", writeConfig(t, "memdb.conf", test.file)}, args...)
+			}
+
+			_, err := config.Load(test.role, args)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+
+			for _, expected := range test.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected error to contain %q, got %q", expected, err)
+				}
+			}
+		})
+	}
+}
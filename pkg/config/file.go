@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readFile reads the settings of a config file, either a JSON object or
+// TOML-like key = value lines:
+//
+//	# comment
+//	port = 8080
+//	replicas = ["http://localhost:8081", "http://localhost:8082"]
+//	backup_interval = "1s"
+//
+// Lists are returned comma separated, like in environment variables.
+func readFile(name string) (map[string]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		values, err := parseJSON(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		return values, nil
+	}
+
+	values, err := parseLines(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return values, nil
+}
+
+func parseJSON(data []byte) (map[string]string, error) {
+	raw := map[string]any{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for key, value := range raw {
+		str, err := jsonString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		values[key] = str
+	}
+
+	return values, nil
+}
+
+func jsonString(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		items := []string{}
+		for _, item := range v {
+			str, err := jsonString(item)
+			if err != nil {
+				return "", err
+			}
+
+			items = append(items, str)
+		}
+
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+func parseLines(data string) (map[string]string, error) {
+	values := map[string]string{}
+
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+
+		parsed, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		values[strings.TrimSpace(key)] = parsed
+	}
+
+	return values, nil
+}
+
+// parseValue parses a quoted string, a list of quoted strings or a bare value
+// followed by an optional comment.
+func parseValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return "", fmt.Errorf("malformed string %s", value)
+		}
+
+		if rest := strings.TrimSpace(value[len(quoted):]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+
+		return strconv.Unquote(quoted)
+	case strings.HasPrefix(value, "["):
+		end := strings.LastIndex(value, "]")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated list %s", value)
+		}
+
+		items := []string{}
+		for _, item := range strings.Split(value[1:end], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+
+			parsed, err := parseValue(item)
+			if err != nil {
+				return "", err
+			}
+
+			items = append(items, parsed)
+		}
+
+		return strings.Join(items, ","), nil
+	default:
+		value, _, _ = strings.Cut(value, "#")
+
+		return strings.TrimSpace(value), nil
+	}
+}
@@ -0,0 +1,82 @@
+package db
+
+import "sort"
+
+const (
+	// changes kept by the leader for replicas to catch up from
+	DefaultChangelogSize = 10000
+)
+
+// changelog keeps the most recent changes of a node, in a ring of contiguous
+// seqs of the current term. A change may merge several seqs, as applied by
+// replicas.
+type changelog struct {
+	changes []Change
+	// index of the oldest change
+	start int
+	size  int
+}
+
+func newChangelog(limit int) *changelog {
+	return &changelog{changes: make([]Change, limit)}
+}
+
+// add appends change, dropping the oldest one when the changelog is full. A
+// change that doesn't follow the newest one starts the changelog over.
+func (c *changelog) add(change Change) {
+	if len(c.changes) == 0 {
+		return
+	}
+
+	if c.size > 0 {
+		last := c.changes[(c.start+c.size-1)%len(c.changes)]
+		if change.First() != last.Seq+1 || change.Term != last.Term {
+			c.reset()
+		}
+	}
+
+	if c.size == len(c.changes) {
+		c.changes[c.start] = change
+		c.start = (c.start + 1) % len(c.changes)
+
+		return
+	}
+
+	c.changes[(c.start+c.size)%len(c.changes)] = change
+	c.size++
+}
+
+// since returns the changes after seq, false when some of them were already
+// dropped or seq is in the middle of a merged change. The caller checks that
+// seq is not ahead of the node.
+func (c *changelog) since(seq uint64) ([]Change, bool) {
+	if c.size == 0 || seq+1 < c.at(0).First() {
+		return nil, false
+	}
+
+	i := sort.Search(c.size, func(i int) bool {
+		return c.at(i).Seq > seq
+	})
+
+	if i < c.size && c.at(i).First() <= seq {
+		return nil, false
+	}
+
+	changes := []Change{}
+	for ; i < c.size; i++ {
+		changes = append(changes, c.at(i))
+	}
+
+	return changes, true
+}
+
+// at returns the i-th oldest change.
+func (c *changelog) at(i int) Change {
+	return c.changes[(c.start+i)%len(c.changes)]
+}
+
+// reset drops every change.
+func (c *changelog) reset() {
+	clear(c.changes)
+	c.start, c.size = 0, 0
+}
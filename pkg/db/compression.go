@@ -0,0 +1,102 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	dbErrs "memdb/pkg/errors"
+)
+
+// Compression of snapshot files.
+type Compression string
+
+const (
+	CompressionNone  Compression = "none"
+	CompressionGzip  Compression = "gzip"
+	CompressionFlate Compression = "flate"
+)
+
+// snapshot header flags
+const (
+	flagGzip  uint16 = 1 << 0
+	flagFlate uint16 = 1 << 1
+
+	compressionFlags = flagGzip | flagFlate
+)
+
+// ParseCompression validates a compression name, an empty name means none.
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(name) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionFlate:
+		return Compression(name), nil
+	default:
+		return "", fmt.Errorf("unknown compression %q, expected one of none, gzip, flate", name)
+	}
+}
+
+// compress returns data compressed with c and the header flag recording it.
+func compress(data []byte, c Compression) ([]byte, uint16, error) {
+	var (
+		buf    bytes.Buffer
+		writer io.WriteCloser
+		flag   uint16
+	)
+
+	switch c {
+	case CompressionGzip:
+		writer = gzip.NewWriter(&buf)
+		flag = flagGzip
+	case CompressionFlate:
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		writer = w
+		flag = flagFlate
+	default:
+		return data, 0, nil
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, 0, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), flag, nil
+}
+
+// decompress reverses compress according to the header flags.
+func decompress(data []byte, flags uint16) ([]byte, error) {
+	var reader io.Reader
+
+	switch flags & compressionFlags {
+	case 0:
+		return data, nil
+	case flagGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", dbErrs.ErrCorruptSnapshot, err)
+		}
+
+		reader = r
+	case flagFlate:
+		reader = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("%w: conflicting compression flags %#x", dbErrs.ErrCorruptSnapshot, flags)
+	}
+
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", dbErrs.ErrCorruptSnapshot, err)
+	}
+
+	return out, nil
+}
@@ -1,16 +1,82 @@
 package db
 
-import "time"
+import (
+	"io"
+	"time"
+)
 
 const (
 	BackupFile = "wordcounts.db"
 	writeFreq  = 1 * time.Second
 )
 
+// Change is a delta applied on the leader, Seq is its position in the
+// leader's history and Term identifies that history: seqs only follow each
+// other within a term.
+type Change struct {
+	Seq  uint64 `json:"seq"`
+	Term uint64 `json:"term"`
+	// first seq of the changes merged into this one, 0 for a single change
+	FirstSeq uint64         `json:"first_seq,omitempty"`
+	Updates  map[string]int `json:"updates"`
+}
+
+// First returns the seq of the first change merged into c.
+func (c Change) First() uint64 {
+	if c.FirstSeq == 0 {
+		return c.Seq
+	}
+
+	return c.FirstSeq
+}
+
 type Leader interface {
-	CountWords(text string) map[string]int
+	CountWords(text string) (Change, error)
 	GetWordCount(word string) int
 	GetWordsCounts() map[string]int
+	// Snapshot returns a copy of the word counts along with its position.
+	Snapshot() Snapshot
+	// View returns the word counts along with their position without copying
+	// them, release must be called once done with them.
+	View() (snap Snapshot, release func())
+	// WriteSnapshot streams a view to w in the snapshot format.
+	WriteSnapshot(w io.Writer, snap Snapshot) error
+	// ChangesSince returns the changes made after seq in term, or
+	// ErrPositionTruncated when they are not all kept anymore.
+	ChangesSince(term uint64, seq uint64) ([]Change, error)
+	// Position returns the seq of the last change made.
+	Position() uint64
+	// Term returns the term of the leader history.
+	Term() uint64
+	// Backup writes a consistent snapshot of the current state to w.
+	Backup(w io.Writer) error
+	// Restore replaces the current state with a snapshot read from r.
+	Restore(r io.Reader) error
+	Generations() ([]Generation, error)
+	RestoreGeneration(id string) error
+	// Digest returns the digest of the word counts over buckets buckets.
+	Digest(buckets int) (Digest, error)
+	// DigestAt returns the digest as of a position the changelog reaches
+	// back to.
+	DigestAt(term uint64, seq uint64, buckets int) (Digest, error)
+	// DigestBuckets returns the word counts in the given buckets of a digest,
+	// as of a position like DigestAt.
+	DigestBuckets(term uint64, seq uint64, buckets int, ids []int) (Snapshot, error)
+}
+
+// Upstream is the state a node serves to the replicas syncing from it, the
+// leader or a replica serving downstream replicas.
+type Upstream interface {
+	View() (snap Snapshot, release func())
+	// WriteSnapshot streams a view to w in the snapshot format, spooling it
+	// in the node rootDir.
+	WriteSnapshot(w io.Writer, snap Snapshot) error
+	ChangesSince(term uint64, seq uint64) ([]Change, error)
+	Digest(buckets int) (Digest, error)
+	DigestAt(term uint64, seq uint64, buckets int) (Digest, error)
+	DigestBuckets(term uint64, seq uint64, buckets int, ids []int) (Snapshot, error)
+	Position() uint64
+	Term() uint64
 }
 
 // Remote Replica
@@ -18,6 +84,26 @@ type Replica interface {
 	GetWordCount(word string) int
 	AddWordCount(word string, count int)
 	SetWordsCounts(wordCounts map[string]int)
+	// Apply adds a leader change to the word counts.
+	Apply(change Change)
+	// Reset replaces the word counts with a leader snapshot.
+	Reset(snap Snapshot)
+	// Position returns the seq of the last leader change applied.
+	Position() uint64
+	// Term returns the leader term of the last change applied.
+	Term() uint64
+	// Digest returns the digest of the word counts over buckets buckets.
+	Digest(buckets int) (Digest, error)
+	// Repair replaces the word counts in the given buckets of a digest with
+	// the leader ones.
+	Repair(snap Snapshot, buckets int, ids []int) (int, error)
+	// View, WriteSnapshot, ChangesSince, DigestAt and DigestBuckets serve
+	// downstream replicas.
+	View() (snap Snapshot, release func())
+	WriteSnapshot(w io.Writer, snap Snapshot) error
+	ChangesSince(term uint64, seq uint64) ([]Change, error)
+	DigestAt(term uint64, seq uint64, buckets int) (Digest, error)
+	DigestBuckets(term uint64, seq uint64, buckets int, ids []int) (Snapshot, error)
 }
 
 type LocalReplica interface {
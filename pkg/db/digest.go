@@ -0,0 +1,214 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	dbErrs "memdb/pkg/errors"
+)
+
+const (
+	// buckets the words are spread over by digests
+	DefaultDigestBuckets = 256
+	// most buckets of a digest
+	MaxDigestBuckets = 1 << 16
+)
+
+// Digest summarizes the word counts of a node at a position: the words are
+// spread over buckets by hash, and each bucket holds the sum of the hashes of
+// its words and their counts. Nodes with the same word counts have the same
+// digest, the buckets that differ tell which words to compare.
+type Digest struct {
+	Seq     uint64   `json:"seq"`
+	Term    uint64   `json:"term"`
+	Buckets []uint64 `json:"buckets"`
+}
+
+// DigestBucket returns the bucket of word in a digest of buckets buckets.
+func DigestBucket(word string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(word))
+
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// Diff returns the buckets that differ between d and other, every bucket when
+// they don't have as many.
+func (d Digest) Diff(other Digest) []int {
+	var diff []int
+
+	for i := range max(len(d.Buckets), len(other.Buckets)) {
+		if len(d.Buckets) != len(other.Buckets) || d.Buckets[i] != other.Buckets[i] {
+			diff = append(diff, i)
+		}
+	}
+
+	return diff
+}
+
+// newDigest returns the digest of entries over buckets buckets. Words counted
+// 0 are left out, they are the same as missing words.
+func newDigest(seq uint64, term uint64, buckets int, entries Entries) (Digest, error) {
+	digest := Digest{Seq: seq, Term: term, Buckets: make([]uint64, buckets)}
+
+	err := entries(func(word string, count int) bool {
+		if count != 0 {
+			digest.Buckets[DigestBucket(word, buckets)] += entryHash(word, count)
+		}
+
+		return true
+	})
+
+	return digest, err
+}
+
+// bucketWords returns the words of entries in the given buckets.
+func bucketWords(buckets int, ids []int, entries Entries) (map[string]int, error) {
+	wanted := make([]bool, buckets)
+	for _, id := range ids {
+		if id >= 0 && id < buckets {
+			wanted[id] = true
+		}
+	}
+
+	words := make(map[string]int)
+
+	err := entries(func(word string, count int) bool {
+		if count != 0 && wanted[DigestBucket(word, buckets)] {
+			words[word] = count
+		}
+
+		return true
+	})
+
+	return words, err
+}
+
+func entryHash(word string, count int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(word))
+	h.Write([]byte{0})
+	h.Write(binary.AppendVarint(nil, int64(count)))
+
+	return h.Sum64()
+}
+
+// viewer is a node whose word counts are read from a frozen view, without
+// holding up its writes.
+type viewer interface {
+	View() (Snapshot, func())
+	viewAt(term uint64, seq uint64) (Snapshot, func(), error)
+}
+
+func viewDigest(node viewer, buckets int) (Digest, error) {
+	snap, release := node.View()
+	defer release()
+
+	return newDigest(snap.Seq, snap.Term, buckets, snap.Entries())
+}
+
+func viewDigestAt(node viewer, term uint64, seq uint64, buckets int) (Digest, error) {
+	snap, release, err := node.viewAt(term, seq)
+	if err != nil {
+		return Digest{}, err
+	}
+
+	defer release()
+
+	return newDigest(snap.Seq, snap.Term, buckets, snap.Entries())
+}
+
+func viewDigestBuckets(node viewer, term uint64, seq uint64, buckets int, ids []int) (Snapshot, error) {
+	snap, release, err := node.viewAt(term, seq)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	defer release()
+
+	words, err := bucketWords(buckets, ids, snap.Entries())
+
+	return Snapshot{Seq: seq, Term: term, WordCount: words}, err
+}
+
+// Digest returns the digest of the word counts over buckets buckets.
+func (db *BaseLeader) Digest(buckets int) (Digest, error) {
+	return viewDigest(db, buckets)
+}
+
+// DigestAt returns the digest of the word counts as of position seq of term,
+// or ErrPositionTruncated when the changelog doesn't reach back to it.
+func (db *BaseLeader) DigestAt(term uint64, seq uint64, buckets int) (Digest, error) {
+	return viewDigestAt(db, term, seq, buckets)
+}
+
+// DigestBuckets returns the word counts in the given buckets of a digest of
+// buckets buckets, as of position seq of term like DigestAt.
+func (db *BaseLeader) DigestBuckets(term uint64, seq uint64, buckets int, ids []int) (Snapshot, error) {
+	return viewDigestBuckets(db, term, seq, buckets, ids)
+}
+
+// Digest returns the digest of the word counts over buckets buckets.
+func (db *BaseReplica) Digest(buckets int) (Digest, error) {
+	return viewDigest(db, buckets)
+}
+
+// DigestAt returns the digest of the word counts as of position seq of term,
+// see BaseLeader.DigestAt.
+func (db *BaseReplica) DigestAt(term uint64, seq uint64, buckets int) (Digest, error) {
+	return viewDigestAt(db, term, seq, buckets)
+}
+
+// DigestBuckets returns the word counts in the given buckets of a digest of
+// buckets buckets, as of position seq of term.
+func (db *BaseReplica) DigestBuckets(term uint64, seq uint64, buckets int, ids []int) (Snapshot, error) {
+	return viewDigestBuckets(db, term, seq, buckets, ids)
+}
+
+// Repair replaces the word counts in the given buckets of a digest of buckets
+// buckets with the leader ones of snap, as returned by DigestBuckets. The
+// replica may have moved past the snap position since: its own word counts
+// are rolled back to it, and the difference is added to the current ones. It
+// is refused with ErrPositionMoved when the changelog doesn't reach back to
+// the snap position. It returns the number of words whose count changed.
+func (db *BaseReplica) Repair(snap Snapshot, buckets int, ids []int) (int, error) {
+	// held until the repair is added, so that the state isn't replaced
+	// meanwhile
+	view, release, err := db.viewAt(snap.Term, snap.Seq)
+	if errors.Is(err, dbErrs.ErrPositionTruncated) {
+		return 0, dbErrs.ErrPositionMoved
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	local, err := bucketWords(buckets, ids, view.Entries())
+	if err != nil {
+		return 0, err
+	}
+
+	updates := make(map[string]int)
+
+	for word, count := range local {
+		if delta := snap.WordCount[word] - count; delta != 0 {
+			updates[word] = delta
+		}
+	}
+
+	for word, count := range snap.WordCount {
+		if _, ok := local[word]; !ok && count != 0 {
+			updates[word] = count
+		}
+	}
+
+	if len(updates) > 0 {
+		db.lock.Lock()
+		db.add(updates)
+		db.lock.Unlock()
+	}
+
+	return len(updates), nil
+}
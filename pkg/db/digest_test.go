@@ -0,0 +1,98 @@
+package db_test
+
+import (
+	"errors"
+	"log/slog"
+	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"testing"
+)
+
+func TestDigestRepair(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leader.Close()
+
+	for _, text := range []string{"the quick brown fox", "jumps over the lazy dog"} {
+		if _, err := leader.CountWords(text); err != nil {
+			t.Fatalf("failed to count words: %v", err)
+		}
+	}
+
+	replica := db.NewReplica(logger)
+	replica.Reset(leader.Snapshot())
+
+	digest, err := leader.Digest(db.DefaultDigestBuckets)
+	if err != nil {
+		t.Fatalf("failed to compute leader digest: %v", err)
+	}
+
+	local, err := replica.Digest(db.DefaultDigestBuckets)
+	if err != nil {
+		t.Fatalf("failed to compute replica digest: %v", err)
+	}
+
+	if diff := local.Diff(digest); len(diff) != 0 {
+		t.Fatalf("expected identical digests, got %d divergent buckets", len(diff))
+	}
+
+	// drift: a wrong count, a missing word and an extra word
+	replica.AddWordCount("the", 3)
+	replica.AddWordCount("fox", -1)
+	replica.AddWordCount("cat", 1)
+
+	local, _ = replica.Digest(db.DefaultDigestBuckets)
+
+	diff := local.Diff(digest)
+	if len(diff) == 0 || len(diff) > 3 {
+		t.Fatalf("expected 1 to 3 divergent buckets, got %d", len(diff))
+	}
+
+	// both move on before the repair, which is made as of the digest position
+	change, err := leader.CountWords("the end")
+	if err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	replica.Apply(change)
+
+	snap, err := leader.DigestBuckets(local.Term, local.Seq, db.DefaultDigestBuckets, diff)
+	if err != nil {
+		t.Fatalf("failed to read leader buckets: %v", err)
+	}
+
+	if _, err := leader.DigestAt(local.Term, local.Seq+2, db.DefaultDigestBuckets); !errors.Is(err, dbErrs.ErrPositionTruncated) {
+		t.Fatalf("expected a digest ahead of the leader to be refused, got %v", err)
+	}
+
+	if _, err := replica.Repair(db.Snapshot{Seq: snap.Seq + 2, Term: snap.Term}, db.DefaultDigestBuckets, diff); !errors.Is(err, dbErrs.ErrPositionMoved) {
+		t.Fatalf("expected a repair ahead of the replica to be refused, got %v", err)
+	}
+
+	repaired, err := replica.Repair(snap, db.DefaultDigestBuckets, diff)
+	if err != nil {
+		t.Fatalf("failed to repair: %v", err)
+	}
+
+	if repaired != 3 {
+		t.Errorf("expected 3 words repaired, got %d", repaired)
+	}
+
+	for word, expected := range map[string]int{"the": 3, "fox": 1, "cat": 0, "dog": 1, "end": 1} {
+		if count := replica.GetWordCount(word); count != expected {
+			t.Errorf("expected %q counted %d after the repair, got %d", word, expected, count)
+		}
+	}
+
+	digest, _ = leader.Digest(db.DefaultDigestBuckets)
+
+	local, _ = replica.Digest(db.DefaultDigestBuckets)
+	if diff := local.Diff(digest); len(diff) != 0 {
+		t.Errorf("expected identical digests after the repair, got %d divergent buckets", len(diff))
+	}
+}
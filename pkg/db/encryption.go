@@ -0,0 +1,174 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"strings"
+)
+
+const (
+	// snapshot header flag
+	flagEncrypted uint16 = 1 << 2
+
+	keySize   = 32 // AES-256
+	keyIDSize = 4
+)
+
+// Keyring holds the AES-256 keys used to encrypt files at rest. New files are
+// encrypted with the current (first) key, the previous keys are only used to
+// decrypt files written before a key rotation.
+type Keyring struct {
+	keys []keyringKey
+}
+
+type keyringKey struct {
+	id   uint32
+	aead cipher.AEAD
+}
+
+// ParseKeyring parses keys separated by newlines or commas, the first one is
+// the current key. Each key is 32 bytes, hex or base64 encoded.
+func ParseKeyring(data string) (*Keyring, error) {
+	keyring := &Keyring{}
+
+	fields := strings.FieldsFunc(data, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		key, err := decodeKey(field)
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(key)
+		keyring.keys = append(keyring.keys, keyringKey{
+			id:   binary.BigEndian.Uint32(sum[:keyIDSize]),
+			aead: aead,
+		})
+	}
+
+	if len(keyring.keys) == 0 {
+		return nil, fmt.Errorf("%w: no key found", dbErrs.ErrEncryptionKey)
+	}
+
+	return keyring, nil
+}
+
+// LoadKeyring reads a keyring from a key file, see ParseKeyring.
+func LoadKeyring(keyFile string) (*Keyring, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeyring(string(data))
+}
+
+func decodeKey(field string) ([]byte, error) {
+	if key, err := hex.DecodeString(field); err == nil && len(key) == keySize {
+		return key, nil
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(field); err == nil && len(key) == keySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: expected a %d bytes hex or base64 encoded key", dbErrs.ErrEncryptionKey, keySize)
+}
+
+func (k *Keyring) currentID() uint32 {
+	return k.keys[0].id
+}
+
+// seal encrypts data with the current key: key id | nonce | ciphertext.
+func (k *Keyring) seal(data []byte, additional []byte) ([]byte, error) {
+	key := k.keys[0]
+
+	nonceSize := key.aead.NonceSize()
+	out := make([]byte, keyIDSize+nonceSize, keyIDSize+nonceSize+len(data)+key.aead.Overhead())
+	binary.BigEndian.PutUint32(out[0:keyIDSize], key.id)
+
+	if _, err := rand.Read(out[keyIDSize:]); err != nil {
+		return nil, err
+	}
+
+	return key.aead.Seal(out, out[keyIDSize:], data, additional), nil
+}
+
+// open decrypts data sealed with any key of the keyring and returns the id
+// of the key it was sealed with.
+func (k *Keyring) open(data []byte, additional []byte) ([]byte, uint32, error) {
+	if k == nil {
+		return nil, 0, fmt.Errorf("%w: file is encrypted but no key is configured", dbErrs.ErrEncryptionKey)
+	}
+
+	if len(data) < keyIDSize {
+		return nil, 0, fmt.Errorf("%w: truncated encrypted data", dbErrs.ErrEncryptionKey)
+	}
+
+	id := binary.BigEndian.Uint32(data[0:keyIDSize])
+
+	for _, key := range k.keys {
+		if key.id != id {
+			continue
+		}
+
+		nonceSize := key.aead.NonceSize()
+		if len(data) < keyIDSize+nonceSize {
+			return nil, 0, fmt.Errorf("%w: truncated encrypted data", dbErrs.ErrEncryptionKey)
+		}
+
+		plain, err := key.aead.Open(nil, data[keyIDSize:keyIDSize+nonceSize], data[keyIDSize+nonceSize:], additional)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %w", dbErrs.ErrEncryptionKey, err)
+		}
+
+		return plain, id, nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: no key with id %08x in the keyring", dbErrs.ErrEncryptionKey, id)
+}
+
+const (
+	EnvEncryptionKey     = "MEMDB_ENCRYPTION_KEY"
+	EnvEncryptionKeyFile = "MEMDB_ENCRYPTION_KEY_FILE"
+)
+
+// KeyringFromEnv loads the keyring from the file named by
+// MEMDB_ENCRYPTION_KEY_FILE or from MEMDB_ENCRYPTION_KEY. It returns nil
+// when neither is set, meaning files are not encrypted.
+func KeyringFromEnv() (*Keyring, error) {
+	if keyFile := os.Getenv(EnvEncryptionKeyFile); keyFile != "" {
+		return LoadKeyring(keyFile)
+	}
+
+	if keys := os.Getenv(EnvEncryptionKey); keys != "" {
+		return ParseKeyring(keys)
+	}
+
+	return nil, nil
+}
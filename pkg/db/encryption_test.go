@@ -0,0 +1,160 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKey    = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	rotatedKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func TestEncryptedSnapshot(t *testing.T) {
+	keyring, err := db.ParseKeyring(testKey)
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	data, err := db.EncodeSnapshot(db.Snapshot{Seq: 3, WordCount: map[string]int{"secret": 1}}, db.WithKeyring(keyring))
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("expected encrypted snapshot not to contain plaintext words")
+	}
+
+	if _, err := db.DecodeSnapshot(data); !errors.Is(err, dbErrs.ErrEncryptionKey) {
+		t.Errorf("expected encryption key error without a keyring, got %v", err)
+	}
+
+	other, err := db.ParseKeyring(rotatedKey)
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	if _, err := db.DecodeSnapshot(data, db.WithKeyring(other)); !errors.Is(err, dbErrs.ErrEncryptionKey) {
+		t.Errorf("expected encryption key error with the wrong key, got %v", err)
+	}
+
+	snap, err := db.DecodeSnapshot(data, db.WithKeyring(keyring))
+	if err != nil {
+		t.Fatalf("failed to decode snapshot: %v", err)
+	}
+
+	if snap.Seq != 3 || snap.WordCount["secret"] != 1 {
+		t.Errorf("unexpected snapshot after round trip: %+v", snap)
+	}
+}
+
+func TestEncryptedPersistenceAndKeyRotation(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	keyring, err := db.ParseKeyring(testKey)
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	leader, err := db.NewLeader(rootDir, logger, db.WithKeyring(keyring))
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	if _, err := leader.CountWords("secret"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	if _, err := leader.CountWords("classified"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	leader.Close()
+
+	for _, name := range []string{db.BackupFile, db.LogFile} {
+		data, err := os.ReadFile(path.Join(rootDir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+
+		if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("classified")) {
+			t.Errorf("expected %s not to contain plaintext words", name)
+		}
+	}
+
+	// the local replica reads the leader's files with the same key
+	localReplica := db.NewLocalReplica(rootDir, logger, db.WithKeyring(keyring))
+	if err := localReplica.Update(); err != nil {
+		t.Fatalf("failed to update local replica: %v", err)
+	}
+
+	if got := localReplica.GetWordCount("secret"); got != 1 {
+		t.Errorf("expected 1 for word secret on the local replica, got %d", got)
+	}
+
+	// rotate: new current key, the old one is kept to decrypt existing files
+	rotated, err := db.ParseKeyring(strings.Join([]string{rotatedKey, testKey}, "\n"))
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	leader, err = db.NewLeader(rootDir, logger, db.WithKeyring(rotated))
+	if err != nil {
+		t.Fatalf("failed to restore leader with rotated keys: %v", err)
+	}
+
+	if got := leader.GetWordCount("classified"); got != 1 {
+		t.Errorf("expected 1 for word classified, got %d", got)
+	}
+
+	// the next snapshot is written with the new key
+	time.Sleep(1500 * time.Millisecond)
+
+	leader.Close()
+
+	newKeyOnly, err := db.ParseKeyring(rotatedKey)
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	data, err := os.ReadFile(path.Join(rootDir, db.BackupFile))
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+
+	snap, err := db.DecodeSnapshot(data, db.WithKeyring(newKeyOnly))
+	if err != nil {
+		t.Fatalf("expected snapshot to be re-encrypted with the new key: %v", err)
+	}
+
+	if snap.WordCount["secret"] != 1 || snap.WordCount["classified"] != 1 {
+		t.Errorf("unexpected word counts after key rotation: %v", snap.WordCount)
+	}
+}
+
+func TestEncryptionRefusesLSMEngine(t *testing.T) {
+	keyring, err := db.ParseKeyring(testKey)
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	// runs are not encrypted, they would hold the word counts in the clear
+	_, err = db.NewLeader(t.TempDir(), logger, db.WithKeyring(keyring), db.WithStorageEngine(db.StorageEngineLSM))
+	if !errors.Is(err, dbErrs.ErrEncryptionKey) {
+		t.Fatalf("expected an encryption key error, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"log/slog"
+	dbErrs "memdb/pkg/errors"
+	"path"
+)
+
+// Engine stores the word counts of a node. Get and Range may be called
+// concurrently with each other, but not with Add or Replace.
+type Engine interface {
+	// Get returns the count of word, 0 when it is missing.
+	Get(word string) (int, error)
+	// Add increments the count of every word in updates.
+	Add(updates map[string]int) error
+	// Range yields every word count in key order.
+	Range(yield func(word string, count int) bool) error
+	// Replace drops every word count and loads entries, sorted by key.
+	Replace(entries Entries) error
+	Close() error
+}
+
+// StorageEngine selects the Engine of a node.
+type StorageEngine string
+
+const (
+	// every word count is kept in a Go map
+	StorageEngineMap StorageEngine = "map"
+	// word counts are kept in sorted runs on disk, see lsmEngine
+	StorageEngineLSM StorageEngine = "lsm"
+
+	// directory under rootDir holding the files of the lsm engine
+	EngineDir = "engine"
+)
+
+// ParseStorageEngine validates a storage engine name, an empty name means map.
+func ParseStorageEngine(name string) (StorageEngine, error) {
+	switch StorageEngine(name) {
+	case "", StorageEngineMap:
+		return StorageEngineMap, nil
+	case StorageEngineLSM:
+		return StorageEngineLSM, nil
+	default:
+		return "", fmt.Errorf("unknown storage engine %q, expected one of map, lsm", name)
+	}
+}
+
+// openEngine opens the engine of a node persisting its state in rootDir.
+func openEngine(rootDir string, o options, logger *slog.Logger) (Engine, error) {
+	switch o.engine {
+	case StorageEngineLSM:
+		if o.keyring != nil {
+			// its runs would hold the word counts in the clear
+			return nil, fmt.Errorf("%w: the lsm storage engine doesn't encrypt its runs", dbErrs.ErrEncryptionKey)
+		}
+
+		return OpenLSMEngine(path.Join(rootDir, EngineDir), o.lsm, logger)
+	default:
+		return NewMapEngine(), nil
+	}
+}
+
+// MapEngine keeps every word count in memory.
+type MapEngine struct {
+	wordCount map[string]int
+}
+
+func NewMapEngine() *MapEngine {
+	return &MapEngine{wordCount: make(map[string]int)}
+}
+
+func (e *MapEngine) Get(word string) (int, error) {
+	return e.wordCount[word], nil
+}
+
+func (e *MapEngine) Add(updates map[string]int) error {
+	for word, count := range updates {
+		e.wordCount[word] += count
+	}
+
+	return nil
+}
+
+func (e *MapEngine) Range(yield func(word string, count int) bool) error {
+	return mapEntries(e.wordCount)(yield)
+}
+
+func (e *MapEngine) Replace(entries Entries) error {
+	wordCount := make(map[string]int)
+
+	if err := entries(func(word string, count int) bool {
+		wordCount[word] = count
+		return true
+	}); err != nil {
+		return err
+	}
+
+	e.wordCount = wordCount
+
+	return nil
+}
+
+func (e *MapEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,280 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestEngines(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	// a tiny memtable and cache so that flushes, merges and evictions happen
+	lsm, err := db.OpenLSMEngine(t.TempDir(), db.LSMConfig{MemtableSize: 50, CacheBlocks: 2}, logger)
+	if err != nil {
+		t.Fatalf("failed to open lsm engine: %v", err)
+	}
+	defer lsm.Close()
+
+	engines := map[string]db.Engine{
+		"map": db.NewMapEngine(),
+		"lsm": lsm,
+	}
+
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			expected := make(map[string]int)
+
+			for i := 0; i < 200; i++ {
+				updates := make(map[string]int)
+				for j := 0; j < 10; j++ {
+					word := fmt.Sprintf("word%04d", rnd.Intn(1000))
+					updates[word]++
+					expected[word]++
+				}
+
+				if err := engine.Add(updates); err != nil {
+					t.Fatalf("failed to add updates: %v", err)
+				}
+			}
+
+			checkEngine(t, engine, expected)
+
+			replacement := map[string]int{"hello": 2, "world": 1}
+			if err := engine.Replace(db.Snapshot{WordCount: replacement}.Entries()); err != nil {
+				t.Fatalf("failed to replace engine content: %v", err)
+			}
+
+			checkEngine(t, engine, replacement)
+
+			if count, _ := engine.Get("word0001"); count != 0 {
+				t.Errorf("expected replaced word to be gone, got %d", count)
+			}
+		})
+	}
+}
+
+func checkEngine(t *testing.T, engine db.Engine, expected map[string]int) {
+	t.Helper()
+
+	for word, count := range expected {
+		got, err := engine.Get(word)
+		if err != nil {
+			t.Fatalf("failed to get word %s: %v", word, err)
+		}
+
+		if got != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, got)
+		}
+	}
+
+	words := []string{}
+	if err := engine.Range(func(word string, count int) bool {
+		if expected[word] != count {
+			t.Errorf("expected %d for word %s in range, got %d", expected[word], word, count)
+		}
+
+		words = append(words, word)
+
+		return true
+	}); err != nil {
+		t.Fatalf("failed to range over engine: %v", err)
+	}
+
+	if len(words) != len(expected) {
+		t.Errorf("expected %d words in range, got %d", len(expected), len(words))
+	}
+
+	if !sort.StringsAreSorted(words) {
+		t.Errorf("expected range to be sorted by key")
+	}
+}
+
+func TestLeaderWithLSMEngine(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	opts := []db.Option{
+		db.WithStorageEngine(db.StorageEngineLSM),
+		db.WithLSMConfig(db.LSMConfig{MemtableSize: 4, CacheBlocks: 16}),
+	}
+
+	leader, err := db.NewLeader(rootDir, logger, opts...)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	for _, text := range []string{"a b c d e", "a b c", "f g h i j k", "a"} {
+		if _, err := leader.CountWords(text); err != nil {
+			t.Fatalf("failed to count words: %v", err)
+		}
+	}
+
+	// written from the engine by the periodic backup
+	time.Sleep(1500 * time.Millisecond)
+
+	if _, err := leader.CountWords("a z"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	leader.Close()
+
+	restored, err := db.NewLeader(rootDir, logger, opts...)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer restored.Close()
+
+	expectedCounts := map[string]int{"a": 4, "b": 2, "c": 2, "k": 1, "z": 1}
+	for word, count := range expectedCounts {
+		if got := restored.GetWordCount(word); got != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, got)
+		}
+	}
+
+	if snap := restored.Snapshot(); len(snap.WordCount) != 12 {
+		t.Errorf("expected 12 words in snapshot, got %d", len(snap.WordCount))
+	}
+
+	// restarted from the runs and the write-ahead log, the backup still wrote
+	// a generation for the fallback and the readers of BackupFile
+	generations, _ := restored.Generations()
+	if len(generations) != 1 || generations[0].Seq != 4 {
+		t.Fatalf("expected a snapshot generation at seq 4, got %+v", generations)
+	}
+
+	data, err := os.ReadFile(filepath.Join(rootDir, db.BackupFile))
+	if err != nil {
+		t.Fatalf("failed to read backup file: %v", err)
+	}
+
+	snap, err := db.DecodeSnapshot(data)
+	if err != nil {
+		t.Fatalf("failed to decode backup file: %v", err)
+	}
+
+	if snap.Seq != 4 || len(snap.WordCount) != 11 || snap.WordCount["a"] != 3 {
+		t.Errorf("expected 11 words at seq 4 in backup file, got %d at seq %d", len(snap.WordCount), snap.Seq)
+	}
+}
+
+func TestLSMEngineCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	config := db.LSMConfig{MemtableSize: 10, CacheBlocks: 2}
+
+	lsm, err := db.OpenLSMEngine(dir, config, logger)
+	if err != nil {
+		t.Fatalf("failed to open lsm engine: %v", err)
+	}
+
+	expected := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		word := fmt.Sprintf("word%04d", i%30)
+		expected[word]++
+
+		if err := lsm.Add(map[string]int{word: 1}); err != nil {
+			t.Fatalf("failed to add updates: %v", err)
+		}
+
+		lsm.SetPosition(uint64(i+1), 7)
+	}
+
+	if err := lsm.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	// not checkpointed, left to the write-ahead log
+	if err := lsm.Add(map[string]int{"lost": 1}); err != nil {
+		t.Fatalf("failed to add updates: %v", err)
+	}
+
+	lsm.SetPosition(101, 7)
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("failed to close lsm engine: %v", err)
+	}
+
+	// left over by a flush the manifest never listed
+	orphan := filepath.Join(dir, "run-00000000000000099999.db")
+	if err := os.WriteFile(orphan, []byte("partial"), 0600); err != nil {
+		t.Fatalf("failed to write orphan run: %v", err)
+	}
+
+	reopened, err := db.OpenLSMEngine(dir, config, logger)
+	if err != nil {
+		t.Fatalf("failed to reopen lsm engine: %v", err)
+	}
+	defer reopened.Close()
+
+	if seq, term := reopened.Persisted(); seq != 100 || term != 7 {
+		t.Errorf("expected position 100 of term 7, got %d of term %d", seq, term)
+	}
+
+	checkEngine(t, reopened, expected)
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected orphan run to be removed, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, db.ManifestFile), []byte("{"), 0600); err != nil {
+		t.Fatalf("failed to corrupt manifest: %v", err)
+	}
+
+	if _, err := db.OpenLSMEngine(dir, config, logger); !errors.Is(err, dbErrs.ErrCorruptSnapshot) {
+		t.Errorf("expected a corrupt manifest to be refused, got %v", err)
+	}
+}
+
+func TestLSMEngineConcurrentReads(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	lsm, err := db.OpenLSMEngine(t.TempDir(), db.LSMConfig{MemtableSize: 5, CacheBlocks: 4}, logger)
+	if err != nil {
+		t.Fatalf("failed to open lsm engine: %v", err)
+	}
+	defer lsm.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// reads race with the background flushes and merges
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			lsm.Range(func(string, int) bool { return true })
+			lsm.Get("word0001")
+		}
+	}()
+
+	expected := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		word := fmt.Sprintf("word%04d", i%200)
+		expected[word]++
+
+		if err := lsm.Add(map[string]int{word: 1}); err != nil {
+			t.Fatalf("failed to add updates: %v", err)
+		}
+	}
+
+	if err := lsm.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	checkEngine(t, lsm, expected)
+}
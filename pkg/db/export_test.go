@@ -0,0 +1,19 @@
+package db
+
+import "os"
+
+// BreakLogSync swaps the write-ahead log file of leader for a pipe, which
+// takes writes but fails every fsync.
+func BreakLogSync(leader *BaseLeader) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	leader.wal.lock.Lock()
+	leader.wal.file.Close()
+	leader.wal.file = w
+	leader.wal.lock.Unlock()
+
+	return r, nil
+}
@@ -0,0 +1,264 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	dbErrs "memdb/pkg/errors"
+	"sort"
+)
+
+const (
+	// every indexInterval-th entry of a binary snapshot is referenced from
+	// the footer index
+	indexInterval = 128
+
+	// index offset (8) + index entries (8) + total entries (8)
+	footerSize = 24
+)
+
+// Entries yields word counts in key order until yield returns false.
+type Entries func(yield func(word string, count int) bool) error
+
+// mapEntries returns the entries of wordCount sorted by key.
+func mapEntries(wordCount map[string]int) Entries {
+	return func(yield func(word string, count int) bool) error {
+		words := make([]string, 0, len(wordCount))
+		for word := range wordCount {
+			words = append(words, word)
+		}
+
+		sort.Strings(words)
+
+		for _, word := range words {
+			if !yield(word, wordCount[word]) {
+				return nil
+			}
+		}
+
+		return nil
+	}
+}
+
+// entriesWriter streams entries in the binary snapshot format:
+//
+//	entries: varint key length, key, varint count; sorted by key
+//	index:   varint key length, key, varint entry offset; every indexInterval-th entry
+//	footer:  index offset, index entries, total entries; fixed 8 bytes each
+type entriesWriter struct {
+	w            io.Writer
+	buf          []byte
+	offset       uint64
+	index        []byte
+	indexEntries uint64
+	entries      uint64
+	prev         string
+}
+
+func newEntriesWriter(w io.Writer) *entriesWriter {
+	return &entriesWriter{w: w}
+}
+
+func (ew *entriesWriter) add(word string, count int) error {
+	if ew.entries > 0 && word <= ew.prev {
+		return fmt.Errorf("key %q written out of order", word)
+	}
+
+	if ew.entries%indexInterval == 0 {
+		ew.index = binary.AppendUvarint(ew.index, uint64(len(word)))
+		ew.index = append(ew.index, word...)
+		ew.index = binary.AppendUvarint(ew.index, ew.offset)
+		ew.indexEntries++
+	}
+
+	ew.buf = binary.AppendUvarint(ew.buf[:0], uint64(len(word)))
+	ew.buf = append(ew.buf, word...)
+	ew.buf = binary.AppendVarint(ew.buf, int64(count))
+
+	if _, err := ew.w.Write(ew.buf); err != nil {
+		return err
+	}
+
+	ew.offset += uint64(len(ew.buf))
+	ew.entries++
+	ew.prev = word
+
+	return nil
+}
+
+// write adds every entry of entries, which must be sorted by key, and closes
+// the writer.
+func (ew *entriesWriter) write(entries Entries) error {
+	var err error
+	if rangeErr := entries(func(word string, count int) bool {
+		err = ew.add(word, count)
+		return err == nil
+	}); rangeErr != nil {
+		return rangeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ew.close()
+}
+
+// close writes the index and the footer.
+func (ew *entriesWriter) close() error {
+	footer := binary.BigEndian.AppendUint64(nil, ew.offset)
+	footer = binary.BigEndian.AppendUint64(footer, ew.indexEntries)
+	footer = binary.BigEndian.AppendUint64(footer, ew.entries)
+
+	if _, err := ew.w.Write(ew.index); err != nil {
+		return err
+	}
+
+	_, err := ew.w.Write(footer)
+
+	return err
+}
+
+// encodeEntries serializes entries, which must be sorted by key, in the binary
+// snapshot format.
+func encodeEntries(entries Entries) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := newEntriesWriter(&buf).write(entries); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeWordCounts serializes wordCount in the binary snapshot format.
+func encodeWordCounts(wordCount map[string]int) []byte {
+	// writes to a bytes.Buffer of sorted keys can't fail
+	data, _ := encodeEntries(mapEntries(wordCount))
+
+	return data
+}
+
+// decodeWordCounts parses a binary snapshot payload and cross-checks its
+// footer index against the entries.
+func decodeWordCounts(data []byte) (map[string]int, error) {
+	wordCount := make(map[string]int)
+
+	err := scanEntries(data, func(word string, count int) bool {
+		wordCount[word] = count
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return wordCount, nil
+}
+
+// scanEntries validates a binary snapshot payload and passes its entries to
+// fn in key order. Entries are passed as they are read, so fn may see some
+// of them before a corruption further down is detected.
+func scanEntries(data []byte, fn func(word string, count int) bool) error {
+	if len(data) < footerSize {
+		return fmt.Errorf("%w: truncated footer", dbErrs.ErrCorruptSnapshot)
+	}
+
+	footer := data[len(data)-footerSize:]
+	indexOffset := binary.BigEndian.Uint64(footer[0:8])
+	indexEntries := binary.BigEndian.Uint64(footer[8:16])
+	entries := binary.BigEndian.Uint64(footer[16:24])
+
+	if indexOffset > uint64(len(data)-footerSize) {
+		return fmt.Errorf("%w: index offset out of range", dbErrs.ErrCorruptSnapshot)
+	}
+
+	// entry offset -> key, for the index cross-check
+	offsets := make(map[uint64]string, entries/indexInterval+1)
+
+	var (
+		pos   uint64
+		prev  string
+		count uint64
+		stop  bool
+	)
+
+	for ; pos < indexOffset; count++ {
+		offset := pos
+
+		word, n, err := readString(data[pos:indexOffset])
+		if err != nil {
+			return err
+		}
+
+		pos += uint64(n)
+
+		value, n := binary.Varint(data[pos:indexOffset])
+		if n <= 0 {
+			return fmt.Errorf("%w: malformed count", dbErrs.ErrCorruptSnapshot)
+		}
+
+		pos += uint64(n)
+
+		if count > 0 && word <= prev {
+			return fmt.Errorf("%w: keys out of order", dbErrs.ErrCorruptSnapshot)
+		}
+
+		if count%indexInterval == 0 {
+			offsets[offset] = word
+		}
+
+		if !stop && !fn(word, int(value)) {
+			// keep going, the rest of the payload is still validated
+			stop = true
+		}
+
+		prev = word
+	}
+
+	if count != entries {
+		return fmt.Errorf("%w: expected %d entries, found %d", dbErrs.ErrCorruptSnapshot, entries, count)
+	}
+
+	if uint64(len(offsets)) != indexEntries {
+		return fmt.Errorf("%w: expected %d index entries, found %d", dbErrs.ErrCorruptSnapshot, indexEntries, len(offsets))
+	}
+
+	index := data[indexOffset : len(data)-footerSize]
+	for i := uint64(0); i < indexEntries; i++ {
+		word, n, err := readString(index)
+		if err != nil {
+			return err
+		}
+
+		index = index[n:]
+
+		offset, n := binary.Uvarint(index)
+		if n <= 0 {
+			return fmt.Errorf("%w: malformed index offset", dbErrs.ErrCorruptSnapshot)
+		}
+
+		index = index[n:]
+
+		if offsets[offset] != word {
+			return fmt.Errorf("%w: index entry %q doesn't match entries", dbErrs.ErrCorruptSnapshot, word)
+		}
+	}
+
+	if len(index) != 0 {
+		return fmt.Errorf("%w: trailing index bytes", dbErrs.ErrCorruptSnapshot)
+	}
+
+	return nil
+}
+
+// readString reads a varint length prefixed string and returns the number of
+// bytes consumed.
+func readString(data []byte) (string, int, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return "", 0, fmt.Errorf("%w: malformed key", dbErrs.ErrCorruptSnapshot)
+	}
+
+	return string(data[n : n+int(length)]), n + int(length), nil
+}
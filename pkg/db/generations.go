@@ -0,0 +1,216 @@
+package db
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// directory under rootDir holding the retained snapshot generations
+	SnapshotsDir = "snapshots"
+
+	generationPrefix     = "wordcounts-"
+	generationSuffix     = ".db"
+	generationTimeLayout = "20060102T150405.000000000Z"
+
+	// the two newest generations are always kept, the newest one is what
+	// restore loads and the second one is its fallback
+	minGenerations = 2
+)
+
+// Generation is a retained snapshot of the leader.
+type Generation struct {
+	ID      string    `json:"id"`
+	Seq     uint64    `json:"seq"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+
+	name string
+}
+
+func generationName(rootDir string, id string) string {
+	return path.Join(rootDir, SnapshotsDir, generationPrefix+id+generationSuffix)
+}
+
+// listGenerations returns the generations in rootDir, newest first.
+func listGenerations(rootDir string) ([]Generation, error) {
+	names, err := filepath.Glob(path.Join(rootDir, SnapshotsDir, generationPrefix+"*"+generationSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	generations := []Generation{}
+	for _, name := range names {
+		id := strings.TrimSuffix(strings.TrimPrefix(path.Base(name), generationPrefix), generationSuffix)
+
+		created, seq, ok := strings.Cut(id, "-")
+		if !ok {
+			continue
+		}
+
+		createdAt, err := time.Parse(generationTimeLayout, created)
+		if err != nil {
+			continue
+		}
+
+		seqNum, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+
+		generations = append(generations, Generation{
+			ID:      id,
+			Seq:     seqNum,
+			Created: createdAt,
+			Size:    info.Size(),
+			name:    name,
+		})
+	}
+
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Created.After(generations[j].Created)
+	})
+
+	return generations, nil
+}
+
+// writeGeneration durably writes snap as a new generation and atomically
+// points BackupFile at it.
+func writeGeneration(rootDir string, snap Snapshot, o options) (Generation, error) {
+	data, err := encodeSnapshot(snap, o)
+	if err != nil {
+		return Generation{}, err
+	}
+
+	dir := path.Join(rootDir, SnapshotsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Generation{}, err
+	}
+
+	created := time.Now().UTC()
+	id := fmt.Sprintf("%s-%d", created.Format(generationTimeLayout), snap.Seq)
+	name := generationName(rootDir, id)
+
+	tmp := name + ".tmp"
+	if err := writeFileSync(tmp, data, 0600); err != nil {
+		return Generation{}, err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		return Generation{}, err
+	}
+
+	if err := syncDir(dir); err != nil {
+		return Generation{}, err
+	}
+
+	// BackupFile is a hard link to the newest generation, replaced atomically
+	// so that readers such as the local replica never see it missing
+	current := path.Join(rootDir, BackupFile)
+
+	if err := os.Remove(current + ".tmp"); err != nil && !os.IsNotExist(err) {
+		return Generation{}, err
+	}
+
+	if err := os.Link(name, current+".tmp"); err != nil {
+		return Generation{}, err
+	}
+
+	if err := os.Rename(current+".tmp", current); err != nil {
+		return Generation{}, err
+	}
+
+	if err := syncDir(rootDir); err != nil {
+		return Generation{}, err
+	}
+
+	return Generation{ID: id, Seq: snap.Seq, Created: created, Size: int64(len(data)), name: name}, nil
+}
+
+// pruneGenerations drops the generations that fall outside of retention.
+func pruneGenerations(rootDir string, retention Retention, logger *slog.Logger) error {
+	generations, err := listGenerations(rootDir)
+	if err != nil {
+		return err
+	}
+
+	for i, generation := range generations {
+		if i < minGenerations {
+			continue
+		}
+
+		expired := retention.MaxAge > 0 && time.Since(generation.Created) > retention.MaxAge
+		if i < retention.Count && !expired {
+			continue
+		}
+
+		if err := os.Remove(generation.name); err != nil {
+			return err
+		}
+
+		logger.Info("dropped snapshot generation", "id", generation.ID)
+	}
+
+	return nil
+}
+
+// loadSnapshot returns the newest intact snapshot generation in rootDir.
+// It only returns an empty snapshot when no generation exists at all.
+func loadSnapshot(rootDir string, o options, logger *slog.Logger) (Snapshot, error) {
+	generations, err := listGenerations(rootDir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	names := []string{}
+	for _, generation := range generations {
+		names = append(names, generation.name)
+	}
+
+	// written before generations were retained
+	if len(names) == 0 {
+		names = append(names, path.Join(rootDir, BackupFile))
+	}
+
+	var lastErr error
+
+	for _, name := range names {
+		snap, err := openSnapshotFile(name, o)
+		if err == nil {
+			if lastErr != nil {
+				logger.Error("!!! RESTORED FROM AN OLDER SNAPSHOT GENERATION, the latest one is corrupt !!!",
+					"file", name, "seq", snap.Seq)
+			}
+
+			return snap, nil
+		}
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		logger.Error("!!! SNAPSHOT FILE IS CORRUPT !!!", "file", name, "error", err)
+
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return Snapshot{}, lastErr
+	}
+
+	logger.Info("No persistence file found, starting fresh.")
+
+	return Snapshot{WordCount: make(map[string]int)}, nil
+}
@@ -0,0 +1,73 @@
+package db_test
+
+import (
+	"errors"
+	"log/slog"
+	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRestoreGeneration(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(rootDir, logger, db.WithRetention(db.Retention{Count: 3}))
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	// one snapshot generation per write
+	for _, text := range []string{"hello", "bad burst", "bad burst", "bad burst"} {
+		if _, err := leader.CountWords(text); err != nil {
+			t.Fatalf("failed to count words: %v", err)
+		}
+
+		time.Sleep(1200 * time.Millisecond)
+	}
+
+	generations, err := leader.Generations()
+	if err != nil {
+		t.Fatalf("failed to list generations: %v", err)
+	}
+
+	if len(generations) != 3 {
+		t.Fatalf("expected retention to keep 3 generations, got %d", len(generations))
+	}
+
+	// the oldest retained generation has a single "bad burst"
+	oldest := generations[len(generations)-1]
+	if err := leader.RestoreGeneration(oldest.ID); err != nil {
+		t.Fatalf("failed to restore generation: %v", err)
+	}
+
+	expectedCounts := map[string]int{"hello": 1, "bad": 1, "burst": 1}
+	for word, count := range expectedCounts {
+		if got := leader.GetWordCount(word); got != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, got)
+		}
+	}
+
+	if err := leader.RestoreGeneration("nonexistent"); !errors.Is(err, dbErrs.ErrGenerationNotFound) {
+		t.Errorf("expected generation not found error, got %v", err)
+	}
+
+	// the restored state must survive a restart, the discarded writes must
+	// not be replayed
+	leader.Close()
+
+	restored, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer restored.Close()
+
+	for word, count := range expectedCounts {
+		if got := restored.GetWordCount(word); got != count {
+			t.Errorf("expected %d for word %s after restart, got %d", count, word, got)
+		}
+	}
+}
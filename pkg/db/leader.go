@@ -1,60 +1,167 @@
 package db
 
 import (
-	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
+	dbErrs "memdb/pkg/errors"
 	"os"
-	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
 type BaseLeader struct {
-	wordCount   map[string]int
-	dblock      sync.RWMutex
+	// frozen while a snapshot or a view of it is read, new deltas go to its
+	// overlay meanwhile
+	engine *viewEngine
+	dblock sync.RWMutex
+	// held for reading by the readers of a frozen engine, and for writing
+	// while the state is replaced
+	views sync.RWMutex
+	// serializes writing snapshots with replacing the state
+	backupLock  sync.Mutex
 	rootDir     string
 	needsBackup bool
 	logger      *slog.Logger
+	opts        options
+	// seq of the last delta applied, deltas are only applied and handed to
+	// replicas once they are durable in the write-ahead log
+	seq uint64
+	// seq of the last delta appended to the write-ahead log and the deltas
+	// appended but not applied yet, in seq order
+	appended uint64
+	pending  []Change
+	// identifies the history seq belongs to, a new term starts whenever the
+	// state is replaced so that replicas don't mistake it for a continuation
+	term uint64
+	// seq of the last snapshot written to BackupFile
+	snapshotSeq uint64
+	// recent changes, for replicas to catch up from
+	changelog *changelog
+	wal       *wal
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
 }
 
-func NewLeader(rootDir string, logger *slog.Logger) *BaseLeader {
+func NewLeader(rootDir string, logger *slog.Logger, opts ...Option) (*BaseLeader, error) {
 	db := &BaseLeader{
-		wordCount: make(map[string]int),
-		rootDir:   rootDir,
-		logger:    logger,
+		rootDir: rootDir,
+		logger:  logger,
+		opts:    newOptions(opts),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 
+	db.changelog = newChangelog(db.opts.changelogSize)
+
 	if _, err := os.Stat(rootDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(rootDir, 0700); err != nil {
 			logger.Error("failed to create database rootDir")
 		}
 	}
 
-	// refactor constructor to return error
-	_ = db.restore()
+	removeSpools(rootDir)
+
+	engine, err := openEngine(rootDir, db.opts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	db.engine = &viewEngine{Engine: engine}
+
+	if err := db.restore(); err != nil {
+		engine.Close()
+
+		return nil, err
+	}
 
 	go db.runBackup()
 
-	return db
+	return db, nil
 }
 
 // CountWords increments the count of each word in the given text.
-func (db *BaseLeader) CountWords(text string) map[string]int {
+// The delta is durable in the write-ahead log once CountWords returns.
+func (db *BaseLeader) CountWords(text string) (Change, error) {
 	words := strings.Fields(text)
 
-	db.dblock.Lock()
-	defer db.dblock.Unlock()
-
 	wordsCounts := make(map[string]int)
 	for _, word := range words {
-		db.wordCount[word]++
 		wordsCounts[word]++
 	}
 
-	db.needsBackup = true
+	if len(wordsCounts) == 0 {
+		return Change{Updates: wordsCounts}, nil
+	}
+
+	db.dblock.Lock()
+
+	change := Change{Seq: db.appended + 1, Term: db.term, Updates: wordsCounts}
+	if err := db.wal.append(walRecord{Seq: change.Seq, Term: change.Term, Updates: wordsCounts}); err != nil {
+		db.dblock.Unlock()
+
+		db.logger.Error("failed to append to write-ahead log", "error", err)
+
+		return Change{}, err
+	}
+
+	db.appended = change.Seq
+	db.pending = append(db.pending, change)
+
+	db.dblock.Unlock()
+
+	// fsync outside of the lock so that concurrent writers share one flush
+	syncErr := db.wal.sync(change.Seq)
+
+	db.dblock.Lock()
+	defer db.dblock.Unlock()
+
+	if syncErr != nil {
+		db.logger.Error("failed to sync write-ahead log", "error", syncErr)
+
+		// the log refuses any further delta, the ones that didn't make it
+		// are never applied
+		db.apply(db.wal.syncedSeq())
+		db.pending = nil
+		db.appended = db.seq
+
+		return Change{}, syncErr
+	}
+
+	// also applies the deltas of the concurrent writers flushed along, so
+	// that they are applied in seq order
+	if err := db.apply(change.Seq); err != nil {
+		return Change{}, err
+	}
 
-	return wordsCounts
+	return change, nil
+}
+
+// apply applies the pending deltas up to seq to the state and the changelog.
+// The dblock must be held.
+func (db *BaseLeader) apply(seq uint64) error {
+	for len(db.pending) > 0 && db.pending[0].Seq <= seq {
+		change := db.pending[0]
+		db.pending = db.pending[1:]
+
+		db.seq = change.Seq
+		db.needsBackup = true
+		db.changelog.add(change)
+
+		if err := db.engine.Add(change.Updates); err != nil {
+			db.logger.Error("failed to apply words to storage engine", "error", err)
+
+			return err
+		}
+
+		db.engine.setPosition(change.Seq, change.Term)
+	}
+
+	return nil
 }
 
 // GetWordCount returns the count of the given word.
@@ -62,9 +169,9 @@ func (db *BaseLeader) GetWordCount(word string) int {
 	db.dblock.RLock()
 	defer db.dblock.RUnlock()
 
-	count, ok := db.wordCount[word]
-	if !ok {
-		return 0
+	count, err := db.engine.Get(word)
+	if err != nil {
+		db.logger.Error("failed to read word from storage engine", "word", word, "error", err)
 	}
 
 	return count
@@ -72,57 +179,487 @@ func (db *BaseLeader) GetWordCount(word string) int {
 
 // GetWordsCounts returns the current word count data.
 func (db *BaseLeader) GetWordsCounts() map[string]int {
+	return db.Snapshot().WordCount
+}
+
+// Snapshot returns a copy of the current word count data and its position.
+func (db *BaseLeader) Snapshot() Snapshot {
 	db.dblock.RLock()
 	defer db.dblock.RUnlock()
 
 	wordCounts := make(map[string]int)
-	for k, v := range db.wordCount {
-		wordCounts[k] = v
+
+	if err := db.engine.Range(func(word string, count int) bool {
+		wordCounts[word] = count
+		return true
+	}); err != nil {
+		db.logger.Error("failed to read storage engine", "error", err)
 	}
 
-	return wordCounts
+	return Snapshot{Seq: db.seq, Term: db.term, WordCount: wordCounts}
 }
 
+// View returns the word counts and their position as of now, without copying
+// them: the entries of the snapshot are read from the frozen engine, which
+// doesn't hold up writes. release must be called once done with them.
+func (db *BaseLeader) View() (Snapshot, func()) {
+	db.views.RLock()
+
+	db.dblock.Lock()
+	snap := Snapshot{Seq: db.seq, Term: db.term, entries: db.engine.freeze()}
+	db.dblock.Unlock()
+
+	return snap, db.releaseView
+}
+
+// WriteSnapshot writes a view to w like the package WriteSnapshot, the spool
+// is kept in rootDir and encrypted like the other files of the leader.
+func (db *BaseLeader) WriteSnapshot(w io.Writer, snap Snapshot) error {
+	return writeSnapshot(w, snap, db.rootDir, db.opts)
+}
+
+// viewAt is View as of position seq of term, the changes made since are
+// rolled back from the frozen engine. It fails like ChangesSince when the
+// changelog doesn't reach back to seq.
+func (db *BaseLeader) viewAt(term uint64, seq uint64) (Snapshot, func(), error) {
+	db.views.RLock()
+
+	db.dblock.Lock()
+
+	changes, err := db.changesSince(term, seq)
+	if err != nil {
+		db.dblock.Unlock()
+		db.views.RUnlock()
+
+		return Snapshot{}, nil, err
+	}
+
+	snap := Snapshot{Seq: seq, Term: term, entries: rollBack(db.engine.freeze(), changes)}
+	db.dblock.Unlock()
+
+	return snap, db.releaseView, nil
+}
+
+func (db *BaseLeader) releaseView() {
+	db.dblock.Lock()
+	db.thaw()
+	db.dblock.Unlock()
+
+	db.views.RUnlock()
+}
+
+// ChangesSince returns the changes made after seq in term, or
+// ErrPositionTruncated when the changelog doesn't reach back to seq, seq
+// belongs to another term or is ahead of the leader.
+func (db *BaseLeader) ChangesSince(term uint64, seq uint64) ([]Change, error) {
+	db.dblock.RLock()
+	defer db.dblock.RUnlock()
+
+	return db.changesSince(term, seq)
+}
+
+// changesSince is ChangesSince with the dblock held.
+func (db *BaseLeader) changesSince(term uint64, seq uint64) ([]Change, error) {
+	if term != db.term || seq > db.seq {
+		return nil, dbErrs.ErrPositionTruncated
+	}
+
+	if seq == db.seq {
+		return []Change{}, nil
+	}
+
+	changes, ok := db.changelog.since(seq)
+	if !ok {
+		return nil, dbErrs.ErrPositionTruncated
+	}
+
+	return changes, nil
+}
+
+// Position returns the seq of the last change made.
+func (db *BaseLeader) Position() uint64 {
+	db.dblock.RLock()
+	defer db.dblock.RUnlock()
+
+	return db.seq
+}
+
+// Term returns the term of the leader history.
+func (db *BaseLeader) Term() uint64 {
+	db.dblock.RLock()
+	defer db.dblock.RUnlock()
+
+	return db.term
+}
+
+// Close stops the periodic backup and closes the write-ahead log. Closing
+// more than once returns the result of the first Close.
+func (db *BaseLeader) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.done)
+		<-db.stopped
+
+		db.dblock.Lock()
+		defer db.dblock.Unlock()
+
+		db.closeErr = errors.Join(db.wal.close(), db.engine.Close())
+	})
+
+	return db.closeErr
+}
+
+// backup writes a snapshot of the current state. The state is frozen under
+// the lock, but serialized and written without holding it so that writers
+// are not stalled for the duration of the write.
 func (db *BaseLeader) backup() error {
-	data, err := json.Marshal(db.wordCount)
+	db.backupLock.Lock()
+	defer db.backupLock.Unlock()
+
+	db.views.RLock()
+	defer db.views.RUnlock()
+
+	db.dblock.Lock()
+
+	if !db.needsBackup {
+		db.dblock.Unlock()
+
+		return nil
+	}
+
+	// deltas after snap.Seq go to a fresh log segment, the sealed ones are
+	// kept back to the previous generation in case the latest one turns out
+	// to be corrupt
+	if err := db.wal.rotate(); err != nil {
+		db.dblock.Unlock()
+
+		db.logger.Error("error rotating write-ahead log", "error", err)
+
+		return err
+	}
+
+	snap := Snapshot{Seq: db.seq, Term: db.term, entries: db.engine.freeze()}
+	db.needsBackup = false
+
+	db.dblock.Unlock()
+
+	var err error
+
+	durable, isDurable := db.engine.durable()
+	if isDurable {
+		// a durable engine restarts from its own checkpoint, the generation is
+		// still what the fallback, a point-in-time restore and the readers of
+		// BackupFile load. Frozen, it only holds the deltas up to snap.Seq.
+		if err = durable.Checkpoint(); err != nil {
+			db.logger.Error("error checkpointing storage engine", "error", err)
+		}
+	}
+
+	if err == nil {
+		if _, err = writeGeneration(db.rootDir, snap, db.opts); err != nil {
+			db.logger.Error("error writing backup file", "error", err)
+		}
+	}
+
+	db.dblock.Lock()
+
+	db.thaw()
+
+	prevSeq := db.snapshotSeq
+	if err == nil {
+		db.snapshotSeq = snap.Seq
+	} else {
+		db.needsBackup = true
+	}
+
+	db.dblock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if isDurable {
+		// the engine restarts from the last delta it persisted
+		persisted, _ := durable.Persisted()
+		prevSeq = min(prevSeq, persisted)
+	}
+
+	if err := db.wal.prune(prevSeq); err != nil {
+		db.logger.Error("error pruning write-ahead log", "error", err)
+	}
+
+	if err := pruneGenerations(db.rootDir, db.opts.retention, db.logger); err != nil {
+		db.logger.Error("error pruning snapshot generations", "error", err)
+	}
+
+	return nil
+}
+
+// thaw folds the writes made while the engine was frozen into it, once its
+// last reader is done. The dblock must be held.
+func (db *BaseLeader) thaw() {
+	if err := db.engine.thaw(); err != nil {
+		db.logger.Error("failed to apply words to storage engine", "error", err)
+	}
+}
+
+// Backup writes a consistent snapshot of the current state to w, in the
+// snapshot file format. Nothing is written to w if the snapshot fails.
+func (db *BaseLeader) Backup(w io.Writer) error {
+	snap, release := db.View()
+
+	data, err := encodeSnapshot(snap, db.opts)
+
+	release()
+
 	if err != nil {
 		return err
 	}
 
-	if err := os.WriteFile(path.Join(db.rootDir, BackupFile), data, 0644); err != nil {
-		db.logger.Error("error writing backup file", "error", err)
+	_, err = w.Write(data)
+
+	return err
+}
+
+// Restore replaces the current state with a snapshot read from r, in any of
+// the snapshot formats. The snapshot is fully validated before the state is
+// touched; see RestoreGeneration for what happens to the current state.
+func (db *BaseLeader) Restore(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
 
+	snap, err := openSnapshot(data, db.opts)
+	if err != nil {
 		return err
 	}
 
+	return db.replace(snap)
+}
+
+// Generations lists the retained snapshot generations, newest first.
+func (db *BaseLeader) Generations() ([]Generation, error) {
+	return listGenerations(db.rootDir)
+}
+
+// RestoreGeneration replaces the current state with the given generation.
+// Everything written after it is discarded, including the write-ahead log,
+// and the restored state is persisted as the newest generation.
+func (db *BaseLeader) RestoreGeneration(id string) error {
+	generations, err := listGenerations(db.rootDir)
+	if err != nil {
+		return err
+	}
+
+	idx := slices.IndexFunc(generations, func(generation Generation) bool {
+		return generation.ID == id
+	})
+	if idx < 0 {
+		return dbErrs.ErrGenerationNotFound
+	}
+
+	snap, err := openSnapshotFile(generations[idx].name, db.opts)
+	if err != nil {
+		return err
+	}
+
+	return db.replace(snap)
+}
+
+// replace swaps the whole state for the word counts of snap and persists it.
+// Replacing the state takes a seq of its own and starts a new term, so that
+// positions handed out before never refer to the new state.
+func (db *BaseLeader) replace(snap Snapshot) error {
+	db.backupLock.Lock()
+	defer db.backupLock.Unlock()
+
+	// nobody reads the engine while it is replaced
+	db.views.Lock()
+	defer db.views.Unlock()
+
+	db.dblock.Lock()
+	defer db.dblock.Unlock()
+
+	if err := db.wal.rotate(); err != nil {
+		return err
+	}
+
+	// every delta appended was flushed by the rotation, the ones not applied
+	// yet still belong to the history being replaced
+	if err := db.apply(db.appended); err != nil {
+		return err
+	}
+
+	if err := db.engine.Replace(snap.Entries()); err != nil {
+		return err
+	}
+
+	db.seq++
+	db.appended = db.seq
+	db.term++
 	db.needsBackup = false
+	db.changelog.reset()
+	db.engine.setPosition(db.seq, db.term)
+
+	if durable, ok := db.engine.durable(); ok {
+		if err := durable.Checkpoint(); err != nil {
+			db.needsBackup = true
+
+			return err
+		}
+	}
+
+	current := Snapshot{Seq: db.seq, Term: db.term, entries: db.engine.Range}
+
+	if _, err := writeGeneration(db.rootDir, current, db.opts); err != nil {
+		db.needsBackup = true
+
+		return err
+	}
+
+	db.snapshotSeq = current.Seq
+
+	// the log only holds deltas on top of the discarded state
+	if err := db.wal.prune(current.Seq); err != nil {
+		db.logger.Error("error pruning write-ahead log", "error", err)
+	}
+
+	db.logger.Warn("leader state replaced", "seq", current.Seq, "term", current.Term)
 
 	return nil
 }
 
 func (db *BaseLeader) runBackup() {
-	for {
-		db.dblock.Lock()
+	defer close(db.stopped)
 
-		if db.needsBackup {
-			if err := db.backup(); err != nil {
-				db.logger.Error("failed to backup database...", "error", err)
-			}
-		}
+	ticker := time.NewTicker(db.opts.backupInterval)
+	defer ticker.Stop()
 
-		db.dblock.Unlock()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		}
 
-		time.Sleep(writeFreq)
+		if err := db.backup(); err != nil {
+			db.logger.Error("failed to backup database...", "error", err)
+		}
 	}
 }
 
 func (db *BaseLeader) restore() error {
-	data, err := os.ReadFile(path.Join(db.rootDir, BackupFile))
+	snap, resumed, err := db.resumeEngine()
+	if err != nil {
+		return err
+	}
+
+	if !resumed {
+		if snap, err = loadSnapshot(db.rootDir, db.opts, db.logger); err != nil {
+			// never start from zero when there is data we failed to read
+			return err
+		}
+
+		if err := db.engine.Replace(snap.Entries()); err != nil {
+			return err
+		}
+
+		// a durable engine doesn't hold the state until its next checkpoint
+		_, durable := db.engine.durable()
+		db.needsBackup = durable
+	}
+
+	db.seq = snap.Seq
+	db.term = snap.Term
+	db.snapshotSeq = snap.Seq
+
+	replayed := 0
+
+	db.wal, err = openWAL(db.rootDir, snap.Seq, db.opts.keyring, db.logger, func(rec walRecord) error {
+		if rec.Seq != db.seq+1 {
+			db.logger.Error("!!! GAP IN WRITE-AHEAD LOG, deltas were lost !!!",
+				"expected_seq", db.seq+1, "found_seq", rec.Seq)
+		}
+
+		if err := db.engine.Add(rec.Updates); err != nil {
+			return err
+		}
+
+		db.seq = rec.Seq
+		if rec.Term != 0 {
+			db.term = rec.Term
+		}
+
+		db.engine.setPosition(db.seq, db.term)
+
+		db.changelog.add(Change{Seq: rec.Seq, Term: db.term, Updates: rec.Updates})
+		replayed++
+
+		return nil
+	})
 	if err != nil {
-		db.logger.Info("No persistence file found, starting fresh.")
+		db.logger.Error("failed to open write-ahead log", "error", err)
 
 		return err
 	}
 
-	return json.Unmarshal(data, &db.wordCount)
+	if replayed > 0 {
+		db.logger.Info("replayed write-ahead log", "records", replayed, "snapshot_seq", snap.Seq, "seq", db.seq)
+
+		db.needsBackup = true
+	}
+
+	db.appended = db.seq
+
+	if db.term == 0 {
+		// a new history, taken from the clock so that a leader which lost its
+		// files doesn't reuse the term of its previous life
+		db.term = uint64(time.Now().UnixNano())
+		db.changelog.reset()
+
+		db.logger.Info("starting a new term", "term", db.term)
+	}
+
+	db.engine.setPosition(db.seq, db.term)
+
+	// version 0 with no words is a fresh start rather than a legacy snapshot
+	if snap.outdated(db.opts) && (snap.version > 0 || len(snap.WordCount) > 0) {
+		db.logger.Info("snapshot is in an older format or encrypted with another key, it will be rewritten on the next backup")
+
+		db.needsBackup = true
+	}
+
+	return nil
+}
+
+// resumeEngine returns the position of a durable engine which holds the
+// state, so that it is resumed from rather than from a snapshot.
+func (db *BaseLeader) resumeEngine() (Snapshot, bool, error) {
+	durable, ok := db.engine.durable()
+	if !ok {
+		return Snapshot{}, false, nil
+	}
+
+	seq, term := durable.Persisted()
+	if term == 0 {
+		return Snapshot{}, false, nil
+	}
+
+	generations, err := listGenerations(db.rootDir)
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+
+	// written by a node running another engine since, or while a full sync
+	// kept the engine from catching up with the backup
+	if len(generations) > 0 && generations[0].Seq > seq {
+		db.logger.Info("a snapshot is newer than the storage engine, restoring from it",
+			"engine_seq", seq, "snapshot_seq", generations[0].Seq)
+
+		return Snapshot{}, false, nil
+	}
+
+	db.logger.Info("resuming from storage engine", "seq", seq, "term", term)
+
+	return Snapshot{Seq: seq, Term: term}, true, nil
 }
@@ -1,10 +1,17 @@
 package db_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log/slog"
 	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCountWords(t *testing.T) {
@@ -12,16 +19,23 @@ func TestCountWords(t *testing.T) {
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	db := db.NewLeader(rootDir, logger)
+	db, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer db.Close()
 
 	text := "hello world hello"
 	expectedCounts := map[string]int{"hello": 2, "world": 1}
 
-	counts := db.CountWords(text)
+	counts, err := db.CountWords(text)
+	if err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
 
 	for word, count := range expectedCounts {
-		if counts[word] != count {
-			t.Errorf("expected %d for word %s, got %d", count, word, counts[word])
+		if counts.Updates[word] != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, counts.Updates[word])
 		}
 	}
 }
@@ -31,9 +45,15 @@ func TestGetWordCount(t *testing.T) {
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	db := db.NewLeader(rootDir, logger)
+	db, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer db.Close()
 
-	db.CountWords("hello world hello")
+	if _, err := db.CountWords("hello world hello"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
 
 	tests := []struct {
 		word     string
@@ -57,9 +77,15 @@ func TestGetWordsCounts(t *testing.T) {
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	db := db.NewLeader(rootDir, logger)
+	db, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer db.Close()
 
-	db.CountWords("hello world hello")
+	if _, err := db.CountWords("hello world hello"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
 
 	expectedCounts := map[string]int{"hello": 2, "world": 1}
 	counts := db.GetWordsCounts()
@@ -70,3 +96,494 @@ func TestGetWordsCounts(t *testing.T) {
 		}
 	}
 }
+
+func TestCountWordsFailedLogSync(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leader.Close()
+
+	if _, err := leader.CountWords("hello"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	pipe, err := db.BreakLogSync(leader)
+	if err != nil {
+		t.Fatalf("failed to break the write-ahead log: %v", err)
+	}
+	defer pipe.Close()
+
+	if _, err := leader.CountWords("hello world"); err == nil {
+		t.Fatalf("expected an error when the write-ahead log can't be synced")
+	}
+
+	// a failed write is neither visible nor handed to replicas
+	if got := leader.GetWordCount("hello"); got != 1 {
+		t.Errorf("expected 1 for word hello, got %d", got)
+	}
+
+	if got := leader.GetWordCount("world"); got != 0 {
+		t.Errorf("expected 0 for word world, got %d", got)
+	}
+
+	if got := leader.Position(); got != 1 {
+		t.Errorf("expected position 1, got %d", got)
+	}
+
+	changes, err := leader.ChangesSince(leader.Term(), 1)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no change after seq 1, got %v (%v)", changes, err)
+	}
+
+	// the log can't be trusted anymore, later writes fail too
+	if _, err := leader.CountWords("again"); err == nil {
+		t.Errorf("expected an error once the write-ahead log failed")
+	}
+
+	if got := leader.GetWordCount("again"); got != 0 {
+		t.Errorf("expected 0 for word again, got %d", got)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	if err := leader.Close(); err != nil {
+		t.Fatalf("failed to close leader: %v", err)
+	}
+
+	if err := leader.Close(); err != nil {
+		t.Errorf("expected the second close to succeed, got %v", err)
+	}
+}
+
+func TestRestoreReplaysLog(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	if _, err := leader.CountWords("hello world hello"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	if _, err := leader.CountWords("hello again"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	// close before any snapshot was taken, counts only live in the log
+	leader.Close()
+
+	restored, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer restored.Close()
+
+	expectedCounts := map[string]int{"hello": 3, "world": 1, "again": 1}
+	for word, count := range expectedCounts {
+		if got := restored.GetWordCount(word); got != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, got)
+		}
+	}
+}
+
+func TestRestoreIgnoresTornLogTail(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	if _, err := leader.CountWords("hello world"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	leader.Close()
+
+	// simulate a crash in the middle of an append
+	file, err := os.OpenFile(path.Join(rootDir, db.LogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+
+	if _, err := file.Write([]byte{0, 0, 0, 42, 1, 2}); err != nil {
+		t.Fatalf("failed to write log: %v", err)
+	}
+
+	file.Close()
+
+	restored, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+
+	if _, err := restored.CountWords("hello"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	restored.Close()
+
+	// the record appended after the torn tail must survive another restart
+	restored, err = db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer restored.Close()
+
+	if got := restored.GetWordCount("hello"); got != 2 {
+		t.Errorf("expected 2 for word hello, got %d", got)
+	}
+}
+
+func TestRestoreFallsBackToPreviousSnapshot(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	// one snapshot generation per write
+	for _, text := range []string{"hello", "world"} {
+		if _, err := leader.CountWords(text); err != nil {
+			t.Fatalf("failed to count words: %v", err)
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+	}
+
+	if _, err := leader.CountWords("again"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	leader.Close()
+
+	generations, err := leader.Generations()
+	if err != nil || len(generations) != 2 {
+		t.Fatalf("expected two snapshot generations, got %v: %v", generations, err)
+	}
+
+	// corrupt the payload of the latest generation, BackupFile links to it
+	data, err := os.ReadFile(path.Join(rootDir, db.BackupFile))
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+
+	data[len(data)-2] ^= 0xff
+
+	file, err := os.OpenFile(path.Join(rootDir, db.BackupFile), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %v", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	file.Close()
+
+	restored, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer restored.Close()
+
+	expectedCounts := map[string]int{"hello": 1, "world": 1, "again": 1}
+	for word, count := range expectedCounts {
+		if got := restored.GetWordCount(word); got != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, got)
+		}
+	}
+}
+
+func TestRestoreRefusesCorruptSnapshot(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	if err := os.WriteFile(path.Join(rootDir, db.BackupFile), []byte(`{"hello": 1`), 0644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	if _, err := db.NewLeader(rootDir, logger); !errors.Is(err, dbErrs.ErrCorruptSnapshot) {
+		t.Fatalf("expected corrupt snapshot error, got %v", err)
+	}
+}
+
+func TestRestoreReadsLegacySnapshot(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	if err := os.WriteFile(path.Join(rootDir, db.BackupFile), []byte(`{"hello": 2, "world": 1}`), 0644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	leader, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer leader.Close()
+
+	if got := leader.GetWordCount("hello"); got != 2 {
+		t.Errorf("expected 2 for word hello, got %d", got)
+	}
+}
+
+func TestCountWordsDuringSnapshot(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	// a large vocabulary so that writing a snapshot takes a while
+	vocabulary := make([]string, 0, 200000)
+	for i := 0; i < cap(vocabulary); i++ {
+		vocabulary = append(vocabulary, fmt.Sprintf("word%d", i))
+	}
+
+	if _, err := leader.CountWords(strings.Join(vocabulary, " ")); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	// keep writing across several snapshots
+	writes := 0
+	for deadline := time.Now().Add(2500 * time.Millisecond); time.Now().Before(deadline); writes++ {
+		if _, err := leader.CountWords("hello word0"); err != nil {
+			t.Fatalf("failed to count words: %v", err)
+		}
+	}
+
+	if got := leader.GetWordCount("hello"); got != writes {
+		t.Errorf("expected %d for word hello, got %d", writes, got)
+	}
+
+	leader.Close()
+
+	restored, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer restored.Close()
+
+	expectedCounts := map[string]int{"hello": writes, "word0": writes + 1, "word199999": 1}
+	for word, count := range expectedCounts {
+		if got := restored.GetWordCount(word); got != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, got)
+		}
+	}
+
+	if got := len(restored.GetWordsCounts()); got != len(vocabulary)+1 {
+		t.Errorf("expected %d distinct words, got %d", len(vocabulary)+1, got)
+	}
+}
+
+func TestViewDuringWrites(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leader.Close()
+
+	if _, err := leader.CountWords("hello world"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	first, releaseFirst := leader.View()
+
+	if _, err := leader.CountWords("hello again"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	// taken while the engine is already frozen, sees the write made since
+	second, releaseSecond := leader.View()
+
+	if _, err := leader.CountWords("hello"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	collect := func(snap db.Snapshot) map[string]int {
+		counts := make(map[string]int)
+		if err := snap.Entries()(func(word string, count int) bool {
+			counts[word] = count
+			return true
+		}); err != nil {
+			t.Fatalf("failed to read view: %v", err)
+		}
+
+		return counts
+	}
+
+	tests := []struct {
+		name     string
+		snap     db.Snapshot
+		seq      uint64
+		expected map[string]int
+	}{
+		{"first view", first, 1, map[string]int{"hello": 1, "world": 1}},
+		{"second view", second, 2, map[string]int{"hello": 2, "world": 1, "again": 1}},
+	}
+
+	for _, tt := range tests {
+		if tt.snap.Seq != tt.seq {
+			t.Errorf("%s: expected seq %d, got %d", tt.name, tt.seq, tt.snap.Seq)
+		}
+
+		if got := collect(tt.snap); fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+
+	// reads see every write while the views are held
+	if got := leader.GetWordCount("hello"); got != 3 {
+		t.Errorf("expected 3 for word hello, got %d", got)
+	}
+
+	releaseFirst()
+	releaseSecond()
+
+	expectedCounts := map[string]int{"hello": 3, "world": 1, "again": 1}
+	if got := leader.GetWordsCounts(); fmt.Sprint(got) != fmt.Sprint(expectedCounts) {
+		t.Errorf("expected %v once the views are released, got %v", expectedCounts, got)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	source, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer source.Close()
+
+	if _, err := source.CountWords("hello world hello"); err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	var backup bytes.Buffer
+	if err := source.Backup(&backup); err != nil {
+		t.Fatalf("failed to back up leader: %v", err)
+	}
+
+	rootDir := t.TempDir()
+
+	target, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+
+	discarded, err := target.CountWords("discarded")
+	if err != nil {
+		t.Fatalf("failed to count words: %v", err)
+	}
+
+	if err := target.Restore(strings.NewReader("MDBS not a snapshot")); !errors.Is(err, dbErrs.ErrCorruptSnapshot) {
+		t.Errorf("expected corrupt snapshot error, got %v", err)
+	}
+
+	if got := target.GetWordCount("discarded"); got != 1 {
+		t.Errorf("expected a failed restore to keep the state, got %d for word discarded", got)
+	}
+
+	if err := target.Restore(&backup); err != nil {
+		t.Fatalf("failed to restore backup: %v", err)
+	}
+
+	// replicas must not take the restored state for a continuation
+	term := target.Snapshot().Term
+	if term == discarded.Term {
+		t.Errorf("expected restore to start a new term, still in term %d", term)
+	}
+
+	target.Close()
+
+	restored, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+	defer restored.Close()
+
+	if got := restored.Snapshot().Term; got != term {
+		t.Errorf("expected term %d to survive a restart, got %d", term, got)
+	}
+
+	expectedCounts := map[string]int{"hello": 2, "world": 1, "discarded": 0}
+	for word, count := range expectedCounts {
+		if got := restored.GetWordCount(word); got != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, got)
+		}
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leader, err := db.NewLeader(t.TempDir(), logger, db.WithChangelogSize(3))
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leader.Close()
+
+	var term uint64
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		change, err := leader.CountWords(text)
+		if err != nil {
+			t.Fatalf("failed to count words: %v", err)
+		}
+
+		term = change.Term
+	}
+
+	changes, err := leader.ChangesSince(term, 3)
+	if err != nil {
+		t.Fatalf("failed to get changes: %v", err)
+	}
+
+	if len(changes) != 2 || changes[0].Seq != 4 || changes[0].Updates["four"] != 1 || changes[1].Seq != 5 {
+		t.Errorf("expected changes 4 and 5, got %+v", changes)
+	}
+
+	if changes, err := leader.ChangesSince(term, 5); err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes when up to date, got %+v, %v", changes, err)
+	}
+
+	// only the 3 most recent changes are kept
+	if _, err := leader.ChangesSince(term, 1); !errors.Is(err, dbErrs.ErrPositionTruncated) {
+		t.Errorf("expected truncated position error, got %v", err)
+	}
+
+	if _, err := leader.ChangesSince(term+1, 3); !errors.Is(err, dbErrs.ErrPositionTruncated) {
+		t.Errorf("expected truncated position error for another term, got %v", err)
+	}
+
+	if _, err := leader.ChangesSince(term, 6); !errors.Is(err, dbErrs.ErrPositionTruncated) {
+		t.Errorf("expected truncated position error ahead of the leader, got %v", err)
+	}
+}
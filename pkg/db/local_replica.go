@@ -1,9 +1,7 @@
 package db
 
 import (
-	"encoding/json"
 	"log/slog"
-	"os"
 	"path"
 	"sync"
 )
@@ -11,14 +9,16 @@ import (
 type BaseLocalReplica struct {
 	rootDir   string
 	logger    *slog.Logger
+	opts      options
 	wordCount map[string]int
 	lock      sync.RWMutex
 }
 
-func NewLocalReplica(rootDir string, logger *slog.Logger) *BaseLocalReplica {
+func NewLocalReplica(rootDir string, logger *slog.Logger, opts ...Option) *BaseLocalReplica {
 	db := &BaseLocalReplica{
 		rootDir:   rootDir,
 		logger:    logger,
+		opts:      newOptions(opts),
 		wordCount: make(map[string]int),
 	}
 
@@ -34,27 +34,17 @@ func (db *BaseLocalReplica) GetWordCount(word string) int {
 }
 
 func (db *BaseLocalReplica) Update() error {
-	var m map[string]int
+	snap, err := readSnapshotFile(path.Join(db.rootDir, BackupFile), db.opts)
+	if err != nil {
+		db.logger.Error("failed to read database file", "error", err)
 
-	if err := db.getWordsCount(&m); err != nil {
 		return err
 	}
 
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	db.wordCount = m
+	db.wordCount = snap.WordCount
 
 	return nil
 }
-
-func (db *BaseLocalReplica) getWordsCount(v any) error {
-	data, err := os.ReadFile(path.Join(db.rootDir, BackupFile))
-	if err != nil {
-		db.logger.Error("failed to read database file", "error", err)
-
-		return err
-	}
-
-	return json.Unmarshal(data, v)
-}
@@ -0,0 +1,1123 @@
+package db
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	runPrefix = "run-"
+	runSuffix = ".db"
+
+	// lists the runs of the lsm engine and the position of the state they
+	// hold
+	ManifestFile = "MANIFEST"
+)
+
+// LSMConfig tunes the lsm storage engine.
+type LSMConfig struct {
+	// words buffered in memory before they are flushed to a sorted run
+	MemtableSize int
+	// decoded run blocks (indexInterval entries each) kept in memory
+	CacheBlocks int
+	// full memtables waiting to be flushed past which writes stall
+	MaxPendingMemtables int
+}
+
+var DefaultLSMConfig = LSMConfig{
+	MemtableSize:        64 * 1024,
+	CacheBlocks:         4096,
+	MaxPendingMemtables: 4,
+}
+
+// durableEngine is an Engine persisting its state on its own, along with the
+// position of the last delta it holds, so that the node restarts from it
+// rather than from a snapshot.
+type durableEngine interface {
+	Engine
+	// SetPosition records the position of the last delta added.
+	SetPosition(seq uint64, term uint64)
+	// Checkpoint makes every delta added so far durable.
+	Checkpoint() error
+	// Persisted returns the position of the durable state, 0, 0 when there is
+	// none.
+	Persisted() (seq uint64, term uint64)
+}
+
+// LSMEngine is a log-structured merge engine: new counts are buffered in a
+// memtable which is handed to a background flush once it is full. Runs hold
+// count deltas in the binary snapshot format, a word count is the sum of its
+// memtable and run entries. Runs are merged size-tiered in the background, so
+// that there are O(log n) of them, and looked up through their sparse index
+// and a block cache. Only the memtables, the sparse indexes and the cache live
+// in memory.
+//
+// The manifest lists the runs and the position of the last delta flushed to
+// them, it is rewritten whenever the runs change. A run is only deleted once
+// a manifest no longer listing it is durable, so the node restarts from the
+// runs and the write-ahead log after the manifest position.
+type LSMEngine struct {
+	dir    string
+	config LSMConfig
+	logger *slog.Logger
+	cache  *blockCache
+
+	lock sync.RWMutex
+	// signaled on every flush and on a background failure
+	changed  *sync.Cond
+	memtable *memtable
+	// full memtables waiting to be flushed, oldest first
+	pending []*memtable
+	// memtables handed to the flush and the ones flushed, or dropped by
+	// Replace, and listed in a durable manifest
+	frozen  uint64
+	flushed uint64
+	// newest first
+	runs   []*lsmRun
+	nextID uint64
+	// position of the runs
+	seq  uint64
+	term uint64
+	// first failure of the background work, returned by the later writes
+	err error
+
+	// held for reading by a flush or a merge, for writing by Replace
+	work sync.RWMutex
+	// serializes the manifest writes
+	manifestLock sync.Mutex
+	flushWake    chan struct{}
+	compactWake  chan struct{}
+	done         chan struct{}
+	stopped      sync.WaitGroup
+}
+
+// memtable is a batch of count deltas along with the position of the last
+// one.
+type memtable struct {
+	counts map[string]int
+	seq    uint64
+	term   uint64
+}
+
+// lsmManifest is the content of ManifestFile.
+type lsmManifest struct {
+	Seq  uint64 `json:"seq"`
+	Term uint64 `json:"term"`
+	// ids of the runs, newest first
+	Runs []uint64 `json:"runs"`
+}
+
+// OpenLSMEngine opens the lsm engine keeping its runs in dir, as of its last
+// manifest. Runs that no manifest lists are left overs of a crash and are
+// dropped.
+func OpenLSMEngine(dir string, config LSMConfig, logger *slog.Logger) (*LSMEngine, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if config.MemtableSize <= 0 {
+		config.MemtableSize = DefaultLSMConfig.MemtableSize
+	}
+
+	if config.MaxPendingMemtables <= 0 {
+		config.MaxPendingMemtables = DefaultLSMConfig.MaxPendingMemtables
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &LSMEngine{
+		dir:         dir,
+		config:      config,
+		logger:      logger,
+		cache:       newBlockCache(config.CacheBlocks),
+		memtable:    &memtable{counts: make(map[string]int), seq: manifest.Seq, term: manifest.Term},
+		seq:         manifest.Seq,
+		term:        manifest.Term,
+		flushWake:   make(chan struct{}, 1),
+		compactWake: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	e.changed = sync.NewCond(&e.lock)
+
+	if err := e.openRuns(manifest); err != nil {
+		for _, run := range e.runs {
+			run.release()
+		}
+
+		return nil, err
+	}
+
+	e.stopped.Add(2)
+
+	go e.runFlush()
+	go e.runCompaction()
+
+	return e, nil
+}
+
+// openRuns opens the runs listed by manifest and removes the others.
+func (e *LSMEngine) openRuns(manifest lsmManifest) error {
+	names, err := filepath.Glob(path.Join(e.dir, runPrefix+"*"+runSuffix))
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[uint64]bool)
+	for _, id := range manifest.Runs {
+		listed[id] = true
+	}
+
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(path.Base(name), runPrefix), runSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		e.nextID = max(e.nextID, id+1)
+
+		if !listed[id] {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, id := range manifest.Runs {
+		file, err := os.Open(e.runName(id))
+		if err != nil {
+			return fmt.Errorf("%w: run %d of the manifest: %w", dbErrs.ErrCorruptSnapshot, id, err)
+		}
+
+		run, err := openRun(id, file, e.cache)
+		if err != nil {
+			file.Close()
+
+			return err
+		}
+
+		e.runs = append(e.runs, run)
+	}
+
+	return nil
+}
+
+func (e *LSMEngine) runName(id uint64) string {
+	return runFile(e.dir, id)
+}
+
+func runFile(dir string, id uint64) string {
+	return path.Join(dir, fmt.Sprintf("%s%020d%s", runPrefix, id, runSuffix))
+}
+
+func (e *LSMEngine) Get(word string) (int, error) {
+	e.lock.RLock()
+
+	count := e.memtable.counts[word]
+	for _, mem := range e.pending {
+		count += mem.counts[word]
+	}
+
+	runs := e.acquireRuns()
+
+	e.lock.RUnlock()
+
+	defer releaseRuns(runs)
+
+	for _, run := range runs {
+		runCount, err := run.get(word, e.cache)
+		if err != nil {
+			return 0, err
+		}
+
+		count += runCount
+	}
+
+	return count, nil
+}
+
+// Add buffers updates in the memtable. A full memtable is handed to the
+// background flush, writes only wait for it when too many of them are
+// pending.
+func (e *LSMEngine) Add(updates map[string]int) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.err != nil {
+		return e.err
+	}
+
+	for word, count := range updates {
+		e.memtable.counts[word] += count
+	}
+
+	if len(e.memtable.counts) < e.config.MemtableSize {
+		return nil
+	}
+
+	e.freezeMemtable()
+
+	for len(e.pending) > e.config.MaxPendingMemtables && e.err == nil {
+		e.changed.Wait()
+	}
+
+	return e.err
+}
+
+func (e *LSMEngine) Range(yield func(word string, count int) bool) error {
+	e.lock.RLock()
+
+	iterators := []entryIterator{newSliceIterator(e.memtable.counts)}
+	pending := e.pending
+	runs := e.acquireRuns()
+
+	e.lock.RUnlock()
+
+	defer releaseRuns(runs)
+
+	// full memtables are not written to anymore
+	for _, mem := range pending {
+		iterators = append(iterators, newSliceIterator(mem.counts))
+	}
+
+	for _, run := range runs {
+		iterators = append(iterators, run.iterator())
+	}
+
+	return mergeEntries(iterators, yield)
+}
+
+// Replace writes entries to a single run. The current state is kept if
+// entries fail. The position of the new state is unknown until SetPosition.
+func (e *LSMEngine) Replace(entries Entries) error {
+	e.work.Lock()
+	defer e.work.Unlock()
+
+	run, err := e.writeRun(entries)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+
+	old := e.runs
+
+	e.runs = nil
+	if run != nil {
+		e.runs = []*lsmRun{run}
+	}
+
+	e.memtable = &memtable{counts: make(map[string]int)}
+	e.pending = nil
+	e.seq, e.term = 0, 0
+	e.flushed = e.frozen
+	e.changed.Broadcast()
+
+	e.lock.Unlock()
+
+	if err := e.writeManifest(); err != nil {
+		// the old runs are kept on disk, the previous manifest lists them
+		return err
+	}
+
+	for _, run := range old {
+		run.drop()
+	}
+
+	return nil
+}
+
+// SetPosition records the position of the last delta added, it is persisted
+// along with the delta.
+func (e *LSMEngine) SetPosition(seq uint64, term uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.memtable.seq, e.memtable.term = seq, term
+}
+
+// Checkpoint flushes the memtable and waits until every delta added so far is
+// in a durable manifest.
+func (e *LSMEngine) Checkpoint() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.err != nil {
+		return e.err
+	}
+
+	if len(e.memtable.counts) > 0 || e.memtable.seq != e.seq || e.memtable.term != e.term {
+		e.freezeMemtable()
+	}
+
+	target := e.frozen
+	for e.flushed < target && e.err == nil {
+		e.changed.Wait()
+	}
+
+	return e.err
+}
+
+// Persisted returns the position of the state held by the durable runs.
+func (e *LSMEngine) Persisted() (uint64, uint64) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.seq, e.term
+}
+
+// Close stops the background work and closes the runs. The memtables not
+// flushed yet are dropped, see Checkpoint.
+func (e *LSMEngine) Close() error {
+	close(e.done)
+	e.stopped.Wait()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var errs []error
+	for _, run := range e.runs {
+		errs = append(errs, run.release())
+	}
+
+	e.runs = nil
+
+	return errors.Join(errs...)
+}
+
+// freezeMemtable hands the memtable to the background flush. The lock must be
+// held.
+func (e *LSMEngine) freezeMemtable() {
+	e.pending = append(e.pending, e.memtable)
+	e.memtable = &memtable{counts: make(map[string]int), seq: e.memtable.seq, term: e.memtable.term}
+	e.frozen++
+
+	wake(e.flushWake)
+}
+
+// acquireRuns returns the runs, which are kept open until released. The lock
+// must be held.
+func (e *LSMEngine) acquireRuns() []*lsmRun {
+	runs := make([]*lsmRun, len(e.runs))
+	for i, run := range e.runs {
+		run.acquire()
+		runs[i] = run
+	}
+
+	return runs
+}
+
+func releaseRuns(runs []*lsmRun) {
+	for _, run := range runs {
+		run.release()
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// fail stops the writes after a background failure.
+func (e *LSMEngine) fail(err error) {
+	e.logger.Error("lsm engine background work failed, writes are refused", "error", err)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.err == nil {
+		e.err = err
+	}
+
+	e.changed.Broadcast()
+}
+
+func (e *LSMEngine) runFlush() {
+	defer e.stopped.Done()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-e.flushWake:
+		}
+
+		for {
+			flushed, err := e.flushOne()
+			if err != nil {
+				e.fail(err)
+				return
+			}
+
+			if !flushed {
+				break
+			}
+
+			wake(e.compactWake)
+		}
+	}
+}
+
+// flushOne writes the oldest pending memtable to a run, it returns false when
+// none is pending.
+func (e *LSMEngine) flushOne() (bool, error) {
+	e.work.RLock()
+	defer e.work.RUnlock()
+
+	e.lock.RLock()
+	if len(e.pending) == 0 {
+		e.lock.RUnlock()
+
+		return false, nil
+	}
+
+	mem := e.pending[0]
+	e.lock.RUnlock()
+
+	run, err := e.writeRun(mapEntries(mem.counts))
+	if err != nil {
+		return false, err
+	}
+
+	e.lock.Lock()
+
+	e.pending = e.pending[1:]
+	if run != nil {
+		e.runs = append([]*lsmRun{run}, e.runs...)
+	}
+
+	e.seq, e.term = mem.seq, mem.term
+
+	e.lock.Unlock()
+
+	if err := e.writeManifest(); err != nil {
+		return false, err
+	}
+
+	e.lock.Lock()
+	e.flushed++
+	e.changed.Broadcast()
+	e.lock.Unlock()
+
+	return true, nil
+}
+
+func (e *LSMEngine) runCompaction() {
+	defer e.stopped.Done()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-e.compactWake:
+		}
+
+		for {
+			merged, err := e.mergeOne()
+			if err != nil {
+				e.fail(err)
+				return
+			}
+
+			if !merged {
+				break
+			}
+
+			select {
+			case <-e.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// mergeOne merges a run into the older one next to it while it is at least
+// half as big, so that run sizes grow geometrically. It returns false when
+// there is nothing to merge.
+func (e *LSMEngine) mergeOne() (bool, error) {
+	e.work.RLock()
+	defer e.work.RUnlock()
+
+	e.lock.RLock()
+
+	var newer, older *lsmRun
+	for i := 0; i+1 < len(e.runs); i++ {
+		if e.runs[i].size*2 >= e.runs[i+1].size {
+			newer, older = e.runs[i], e.runs[i+1]
+			break
+		}
+	}
+
+	e.lock.RUnlock()
+
+	if newer == nil {
+		return false, nil
+	}
+
+	// runs are immutable, and only dropped by merges and Replace
+	merged, err := e.writeRun(func(yield func(word string, count int) bool) error {
+		return mergeEntries([]entryIterator{newer.iterator(), older.iterator()}, yield)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	e.lock.Lock()
+
+	// flushes only add newer runs meanwhile, the merged one takes the place
+	// of the two
+	runs := make([]*lsmRun, 0, len(e.runs)-1)
+	for _, run := range e.runs {
+		switch {
+		case run == newer:
+			if merged != nil {
+				runs = append(runs, merged)
+			}
+		case run != older:
+			runs = append(runs, run)
+		}
+	}
+
+	e.runs = runs
+
+	e.lock.Unlock()
+
+	if err := e.writeManifest(); err != nil {
+		return false, err
+	}
+
+	newer.drop()
+	older.drop()
+
+	return true, nil
+}
+
+// writeManifest durably lists the current runs and their position.
+func (e *LSMEngine) writeManifest() error {
+	e.manifestLock.Lock()
+	defer e.manifestLock.Unlock()
+
+	e.lock.RLock()
+
+	manifest := lsmManifest{Seq: e.seq, Term: e.term, Runs: []uint64{}}
+	for _, run := range e.runs {
+		manifest.Runs = append(manifest.Runs, run.id)
+	}
+
+	e.lock.RUnlock()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	name := path.Join(e.dir, ManifestFile)
+	if err := writeFileSync(name+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	// also makes the entries of the new runs durable
+	return syncDir(e.dir)
+}
+
+// readManifest returns the manifest of the engine in dir, an empty one when
+// there is none yet.
+func readManifest(dir string) (lsmManifest, error) {
+	data, err := os.ReadFile(path.Join(dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return lsmManifest{}, nil
+	}
+
+	if err != nil {
+		return lsmManifest{}, err
+	}
+
+	var manifest lsmManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return lsmManifest{}, fmt.Errorf("%w: lsm manifest: %w", dbErrs.ErrCorruptSnapshot, err)
+	}
+
+	return manifest, nil
+}
+
+// LSMManifest describes the manifest of an lsm engine.
+type LSMManifest struct {
+	Seq  uint64
+	Term uint64
+	// files of the runs, newest first
+	Runs []string
+}
+
+// ReadLSMManifest reads the manifest of the lsm engine in dir, an empty one
+// when there is none yet.
+func ReadLSMManifest(dir string) (LSMManifest, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return LSMManifest{}, err
+	}
+
+	runs := make([]string, 0, len(manifest.Runs))
+	for _, id := range manifest.Runs {
+		runs = append(runs, runFile(dir, id))
+	}
+
+	return LSMManifest{Seq: manifest.Seq, Term: manifest.Term, Runs: runs}, nil
+}
+
+// InspectRun reads every entry of a run of the lsm engine, cross-checking
+// them against its index, and returns their number.
+func InspectRun(name string) (int, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+
+	entries := 0
+
+	err = scanEntries(data, func(string, int) bool {
+		entries++
+		return true
+	})
+
+	return entries, err
+}
+
+// writeRun durably writes entries to a new run, nil when there are none.
+func (e *LSMEngine) writeRun(entries Entries) (*lsmRun, error) {
+	e.lock.Lock()
+	id := e.nextID
+	e.nextID++
+	e.lock.Unlock()
+
+	name := e.runName(id)
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewWriter(file)
+	writer := newEntriesWriter(buffered)
+
+	err = writer.write(entries)
+
+	if err == nil {
+		err = buffered.Flush()
+	}
+
+	if err == nil && writer.entries == 0 {
+		file.Close()
+
+		return nil, os.Remove(name)
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	var run *lsmRun
+	if err == nil {
+		run, err = openRun(id, file, e.cache)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(name)
+
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// lsmRun is an immutable file of sorted entries in the binary snapshot
+// format, with its sparse index loaded in memory. It is reference counted:
+// the engine holds a reference while the run is listed, readers while they
+// read it, and the file is closed with the last one.
+type lsmRun struct {
+	id          uint64
+	file        *os.File
+	cache       *blockCache
+	size        int64
+	indexOffset uint64
+	// first key and offset of every block
+	keys    []string
+	offsets []uint64
+	refs    atomic.Int32
+	// set once the run was merged or replaced, its file is removed when
+	// closed
+	dropped atomic.Bool
+}
+
+func openRun(id uint64, file *os.File, cache *blockCache) (*lsmRun, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() < footerSize {
+		return nil, fmt.Errorf("%w: truncated run footer", dbErrs.ErrCorruptSnapshot)
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return nil, err
+	}
+
+	run := &lsmRun{
+		id:          id,
+		file:        file,
+		cache:       cache,
+		size:        info.Size(),
+		indexOffset: binary.BigEndian.Uint64(footer[0:8]),
+	}
+
+	run.refs.Store(1)
+
+	indexEntries := binary.BigEndian.Uint64(footer[8:16])
+
+	if run.indexOffset > uint64(info.Size()-footerSize) {
+		return nil, fmt.Errorf("%w: run index offset out of range", dbErrs.ErrCorruptSnapshot)
+	}
+
+	index := make([]byte, uint64(info.Size()-footerSize)-run.indexOffset)
+	if _, err := file.ReadAt(index, int64(run.indexOffset)); err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < indexEntries; i++ {
+		word, n, err := readString(index)
+		if err != nil {
+			return nil, err
+		}
+
+		index = index[n:]
+
+		offset, n := binary.Uvarint(index)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: malformed run index offset", dbErrs.ErrCorruptSnapshot)
+		}
+
+		index = index[n:]
+
+		run.keys = append(run.keys, word)
+		run.offsets = append(run.offsets, offset)
+	}
+
+	return run, nil
+}
+
+func (r *lsmRun) acquire() {
+	r.refs.Add(1)
+}
+
+// release closes the run with the last reference, and removes its file once
+// it was dropped.
+func (r *lsmRun) release() error {
+	if r.refs.Add(-1) > 0 {
+		return nil
+	}
+
+	err := r.file.Close()
+
+	if r.dropped.Load() {
+		r.cache.evict(r.id)
+
+		err = errors.Join(err, os.Remove(r.file.Name()))
+	}
+
+	return err
+}
+
+// drop releases the reference of the engine to a run no manifest lists
+// anymore.
+func (r *lsmRun) drop() {
+	r.dropped.Store(true)
+	r.release()
+}
+
+func (r *lsmRun) get(word string, cache *blockCache) (int, error) {
+	// last block starting at or before word
+	block := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] > word }) - 1
+	if block < 0 {
+		return 0, nil
+	}
+
+	entries, err := cache.get(r.id, block, func() ([]lsmEntry, error) {
+		return r.readBlock(block)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].word >= word })
+	if i < len(entries) && entries[i].word == word {
+		return entries[i].count, nil
+	}
+
+	return 0, nil
+}
+
+func (r *lsmRun) readBlock(block int) ([]lsmEntry, error) {
+	end := r.indexOffset
+	if block+1 < len(r.offsets) {
+		end = r.offsets[block+1]
+	}
+
+	data := make([]byte, end-r.offsets[block])
+	if _, err := r.file.ReadAt(data, int64(r.offsets[block])); err != nil {
+		return nil, err
+	}
+
+	entries := make([]lsmEntry, 0, indexInterval)
+	for len(data) > 0 {
+		word, n, err := readString(data)
+		if err != nil {
+			return nil, err
+		}
+
+		data = data[n:]
+
+		count, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: malformed run count", dbErrs.ErrCorruptSnapshot)
+		}
+
+		data = data[n:]
+
+		entries = append(entries, lsmEntry{word: word, count: int(count)})
+	}
+
+	return entries, nil
+}
+
+// iterator scans the run sequentially, bypassing the block cache.
+func (r *lsmRun) iterator() entryIterator {
+	return &runIterator{
+		reader: bufio.NewReader(io.NewSectionReader(r.file, 0, int64(r.indexOffset))),
+	}
+}
+
+type lsmEntry struct {
+	word  string
+	count int
+}
+
+type entryIterator interface {
+	// next returns the next entry, ok is false at the end
+	next() (entry lsmEntry, ok bool, err error)
+}
+
+type sliceIterator struct {
+	entries []lsmEntry
+}
+
+// newSliceIterator iterates over the words of wordCount in key order.
+func newSliceIterator(wordCount map[string]int) *sliceIterator {
+	entries := make([]lsmEntry, 0, len(wordCount))
+	for word, count := range wordCount {
+		entries = append(entries, lsmEntry{word: word, count: count})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].word < entries[j].word })
+
+	return &sliceIterator{entries: entries}
+}
+
+func (it *sliceIterator) next() (lsmEntry, bool, error) {
+	if len(it.entries) == 0 {
+		return lsmEntry{}, false, nil
+	}
+
+	entry := it.entries[0]
+	it.entries = it.entries[1:]
+
+	return entry, true, nil
+}
+
+type runIterator struct {
+	reader *bufio.Reader
+}
+
+func (it *runIterator) next() (lsmEntry, bool, error) {
+	length, err := binary.ReadUvarint(it.reader)
+	if errors.Is(err, io.EOF) {
+		return lsmEntry{}, false, nil
+	}
+
+	if err != nil {
+		return lsmEntry{}, false, err
+	}
+
+	word := make([]byte, length)
+	if _, err := io.ReadFull(it.reader, word); err != nil {
+		return lsmEntry{}, false, err
+	}
+
+	count, err := binary.ReadVarint(it.reader)
+	if err != nil {
+		return lsmEntry{}, false, err
+	}
+
+	return lsmEntry{word: string(word), count: int(count)}, true, nil
+}
+
+// mergeEntries yields the entries of the sorted iterators in key order,
+// summing the counts of a word found in several of them.
+func mergeEntries(iterators []entryIterator, yield func(word string, count int) bool) error {
+	heads := make([]lsmEntry, len(iterators))
+	live := make([]bool, len(iterators))
+
+	advance := func(i int) error {
+		entry, ok, err := iterators[i].next()
+		if err != nil {
+			return err
+		}
+
+		heads[i], live[i] = entry, ok
+
+		return nil
+	}
+
+	for i := range iterators {
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var (
+			word  string
+			found bool
+		)
+
+		for i := range heads {
+			if live[i] && (!found || heads[i].word < word) {
+				word, found = heads[i].word, true
+			}
+		}
+
+		if !found {
+			return nil
+		}
+
+		count := 0
+		for i := range heads {
+			if !live[i] || heads[i].word != word {
+				continue
+			}
+
+			count += heads[i].count
+
+			if err := advance(i); err != nil {
+				return err
+			}
+		}
+
+		if !yield(word, count) {
+			return nil
+		}
+	}
+}
+
+// blockCache is an LRU cache of decoded run blocks.
+type blockCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[blockKey]*list.Element
+	lru      *list.List
+}
+
+type blockKey struct {
+	run   uint64
+	block int
+}
+
+type cachedBlock struct {
+	key     blockKey
+	entries []lsmEntry
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		entries:  make(map[blockKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the cached block, loading it with load on a miss.
+func (c *blockCache) get(run uint64, block int, load func() ([]lsmEntry, error)) ([]lsmEntry, error) {
+	key := blockKey{run: run, block: block}
+
+	c.lock.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.lock.Unlock()
+
+		return elem.Value.(*cachedBlock).entries, nil
+	}
+	c.lock.Unlock()
+
+	entries, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.capacity <= 0 {
+		return entries, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&cachedBlock{key: key, entries: entries})
+	}
+
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedBlock).key)
+	}
+
+	return entries, nil
+}
+
+// evict drops the blocks of a run that no longer exists.
+func (c *blockCache) evict(run uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, elem := range c.entries {
+		if key.run == run {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+)
+
+const (
+	// file of the leader's rootDir listing the replicas that joined at
+	// runtime
+	MembersFile = "replicas.json"
+)
+
+// LoadMembers returns the replica URLs saved in the file name, none when it
+// doesn't exist.
+func LoadMembers(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var members []string
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// SaveMembers atomically replaces the replica URLs saved in the file name.
+func SaveMembers(name string, members []string) error {
+	data, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileSync(name+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	return syncDir(path.Dir(name))
+}
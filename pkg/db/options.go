@@ -0,0 +1,103 @@
+package db
+
+import "time"
+
+// Retention controls which snapshot generations the leader keeps on disk.
+// The two newest generations are always kept.
+type Retention struct {
+	// maximum number of generations, 0 keeps only the two newest
+	Count int
+	// generations older than MaxAge are dropped, 0 disables the age limit
+	MaxAge time.Duration
+}
+
+var DefaultRetention = Retention{
+	Count:  10,
+	MaxAge: 24 * time.Hour,
+}
+
+type options struct {
+	retention   Retention
+	compression Compression
+	keyring     *Keyring
+	engine      StorageEngine
+	lsm         LSMConfig
+	// how often the state is written to disk
+	backupInterval time.Duration
+	// number of recent changes the leader, or a replica serving downstream
+	// replicas, keeps for them to catch up
+	changelogSize int
+}
+
+type Option func(*options)
+
+// WithRetention sets the snapshot generations retention policy.
+func WithRetention(retention Retention) Option {
+	return func(o *options) {
+		o.retention = retention
+	}
+}
+
+// WithCompression sets the compression of the snapshot files written by the
+// node. Files are readable regardless of the compression they were written with.
+func WithCompression(compression Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithKeyring encrypts the files written by the node with the current key of
+// keyring and decrypts existing ones with any of its keys.
+func WithKeyring(keyring *Keyring) Option {
+	return func(o *options) {
+		o.keyring = keyring
+	}
+}
+
+// WithStorageEngine sets the engine keeping the word counts of the node.
+func WithStorageEngine(engine StorageEngine) Option {
+	return func(o *options) {
+		o.engine = engine
+	}
+}
+
+// WithLSMConfig tunes the lsm storage engine.
+func WithLSMConfig(config LSMConfig) Option {
+	return func(o *options) {
+		o.lsm = config
+	}
+}
+
+// WithBackupInterval sets how often the leader writes a snapshot and a
+// persistent replica writes its state.
+func WithBackupInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.backupInterval = interval
+	}
+}
+
+// WithChangelogSize sets how many recent changes the leader, or a replica
+// serving downstream replicas, keeps for them to catch up from, 0 disables
+// incremental catch-up.
+func WithChangelogSize(size int) Option {
+	return func(o *options) {
+		o.changelogSize = size
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		retention:      DefaultRetention,
+		compression:    CompressionNone,
+		engine:         StorageEngineMap,
+		lsm:            DefaultLSMConfig,
+		backupInterval: writeFreq,
+		changelogSize:  DefaultChangelogSize,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
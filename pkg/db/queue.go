@@ -0,0 +1,227 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+const (
+	// directory of the leader's rootDir holding the outbound replication
+	// queues
+	QueueDir = "queues"
+	// extension of the durable queue files
+	QueueSuffix = ".queue"
+)
+
+// Queue is a FIFO of leader changes waiting to be delivered to a replica.
+//
+// A queue opened with OpenQueue is backed by a file in the write-ahead log
+// record format, so that undelivered changes survive a restart. Delivered
+// changes are only dropped from the file once the queue is empty: the ones
+// sent again after a restart are ignored by the replica, which already
+// applied them.
+type Queue struct {
+	lock    sync.Mutex
+	changes []Change
+
+	// persistence, only used by queues opened with OpenQueue
+	file    *os.File
+	keyring *Keyring
+	size    int64
+	// records written to file since the last sync
+	dirty bool
+}
+
+// NewQueue returns a queue that only keeps its changes in memory.
+func NewQueue() *Queue {
+	return &Queue{}
+}
+
+// OpenQueue returns a queue backed by the file name, loaded with the changes
+// it holds. Records are encrypted with the keyring passed through opts.
+func OpenQueue(name string, opts ...Option) (*Queue, error) {
+	o := newOptions(opts)
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{file: file, keyring: o.keyring}
+
+	size, err := replayWAL(file, o.keyring, func(rec walRecord) error {
+		q.insert(Change{Seq: rec.Seq, Term: rec.Term, Updates: rec.Updates})
+		return nil
+	})
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	// a torn tail is a change that was never sent, the replica notices the
+	// gap and resyncs
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	q.size = size
+
+	return q, nil
+}
+
+// Push adds change to the queue, after the changes of its term with a lower
+// seq: concurrent writers may push changes slightly out of order. It is
+// written to the file right away but only durable once Sync returns.
+func (q *Queue) Push(change Change) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file != nil {
+		data, err := encodeRecord(walRecord{Seq: change.Seq, Term: change.Term, Updates: change.Updates}, q.keyring)
+		if err != nil {
+			return err
+		}
+
+		if _, err := q.file.Write(data); err != nil {
+			// don't leave a partial record behind, later pushes would end up
+			// after it and be lost on load
+			return errors.Join(err, q.truncate(q.size))
+		}
+
+		q.size += int64(len(data))
+		q.dirty = true
+	}
+
+	q.insert(change)
+
+	return nil
+}
+
+// insert adds change in seq order among the changes of its term. The lock
+// must be held.
+func (q *Queue) insert(change Change) {
+	i := len(q.changes)
+	for i > 0 && q.changes[i-1].Term == change.Term && q.changes[i-1].Seq > change.Seq {
+		i--
+	}
+
+	q.changes = slices.Insert(q.changes, i, change)
+}
+
+// Front returns the change at the head of the queue, false when it is empty.
+func (q *Queue) Front() (Change, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.changes) == 0 {
+		return Change{}, false
+	}
+
+	return q.changes[0], true
+}
+
+// Peek returns up to max changes from the head of the queue.
+func (q *Queue) Peek(max int) []Change {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return append([]Change{}, q.changes[:min(max, len(q.changes))]...)
+}
+
+// Pop drops the changes merged into delivered, if they are still there: the
+// queue may have been cleared meanwhile.
+func (q *Queue) Pop(delivered Change) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	length := len(q.changes)
+
+	q.changes = slices.DeleteFunc(q.changes, func(change Change) bool {
+		return change.Term == delivered.Term && change.Seq >= delivered.First() && change.Seq <= delivered.Seq
+	})
+
+	if len(q.changes) == length {
+		return nil
+	}
+
+	if len(q.changes) == 0 && q.file != nil {
+		return q.truncate(0)
+	}
+
+	return nil
+}
+
+// Len returns the number of changes in the queue.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.changes)
+}
+
+// Clear drops every change of the queue.
+func (q *Queue) Clear() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.changes = nil
+
+	if q.file != nil {
+		return q.truncate(0)
+	}
+
+	return nil
+}
+
+// Sync flushes the changes pushed so far to stable storage.
+func (q *Queue) Sync() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file == nil || !q.dirty {
+		return nil
+	}
+
+	q.dirty = false
+
+	return q.file.Sync()
+}
+
+// Close closes the file of the queue, the changes it holds are kept.
+func (q *Queue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+
+	return errors.Join(q.file.Sync(), q.file.Close())
+}
+
+// truncate cuts the file to size. The lock must be held.
+func (q *Queue) truncate(size int64) error {
+	if err := q.file.Truncate(size); err != nil {
+		return err
+	}
+
+	if _, err := q.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+
+	q.size = size
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package db_test
+
+import (
+	"memdb/pkg/db"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestQueueSurvivesReopen(t *testing.T) {
+	name := path.Join(t.TempDir(), "replica.queue")
+
+	keyring, err := db.ParseKeyring(testKey)
+	if err != nil {
+		t.Fatalf("failed to parse key: %v", err)
+	}
+
+	queue, err := db.OpenQueue(name, db.WithKeyring(keyring))
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := queue.Push(db.Change{Seq: seq, Term: 7, Updates: map[string]int{"hello": int(seq)}}); err != nil {
+			t.Fatalf("failed to push change: %v", err)
+		}
+	}
+
+	if err := queue.Pop(db.Change{Seq: 1, Term: 7}); err != nil {
+		t.Fatalf("failed to pop change: %v", err)
+	}
+
+	if err := queue.Close(); err != nil {
+		t.Fatalf("failed to close queue: %v", err)
+	}
+
+	// a torn record left by a crash in the middle of a push
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open queue file: %v", err)
+	}
+
+	file.Write([]byte{0, 0, 1})
+	file.Close()
+
+	reopened, err := db.OpenQueue(name, db.WithKeyring(keyring))
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	defer reopened.Close()
+
+	// delivered changes stay in the file until the queue is empty
+	if length := reopened.Len(); length != 3 {
+		t.Fatalf("expected 3 queued changes, got %d", length)
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		change, ok := reopened.Front()
+		if !ok || change.Seq != seq || change.Term != 7 || change.Updates["hello"] != int(seq) {
+			t.Fatalf("expected change %d at the head of the queue, got %+v", seq, change)
+		}
+
+		if err := reopened.Pop(change); err != nil {
+			t.Fatalf("failed to pop change: %v", err)
+		}
+	}
+
+	if info, err := os.Stat(name); err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty queue to truncate its file, got %v", info.Size())
+	}
+}
+
+func TestQueueClear(t *testing.T) {
+	queue := db.NewQueue()
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		queue.Push(db.Change{Seq: seq, Updates: map[string]int{"hello": 1}})
+	}
+
+	if err := queue.Clear(); err != nil {
+		t.Fatalf("failed to clear queue: %v", err)
+	}
+
+	// delivered while the queue was cleared
+	if err := queue.Pop(db.Change{Seq: 1}); err != nil {
+		t.Fatalf("failed to pop change: %v", err)
+	}
+
+	if _, ok := queue.Front(); ok || queue.Len() != 0 {
+		t.Errorf("expected an empty queue, got %d changes", queue.Len())
+	}
+}
+
+func TestQueuePopsDeliveredBatch(t *testing.T) {
+	queue := db.NewQueue()
+
+	// pushed out of order by concurrent writers
+	for _, seq := range []uint64{2, 3, 1, 5, 4} {
+		queue.Push(db.Change{Seq: seq, Updates: map[string]int{"hello": 1}})
+	}
+
+	batch := queue.Peek(3)
+	if len(batch) != 3 || batch[0].Seq != 1 || batch[1].Seq != 2 || batch[2].Seq != 3 {
+		t.Fatalf("expected changes 1 to 3, got %+v", batch)
+	}
+
+	if err := queue.Pop(db.Change{Seq: 3, FirstSeq: 2}); err != nil {
+		t.Fatalf("failed to pop changes: %v", err)
+	}
+
+	// change 1 wasn't delivered with the batch
+	if changes := queue.Peek(3); len(changes) != 3 || changes[0].Seq != 1 || changes[1].Seq != 4 || changes[2].Seq != 5 {
+		t.Errorf("expected changes 1, 4 and 5 left, got %+v", changes)
+	}
+}
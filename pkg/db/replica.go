@@ -1,28 +1,209 @@
 package db
 
 import (
+	"errors"
+	"io"
 	"log/slog"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"path"
 	"sync"
+	"time"
+)
+
+const (
+	// state of a persistent remote replica, in the snapshot format
+	ReplicaFile = "replica.db"
 )
 
 type BaseReplica struct {
-	wordCount map[string]int
-	lock      sync.RWMutex
-	logger    *slog.Logger
+	// frozen while a view of it is read, see BaseLeader
+	engine *viewEngine
+	// seq and term of the last leader change applied
+	seq  uint64
+	term uint64
+	lock sync.RWMutex
+	// held for reading by the readers of a frozen engine, and for writing
+	// while the state is replaced
+	views  sync.RWMutex
+	logger *slog.Logger
+	// recent changes applied, for downstream replicas to catch up from
+	changelog *changelog
+
+	// persistence, only used by replicas opened with OpenReplica
+	rootDir string
+	opts    options
+	dirty   bool
+	done    chan struct{}
+	stopped chan struct{}
 }
 
-func NewReplica(logger *slog.Logger) *BaseReplica {
+// NewReplica returns a replica that only keeps its state in memory, opts
+// set the size of its changelog.
+func NewReplica(logger *slog.Logger, opts ...Option) *BaseReplica {
 	return &BaseReplica{
-		wordCount: make(map[string]int),
+		engine:    &viewEngine{Engine: NewMapEngine()},
 		logger:    logger,
+		changelog: newChangelog(newOptions(opts).changelogSize),
+	}
+}
+
+// OpenReplica returns a replica that persists its state in rootDir and
+// resumes from it. The state is written periodically and on Close.
+func OpenReplica(rootDir string, logger *slog.Logger, opts ...Option) (*BaseReplica, error) {
+	db := &BaseReplica{
+		logger:  logger,
+		rootDir: rootDir,
+		opts:    newOptions(opts),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	db.changelog = newChangelog(db.opts.changelogSize)
+
+	if err := os.MkdirAll(rootDir, 0700); err != nil {
+		return nil, err
+	}
+
+	removeSpools(rootDir)
+
+	engine, err := openEngine(rootDir, db.opts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	db.engine = &viewEngine{Engine: engine}
+
+	snap, err := db.resumeEngine()
+	if err != nil {
+		snap, err = openSnapshotFile(path.Join(rootDir, ReplicaFile), db.opts)
+		if err == nil {
+			err = engine.Replace(snap.Entries())
+		}
+	}
+
+	switch {
+	case err == nil:
+		db.seq, db.term = snap.Seq, snap.Term
+		db.engine.setPosition(snap.Seq, snap.Term)
+		db.dirty = snap.outdated(db.opts)
+
+		logger.Info("resuming from local state", "seq", snap.Seq, "term", snap.Term)
+	case errors.Is(err, os.ErrNotExist):
+		logger.Info("No persistence file found, starting fresh.")
+	default:
+		// the leader has everything the replica had, start over from it
+		logger.Error("!!! REPLICA STATE IS UNREADABLE, starting fresh !!!", "error", err)
+	}
+
+	go db.runPersist()
+
+	return db, nil
+}
+
+// resumeEngine returns the position of a durable engine which holds the
+// state, os.ErrNotExist when there is none.
+func (db *BaseReplica) resumeEngine() (Snapshot, error) {
+	durable, ok := db.engine.durable()
+	if !ok {
+		return Snapshot{}, os.ErrNotExist
+	}
+
+	seq, term := durable.Persisted()
+	if term == 0 {
+		return Snapshot{}, os.ErrNotExist
+	}
+
+	// version 3, nothing to rewrite
+	return Snapshot{Seq: seq, Term: term, version: snapshotVersion}, nil
+}
+
+func (db *BaseReplica) runPersist() {
+	defer close(db.stopped)
+
+	ticker := time.NewTicker(db.opts.backupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.persist(); err != nil {
+				db.logger.Error("failed to persist replica state", "error", err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// persist writes the state to disk if it changed since the last write.
+func (db *BaseReplica) persist() error {
+	db.lock.Lock()
+
+	if !db.dirty {
+		db.lock.Unlock()
+
+		return nil
+	}
+
+	db.dirty = false
+	db.lock.Unlock()
+
+	if durable, ok := db.engine.durable(); ok {
+		err := durable.Checkpoint()
+		if err != nil {
+			db.lock.Lock()
+			db.dirty = true
+			db.lock.Unlock()
+		}
+
+		return err
+	}
+
+	snap, release := db.View()
+	data, err := encodeSnapshot(snap, db.opts)
+	release()
+
+	if err == nil {
+		name := path.Join(db.rootDir, ReplicaFile)
+
+		if err = writeFileSync(name+".tmp", data, 0600); err == nil {
+			if err = os.Rename(name+".tmp", name); err == nil {
+				err = syncDir(db.rootDir)
+			}
+		}
+	}
+
+	if err != nil {
+		db.lock.Lock()
+		db.dirty = true
+		db.lock.Unlock()
+	}
+
+	return err
+}
+
+// Close stops the periodic writes and persists the latest state.
+func (db *BaseReplica) Close() error {
+	if db.done == nil {
+		return db.engine.Close()
 	}
+
+	close(db.done)
+	<-db.stopped
+
+	return errors.Join(db.persist(), db.engine.Close())
 }
 
 func (db *BaseReplica) GetWordCount(word string) int {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	count := db.wordCount[word]
+	count, err := db.engine.Get(word)
+	if err != nil {
+		db.logger.Error("failed to read word from storage engine", "word", word, "error", err)
+	}
+
 	return count
 }
 
@@ -30,12 +211,175 @@ func (db *BaseReplica) AddWordCount(word string, count int) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	db.wordCount[word] += count
+	db.add(map[string]int{word: count})
 }
 
 func (db *BaseReplica) SetWordsCounts(wordCounts map[string]int) {
+	db.views.Lock()
+	defer db.views.Unlock()
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	db.wordCount = wordCounts
+	db.replace(mapEntries(wordCounts))
+	db.engine.setPosition(db.seq, db.term)
+}
+
+// Apply adds the leader change to the word counts and moves the position to
+// it. Changes are expected in order, the caller holds back the ones arriving
+// early.
+func (db *BaseReplica) Apply(change Change) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.add(change.Updates)
+	db.seq, db.term = change.Seq, change.Term
+	db.engine.setPosition(change.Seq, change.Term)
+	db.changelog.add(change)
+}
+
+// Reset replaces the word counts with the leader snapshot.
+func (db *BaseReplica) Reset(snap Snapshot) {
+	// waits for the downstream replicas reading a view
+	db.views.Lock()
+	defer db.views.Unlock()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.replace(snap.Entries())
+	db.seq, db.term = snap.Seq, snap.Term
+	db.engine.setPosition(snap.Seq, snap.Term)
+	db.changelog.reset()
+}
+
+// Snapshot returns a copy of the word counts and their position, for
+// downstream replicas to sync from.
+func (db *BaseReplica) Snapshot() Snapshot {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	wordCounts := make(map[string]int)
+
+	if err := db.engine.Range(func(word string, count int) bool {
+		wordCounts[word] = count
+		return true
+	}); err != nil {
+		db.logger.Error("failed to read storage engine", "error", err)
+	}
+
+	return Snapshot{Seq: db.seq, Term: db.term, WordCount: wordCounts}
+}
+
+// View returns the word counts and their position as of now without copying
+// them, see BaseLeader.View. release must be called once done with them.
+func (db *BaseReplica) View() (Snapshot, func()) {
+	db.views.RLock()
+
+	db.lock.Lock()
+	snap := Snapshot{Seq: db.seq, Term: db.term, entries: db.engine.freeze()}
+	db.lock.Unlock()
+
+	return snap, db.releaseView
+}
+
+// WriteSnapshot writes a view to w like BaseLeader.WriteSnapshot, a replica
+// that only keeps its state in memory spools it to the temporary directory.
+func (db *BaseReplica) WriteSnapshot(w io.Writer, snap Snapshot) error {
+	return writeSnapshot(w, snap, db.rootDir, db.opts)
+}
+
+// viewAt is View as of position seq of term, see BaseLeader.viewAt.
+func (db *BaseReplica) viewAt(term uint64, seq uint64) (Snapshot, func(), error) {
+	db.views.RLock()
+
+	db.lock.Lock()
+
+	changes, err := db.changesSince(term, seq)
+	if err != nil {
+		db.lock.Unlock()
+		db.views.RUnlock()
+
+		return Snapshot{}, nil, err
+	}
+
+	snap := Snapshot{Seq: seq, Term: term, entries: rollBack(db.engine.freeze(), changes)}
+	db.lock.Unlock()
+
+	return snap, db.releaseView, nil
+}
+
+func (db *BaseReplica) releaseView() {
+	db.lock.Lock()
+	if err := db.engine.thaw(); err != nil {
+		db.logger.Error("failed to apply words to storage engine", "error", err)
+	}
+	db.lock.Unlock()
+
+	db.views.RUnlock()
+}
+
+// ChangesSince returns the changes applied after seq in term, or
+// ErrPositionTruncated when the changelog doesn't reach back to seq, seq
+// belongs to another term, is ahead of the replica or in the middle of a
+// merged change.
+func (db *BaseReplica) ChangesSince(term uint64, seq uint64) ([]Change, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.changesSince(term, seq)
+}
+
+// changesSince is ChangesSince with the lock held.
+func (db *BaseReplica) changesSince(term uint64, seq uint64) ([]Change, error) {
+	if term != db.term || seq > db.seq {
+		return nil, dbErrs.ErrPositionTruncated
+	}
+
+	if seq == db.seq {
+		return []Change{}, nil
+	}
+
+	changes, ok := db.changelog.since(seq)
+	if !ok {
+		return nil, dbErrs.ErrPositionTruncated
+	}
+
+	return changes, nil
+}
+
+// Position returns the seq of the last leader change applied, 0 when nothing
+// is known about the leader state.
+func (db *BaseReplica) Position() uint64 {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.seq
+}
+
+// Term returns the leader term of the last change applied, 0 when nothing is
+// known about the leader state.
+func (db *BaseReplica) Term() uint64 {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.term
+}
+
+// add applies updates to the engine, the lock must be held.
+func (db *BaseReplica) add(updates map[string]int) {
+	if err := db.engine.Add(updates); err != nil {
+		db.logger.Error("failed to apply words to storage engine", "error", err)
+	}
+
+	db.dirty = true
+}
+
+// replace swaps the engine content for entries, the lock must be held.
+func (db *BaseReplica) replace(entries Entries) {
+	if err := db.engine.Replace(entries); err != nil {
+		db.logger.Error("failed to replace storage engine content", "error", err)
+	}
+
+	db.dirty = true
 }
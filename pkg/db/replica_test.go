@@ -1,9 +1,12 @@
 package db_test
 
 import (
+	"errors"
 	"log/slog"
 	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
 	"os"
+	"path"
 	"testing"
 )
 
@@ -58,3 +61,136 @@ func TestSetWordsCounts(t *testing.T) {
 		t.Fatalf("Expected word count for 'world' to be 2, got %d", count)
 	}
 }
+
+func TestReplicaResumesFromLocalState(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	engines := map[string][]db.Option{
+		"map": nil,
+		// resumed from the engine manifest rather than a snapshot
+		"lsm": {db.WithStorageEngine(db.StorageEngineLSM)},
+	}
+
+	for name, opts := range engines {
+		t.Run(name, func(t *testing.T) {
+			rootDir := t.TempDir()
+
+			replica, err := db.OpenReplica(rootDir, logger, opts...)
+			if err != nil {
+				t.Fatalf("failed to open replica: %v", err)
+			}
+
+			replica.Reset(db.Snapshot{Seq: 3, Term: 7, WordCount: map[string]int{"hello": 1}})
+			replica.Apply(db.Change{Seq: 4, Term: 7, Updates: map[string]int{"world": 1}})
+			replica.Apply(db.Change{Seq: 5, Term: 7, Updates: map[string]int{"hello": 1, "world": 1}})
+
+			if err := replica.Close(); err != nil {
+				t.Fatalf("failed to close replica: %v", err)
+			}
+
+			resumed, err := db.OpenReplica(rootDir, logger, opts...)
+			if err != nil {
+				t.Fatalf("failed to reopen replica: %v", err)
+			}
+			defer resumed.Close()
+
+			if position, term := resumed.Position(), resumed.Term(); position != 5 || term != 7 {
+				t.Errorf("expected position 5 in term 7, got %d in term %d", position, term)
+			}
+
+			expectedCounts := map[string]int{"hello": 2, "world": 2}
+			for word, count := range expectedCounts {
+				if got := resumed.GetWordCount(word); got != count {
+					t.Errorf("expected %d for word %s, got %d", count, word, got)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicaSnapshotCompression(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	replica, err := db.OpenReplica(rootDir, logger, db.WithCompression(db.CompressionGzip))
+	if err != nil {
+		t.Fatalf("failed to open replica: %v", err)
+	}
+
+	replica.Reset(db.Snapshot{Seq: 3, Term: 7, WordCount: map[string]int{"hello": 1}})
+
+	if err := replica.Close(); err != nil {
+		t.Fatalf("failed to close replica: %v", err)
+	}
+
+	data, err := os.ReadFile(path.Join(rootDir, db.ReplicaFile))
+	if err != nil {
+		t.Fatalf("failed to read replica state: %v", err)
+	}
+
+	snap, err := db.OpenSnapshot(data)
+	if err != nil {
+		t.Fatalf("failed to open replica state: %v", err)
+	}
+
+	if snap.Compression() != db.CompressionGzip {
+		t.Errorf("expected a gzip compressed replica state, got %s", snap.Compression())
+	}
+}
+
+func TestReplicaStartsFreshFromCorruptState(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	if err := os.WriteFile(path.Join(rootDir, db.ReplicaFile), []byte("MDBS garbage"), 0600); err != nil {
+		t.Fatalf("failed to write replica state: %v", err)
+	}
+
+	replica, err := db.OpenReplica(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to open replica: %v", err)
+	}
+	defer replica.Close()
+
+	// position 0 makes the server do a full sync from the leader
+	if position := replica.Position(); position != 0 {
+		t.Errorf("expected position 0, got %d", position)
+	}
+}
+
+func TestReplicaChangesSince(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	replica := db.NewReplica(logger)
+	replica.Reset(db.Snapshot{Seq: 1, Term: 7, WordCount: map[string]int{"a": 1}})
+
+	// a change merging seqs 2 to 4, then a single one
+	replica.Apply(db.Change{Seq: 4, Term: 7, FirstSeq: 2, Updates: map[string]int{"b": 3}})
+	replica.Apply(db.Change{Seq: 5, Term: 7, Updates: map[string]int{"c": 1}})
+
+	changes, err := replica.ChangesSince(7, 1)
+	if err != nil || len(changes) != 2 || changes[0].Seq != 4 || changes[1].Seq != 5 {
+		t.Fatalf("expected the changes after seq 1, got %v, %v", changes, err)
+	}
+
+	changes, err = replica.ChangesSince(7, 4)
+	if err != nil || len(changes) != 1 || changes[0].Seq != 5 {
+		t.Fatalf("expected the change after seq 4, got %v, %v", changes, err)
+	}
+
+	// a merged change can't be split
+	if _, err := replica.ChangesSince(7, 3); !errors.Is(err, dbErrs.ErrPositionTruncated) {
+		t.Errorf("expected a position inside a merged change to be truncated, got %v", err)
+	}
+
+	// the snapshot the replica was reset to is not in the changelog
+	if _, err := replica.ChangesSince(7, 0); !errors.Is(err, dbErrs.ErrPositionTruncated) {
+		t.Errorf("expected a position before the snapshot to be truncated, got %v", err)
+	}
+
+	if _, err := replica.ChangesSince(8, 5); !errors.Is(err, dbErrs.ErrPositionTruncated) {
+		t.Errorf("expected a position of another term to be truncated, got %v", err)
+	}
+}
@@ -0,0 +1,474 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// Content-Type of a snapshot sent over HTTP
+	SnapshotContentType = "application/x-memdb-snapshot"
+
+	snapshotMagic = "MDBS"
+	// version 1: JSON payload, version 2: binary payload (see encodeWordCounts),
+	// version 3: term in the header
+	snapshotVersion = 3
+	// magic (4) + version (2) + flags (2) + seq (8) + term (8, since version 3)
+	// + payload length (8) + CRC-32C (4)
+	snapshotHeaderSize = 36
+
+	// spool files of WriteSnapshot, written in chunks of spoolChunkSize
+	spoolPattern   = "snapshot-*.spool"
+	spoolChunkSize = 64 << 10
+)
+
+// snapshotHeaderLayout returns the size of the header of a version and the
+// offset of its payload length, everything before it is authenticated along
+// with an encrypted payload.
+func snapshotHeaderLayout(version uint16) (size int, lengthOffset int) {
+	if version < 3 {
+		return 28, 16
+	}
+
+	return snapshotHeaderSize, 24
+}
+
+// Snapshot is a point-in-time copy of the word counts. Seq is the last
+// write-ahead log record it contains and Term the leader history it belongs
+// to, 0 when unknown.
+type Snapshot struct {
+	Seq       uint64
+	Term      uint64
+	WordCount map[string]int
+	// used instead of WordCount by snapshots that are not loaded in memory:
+	// the word counts of a node engine or a binary payload
+	entries Entries
+	payload []byte
+	// format version it was decoded from, 0 for a bare JSON map
+	version uint16
+	flags   uint16
+	// key it was encrypted with
+	keyID uint32
+}
+
+// Entries yields the word counts of snap in key order.
+func (snap Snapshot) Entries() Entries {
+	switch {
+	case snap.entries != nil:
+		return snap.entries
+	case snap.payload != nil:
+		return func(yield func(word string, count int) bool) error {
+			return scanEntries(snap.payload, yield)
+		}
+	default:
+		return mapEntries(snap.WordCount)
+	}
+}
+
+// EncodeSnapshot serializes snap in the current snapshot format, compressed
+// and encrypted as configured by opts.
+func EncodeSnapshot(snap Snapshot, opts ...Option) ([]byte, error) {
+	return encodeSnapshot(snap, newOptions(opts))
+}
+
+func encodeSnapshot(snap Snapshot, o options) ([]byte, error) {
+	payload, err := encodeEntries(snap.Entries())
+	if err != nil {
+		return nil, err
+	}
+
+	payload, flags, err := compress(payload, o.compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.keyring != nil {
+		flags |= flagEncrypted
+	}
+
+	header := snapshotHeader(snap, flags)
+
+	if o.keyring != nil {
+		// the header is authenticated along with the payload so that the seq,
+		// term and flags can't be tampered with
+		if payload, err = o.keyring.seal(payload, header[0:24]); err != nil {
+			return nil, err
+		}
+	}
+
+	data := append(header, payload...)
+	binary.BigEndian.PutUint64(data[24:32], uint64(len(payload)))
+	binary.BigEndian.PutUint32(data[32:36], crc32.Checksum(payload, crcTable))
+
+	return data, nil
+}
+
+// snapshotHeader returns the header of snap in the current format, the
+// payload length and checksum are left to fill in.
+func snapshotHeader(snap Snapshot, flags uint16) []byte {
+	header := make([]byte, snapshotHeaderSize)
+	copy(header[0:4], snapshotMagic)
+	binary.BigEndian.PutUint16(header[4:6], snapshotVersion)
+	binary.BigEndian.PutUint16(header[6:8], flags)
+	binary.BigEndian.PutUint64(header[8:16], snap.Seq)
+	binary.BigEndian.PutUint64(header[16:24], snap.Term)
+
+	return header
+}
+
+// WriteSnapshot writes snap to w in the current snapshot format, uncompressed
+// and unencrypted. Unlike EncodeSnapshot it doesn't hold the payload in
+// memory: as the header leads with the payload length and checksum, the
+// payload is spooled to a temporary file in dir first, encrypted with the
+// keyring passed through opts.
+func WriteSnapshot(w io.Writer, snap Snapshot, dir string, opts ...Option) error {
+	return writeSnapshot(w, snap, dir, newOptions(opts))
+}
+
+func writeSnapshot(w io.Writer, snap Snapshot, dir string, o options) error {
+	file, err := os.CreateTemp(dir, spoolPattern)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	spool := &spoolWriter{file: file, keyring: o.keyring}
+	checksum := crc32.New(crcTable)
+	buffered := bufio.NewWriterSize(io.MultiWriter(spool, checksum), spoolChunkSize)
+
+	if err := newEntriesWriter(buffered).write(snap.Entries()); err != nil {
+		return err
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	header := snapshotHeader(snap, 0)
+	binary.BigEndian.PutUint64(header[24:32], uint64(spool.written))
+	binary.BigEndian.PutUint32(header[32:36], checksum.Sum32())
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	payload, err := spool.reader()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, payload)
+
+	return err
+}
+
+// spoolWriter writes the payload of a snapshot to a spool file, every write
+// sealed as a length prefixed chunk of its own when there is a keyring.
+type spoolWriter struct {
+	file    *os.File
+	keyring *Keyring
+	// payload bytes written and chunks sealed so far
+	written int64
+	chunks  uint64
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	if s.keyring == nil {
+		n, err := s.file.Write(p)
+		s.written += int64(n)
+
+		return n, err
+	}
+
+	sealed, err := s.keyring.seal(p, spoolChunkID(s.chunks))
+	if err != nil {
+		return 0, err
+	}
+
+	chunk := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(sealed)), uint32(len(sealed)))
+	if _, err := s.file.Write(append(chunk, sealed...)); err != nil {
+		return 0, err
+	}
+
+	s.chunks++
+	s.written += int64(len(p))
+
+	return len(p), nil
+}
+
+// reader returns the payload written to the spool.
+func (s *spoolWriter) reader() (io.Reader, error) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if s.keyring == nil {
+		return s.file, nil
+	}
+
+	return &spoolReader{reader: bufio.NewReaderSize(s.file, spoolChunkSize), keyring: s.keyring}, nil
+}
+
+// spoolReader opens the chunks sealed by a spoolWriter.
+type spoolReader struct {
+	reader  *bufio.Reader
+	keyring *Keyring
+	// rest of the current chunk
+	chunk  []byte
+	chunks uint64
+}
+
+func (s *spoolReader) Read(p []byte) (int, error) {
+	for len(s.chunk) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(s.reader, length[:]); err != nil {
+			return 0, err
+		}
+
+		sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(s.reader, sealed); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return 0, err
+		}
+
+		plain, _, err := s.keyring.open(sealed, spoolChunkID(s.chunks))
+		if err != nil {
+			return 0, err
+		}
+
+		s.chunk = plain
+		s.chunks++
+	}
+
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+
+	return n, nil
+}
+
+// spoolChunkID authenticates the position of a chunk along with it, so that
+// chunks can't be reordered.
+func spoolChunkID(chunk uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, chunk)
+}
+
+// removeSpools removes the spool files a crash left behind in dir.
+func removeSpools(dir string) {
+	names, _ := filepath.Glob(path.Join(dir, spoolPattern))
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
+
+// DecodeSnapshot parses a snapshot in any of the formats written so far,
+// including the bare JSON map written before snapshots had a header.
+// Encrypted snapshots need the keyring passed through opts.
+func DecodeSnapshot(data []byte, opts ...Option) (Snapshot, error) {
+	return decodeSnapshot(data, newOptions(opts))
+}
+
+func decodeSnapshot(data []byte, o options) (Snapshot, error) {
+	snap, err := openSnapshot(data, o)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if snap.WordCount == nil {
+		if snap.WordCount, err = decodeWordCounts(snap.payload); err != nil {
+			return Snapshot{}, err
+		}
+
+		snap.payload = nil
+	}
+
+	return snap, nil
+}
+
+// OpenSnapshot validates a snapshot like DecodeSnapshot, but leaves the
+// entries of a binary payload to be read through snap.Entries instead of
+// loading them in a map.
+func OpenSnapshot(data []byte, opts ...Option) (Snapshot, error) {
+	return openSnapshot(data, newOptions(opts))
+}
+
+func openSnapshot(data []byte, o options) (Snapshot, error) {
+	snap := Snapshot{WordCount: make(map[string]int)}
+
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		if err := json.Unmarshal(data, &snap.WordCount); err != nil {
+			return Snapshot{}, fmt.Errorf("%w: %w", dbErrs.ErrCorruptSnapshot, err)
+		}
+
+		return snap, nil
+	}
+
+	if len(data) < 6 {
+		return Snapshot{}, fmt.Errorf("%w: truncated header", dbErrs.ErrCorruptSnapshot)
+	}
+
+	snap.version = binary.BigEndian.Uint16(data[4:6])
+	if snap.version < 1 || snap.version > snapshotVersion {
+		return Snapshot{}, fmt.Errorf("%w: unsupported version %d", dbErrs.ErrCorruptSnapshot, snap.version)
+	}
+
+	headerSize, lengthOffset := snapshotHeaderLayout(snap.version)
+	if len(data) < headerSize {
+		return Snapshot{}, fmt.Errorf("%w: truncated header", dbErrs.ErrCorruptSnapshot)
+	}
+
+	snap.flags = binary.BigEndian.Uint16(data[6:8])
+	snap.Seq = binary.BigEndian.Uint64(data[8:16])
+	if snap.version >= 3 {
+		snap.Term = binary.BigEndian.Uint64(data[16:24])
+	}
+
+	length := binary.BigEndian.Uint64(data[lengthOffset : lengthOffset+8])
+	checksum := binary.BigEndian.Uint32(data[lengthOffset+8 : headerSize])
+
+	payload := data[headerSize:]
+	if uint64(len(payload)) != length {
+		return Snapshot{}, fmt.Errorf("%w: expected %d payload bytes, found %d",
+			dbErrs.ErrCorruptSnapshot, length, len(payload))
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return Snapshot{}, fmt.Errorf("%w: checksum mismatch", dbErrs.ErrCorruptSnapshot)
+	}
+
+	if snap.flags&flagEncrypted != 0 {
+		plain, keyID, err := o.keyring.open(payload, data[0:lengthOffset])
+		if err != nil {
+			return Snapshot{}, err
+		}
+
+		payload, snap.keyID = plain, keyID
+	}
+
+	payload, err := decompress(payload, snap.flags)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if snap.version == 1 {
+		if err := json.Unmarshal(payload, &snap.WordCount); err != nil {
+			return Snapshot{}, fmt.Errorf("%w: %w", dbErrs.ErrCorruptSnapshot, err)
+		}
+
+		return snap, nil
+	}
+
+	if err := scanEntries(payload, func(string, int) bool { return true }); err != nil {
+		return Snapshot{}, err
+	}
+
+	snap.WordCount, snap.payload = nil, payload
+
+	return snap, nil
+}
+
+// Version returns the format version snap was decoded from, 0 for a bare
+// JSON map.
+func (snap Snapshot) Version() uint16 {
+	return snap.version
+}
+
+// Compression returns the compression of the payload snap was decoded from.
+func (snap Snapshot) Compression() Compression {
+	switch {
+	case snap.flags&flagGzip != 0:
+		return CompressionGzip
+	case snap.flags&flagFlate != 0:
+		return CompressionFlate
+	default:
+		return CompressionNone
+	}
+}
+
+// Encrypted reports whether snap was decoded from an encrypted file.
+func (snap Snapshot) Encrypted() bool {
+	return snap.flags&flagEncrypted != 0
+}
+
+// outdated reports whether snap was decoded from an older format, or is
+// encrypted differently than o asks for, and should be rewritten.
+func (snap Snapshot) outdated(o options) bool {
+	if snap.version < snapshotVersion {
+		return true
+	}
+
+	if o.keyring == nil {
+		return snap.flags&flagEncrypted != 0
+	}
+
+	// written before encryption was enabled or with a rotated key
+	return snap.flags&flagEncrypted == 0 || snap.keyID != o.keyring.currentID()
+}
+
+func readSnapshotFile(name string, o options) (Snapshot, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return decodeSnapshot(data, o)
+}
+
+// openSnapshotFile reads a snapshot file without loading its entries in a
+// map, see openSnapshot.
+func openSnapshotFile(name string, o options) (Snapshot, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return openSnapshot(data, o)
+}
+
+// writeFileSync is like os.WriteFile but also flushes the file to stable
+// storage before returning.
+func writeFileSync(name string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir flushes directory entries (creates, renames) to stable storage.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
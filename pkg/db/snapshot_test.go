@@ -0,0 +1,275 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	wordCount := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		wordCount[fmt.Sprintf("word%d", i)] = i + 1
+	}
+
+	data, err := db.EncodeSnapshot(db.Snapshot{Seq: 42, WordCount: wordCount})
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+
+	snap, err := db.DecodeSnapshot(data)
+	if err != nil {
+		t.Fatalf("failed to decode snapshot: %v", err)
+	}
+
+	if snap.Seq != 42 {
+		t.Errorf("expected seq 42, got %d", snap.Seq)
+	}
+
+	if len(snap.WordCount) != len(wordCount) {
+		t.Fatalf("expected %d words, got %d", len(wordCount), len(snap.WordCount))
+	}
+
+	for word, count := range wordCount {
+		if snap.WordCount[word] != count {
+			t.Errorf("expected %d for word %s, got %d", count, word, snap.WordCount[word])
+		}
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	wordCount := make(map[string]int)
+	for i := 0; i < 100000; i++ {
+		wordCount[fmt.Sprintf("word%d", i)] = i + 1
+	}
+
+	snap := db.Snapshot{Seq: 42, Term: 7, WordCount: wordCount}
+
+	keyring, err := db.ParseKeyring(testKey)
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+
+	for name, opts := range map[string][]db.Option{
+		"plain":     nil,
+		"encrypted": {db.WithKeyring(keyring)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// the spool is complete by the time the header is written
+			out := &spoolCheckWriter{t: t, dir: dir, encrypted: len(opts) > 0}
+			if err := db.WriteSnapshot(out, snap, dir, opts...); err != nil {
+				t.Fatalf("failed to write snapshot: %v", err)
+			}
+
+			if !out.checked {
+				t.Fatalf("expected the payload to be spooled to %s", dir)
+			}
+
+			if names, _ := os.ReadDir(dir); len(names) != 0 {
+				t.Errorf("expected the spool to be removed, found %d files", len(names))
+			}
+
+			// streamed and encoded in memory, the files are the same
+			data, err := db.EncodeSnapshot(snap)
+			if err != nil {
+				t.Fatalf("failed to encode snapshot: %v", err)
+			}
+
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("written snapshot differs from the encoded one")
+			}
+
+			decoded, err := db.DecodeSnapshot(out.Bytes())
+			if err != nil {
+				t.Fatalf("failed to decode written snapshot: %v", err)
+			}
+
+			if decoded.Seq != 42 || decoded.Term != 7 || len(decoded.WordCount) != len(wordCount) {
+				t.Errorf("expected seq 42, term 7 and %d words, got %d, %d and %d words",
+					len(wordCount), decoded.Seq, decoded.Term, len(decoded.WordCount))
+			}
+		})
+	}
+}
+
+// spoolCheckWriter checks the spool of WriteSnapshot on the first write.
+type spoolCheckWriter struct {
+	bytes.Buffer
+	t         *testing.T
+	dir       string
+	encrypted bool
+	checked   bool
+}
+
+func (w *spoolCheckWriter) Write(p []byte) (int, error) {
+	if !w.checked {
+		w.checked = true
+
+		names, _ := filepath.Glob(filepath.Join(w.dir, "*.spool"))
+		if len(names) != 1 {
+			w.t.Fatalf("expected a spool file, found %v", names)
+		}
+
+		spool, err := os.ReadFile(names[0])
+		if err != nil {
+			w.t.Fatalf("failed to read spool: %v", err)
+		}
+
+		if plain := bytes.Contains(spool, []byte("word99999")); plain == w.encrypted {
+			w.t.Errorf("expected encrypted %t spool, found the words in the clear: %t", w.encrypted, plain)
+		}
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func TestSnapshotDetectsCorruption(t *testing.T) {
+	data, err := db.EncodeSnapshot(db.Snapshot{Seq: 1, WordCount: map[string]int{"hello": 1, "world": 2}})
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-5] ^= 0x01
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", data[:len(data)-3]},
+		{"flipped byte", flipped},
+		{"header only", data[:10]},
+	}
+
+	for _, tt := range tests {
+		if _, err := db.DecodeSnapshot(tt.data); !errors.Is(err, dbErrs.ErrCorruptSnapshot) {
+			t.Errorf("%s: expected corrupt snapshot error, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestLegacySnapshotIsUpgraded(t *testing.T) {
+	rootDir := t.TempDir()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	if err := os.WriteFile(path.Join(rootDir, db.BackupFile), []byte(`{"hello": 2, "world": 1}`), 0644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	leader, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to restore leader: %v", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	leader.Close()
+
+	data, err := os.ReadFile(path.Join(rootDir, db.BackupFile))
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+
+	if string(data[:4]) != "MDBS" {
+		t.Fatalf("expected snapshot to be rewritten in the binary format")
+	}
+
+	snap, err := db.DecodeSnapshot(data)
+	if err != nil {
+		t.Fatalf("failed to decode snapshot: %v", err)
+	}
+
+	if snap.WordCount["hello"] != 2 || snap.WordCount["world"] != 1 {
+		t.Errorf("unexpected word counts after upgrade: %v", snap.WordCount)
+	}
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	wordCount := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		wordCount[fmt.Sprintf("word%d", i)] = 1
+	}
+
+	plain, err := db.EncodeSnapshot(db.Snapshot{WordCount: wordCount})
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+
+	for _, compression := range []db.Compression{db.CompressionGzip, db.CompressionFlate} {
+		data, err := db.EncodeSnapshot(db.Snapshot{Seq: 7, WordCount: wordCount}, db.WithCompression(compression))
+		if err != nil {
+			t.Fatalf("%s: failed to encode snapshot: %v", compression, err)
+		}
+
+		if len(data) >= len(plain) {
+			t.Errorf("%s: expected compressed snapshot to be smaller, got %d >= %d bytes", compression, len(data), len(plain))
+		}
+
+		snap, err := db.DecodeSnapshot(data)
+		if err != nil {
+			t.Fatalf("%s: failed to decode snapshot: %v", compression, err)
+		}
+
+		if snap.Seq != 7 || len(snap.WordCount) != len(wordCount) || snap.WordCount["word42"] != 1 {
+			t.Errorf("%s: unexpected snapshot after round trip", compression)
+		}
+
+		if snap.Compression() != compression {
+			t.Errorf("%s: expected snapshot compression to be reported, got %s", compression, snap.Compression())
+		}
+	}
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	wordCount := map[string]int{"hello": 1, "world": 2, "zebra": 3}
+
+	data, err := db.EncodeSnapshot(db.Snapshot{Seq: 3, WordCount: wordCount}, db.WithCompression(db.CompressionGzip))
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+
+	snap, err := db.OpenSnapshot(data)
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %v", err)
+	}
+
+	if snap.Seq != 3 || snap.Version() != 3 || snap.Encrypted() {
+		t.Errorf("unexpected snapshot header: seq %d, version %d, encrypted %t", snap.Seq, snap.Version(), snap.Encrypted())
+	}
+
+	words := []string{}
+	if err := snap.Entries()(func(word string, count int) bool {
+		if wordCount[word] != count {
+			t.Errorf("expected %d for word %s, got %d", wordCount[word], word, count)
+		}
+
+		words = append(words, word)
+
+		return true
+	}); err != nil {
+		t.Fatalf("failed to read snapshot entries: %v", err)
+	}
+
+	if strings.Join(words, " ") != "hello world zebra" {
+		t.Errorf("expected entries in key order, got %v", words)
+	}
+
+	// corruption is detected when the snapshot is opened, before any entry
+	// is read
+	data[len(data)-1] ^= 0xff
+	if _, err := db.OpenSnapshot(data); !errors.Is(err, dbErrs.ErrCorruptSnapshot) {
+		t.Errorf("expected corrupt snapshot error, got %v", err)
+	}
+}
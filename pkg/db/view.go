@@ -0,0 +1,164 @@
+package db
+
+import "sort"
+
+// viewEngine wraps the engine of a node so that it can be read without
+// holding up writes: while it is frozen, deltas go to an overlay which is
+// folded back into the engine once its last reader is done. Every method must
+// be called with the node lock held, but the entries returned by freeze are
+// read without it.
+type viewEngine struct {
+	Engine
+	// deltas added while frozen, nil otherwise
+	overlay map[string]int
+	// readers of the frozen engine
+	readers int
+	// position of the last delta added, for durable engines
+	seq  uint64
+	term uint64
+}
+
+func (e *viewEngine) Get(word string) (int, error) {
+	count, err := e.Engine.Get(word)
+
+	return count + e.overlay[word], err
+}
+
+func (e *viewEngine) Add(updates map[string]int) error {
+	if e.readers == 0 {
+		return e.Engine.Add(updates)
+	}
+
+	for word, count := range updates {
+		e.overlay[word] += count
+	}
+
+	return nil
+}
+
+// Range yields the word counts, the overlay included.
+func (e *viewEngine) Range(yield func(word string, count int) bool) error {
+	return overlayEntries(e.Engine.Range, e.overlay)(yield)
+}
+
+// setPosition records the position of the last delta added. It is handed to
+// a durable engine once the delta reached it, see thaw.
+func (e *viewEngine) setPosition(seq uint64, term uint64) {
+	e.seq, e.term = seq, term
+
+	if durable, ok := e.Engine.(durableEngine); ok && e.readers == 0 {
+		durable.SetPosition(seq, term)
+	}
+}
+
+// durable returns the engine if it persists its state on its own.
+func (e *viewEngine) durable() (durableEngine, bool) {
+	durable, ok := e.Engine.(durableEngine)
+
+	return durable, ok
+}
+
+// frozen reports whether a reader is reading the frozen engine.
+func (e *viewEngine) frozen() bool {
+	return e.readers > 0
+}
+
+// freeze stops writes to the engine and returns its current entries, which
+// stay consistent until the matching thaw.
+func (e *viewEngine) freeze() Entries {
+	if e.readers == 0 {
+		e.overlay = make(map[string]int)
+	}
+
+	e.readers++
+
+	// the deltas added since an earlier freeze are part of this one
+	overlay := make(map[string]int, len(e.overlay))
+	for word, count := range e.overlay {
+		overlay[word] = count
+	}
+
+	return overlayEntries(e.Engine.Range, overlay)
+}
+
+// thaw folds the deltas added while frozen into the engine once the last
+// reader is done.
+func (e *viewEngine) thaw() error {
+	e.readers--
+	if e.readers > 0 {
+		return nil
+	}
+
+	err := e.Engine.Add(e.overlay)
+	e.overlay = nil
+
+	if err == nil {
+		e.setPosition(e.seq, e.term)
+	}
+
+	return err
+}
+
+// rollBack returns entries without the deltas of changes.
+func rollBack(entries Entries, changes []Change) Entries {
+	deltas := make(map[string]int)
+
+	for _, change := range changes {
+		for word, count := range change.Updates {
+			deltas[word] -= count
+		}
+	}
+
+	return overlayEntries(entries, deltas)
+}
+
+// overlayEntries yields entries with the deltas of overlay added, in key
+// order.
+func overlayEntries(entries Entries, overlay map[string]int) Entries {
+	if len(overlay) == 0 {
+		return entries
+	}
+
+	return func(yield func(word string, count int) bool) error {
+		words := make([]string, 0, len(overlay))
+		for word := range overlay {
+			words = append(words, word)
+		}
+
+		sort.Strings(words)
+
+		stopped := false
+
+		err := entries(func(word string, count int) bool {
+			// words only found in the overlay come first
+			for len(words) > 0 && words[0] < word {
+				if stopped = !yield(words[0], overlay[words[0]]); stopped {
+					return false
+				}
+
+				words = words[1:]
+			}
+
+			if len(words) > 0 && words[0] == word {
+				count += overlay[word]
+				words = words[1:]
+			}
+
+			stopped = !yield(word, count)
+
+			return !stopped
+		})
+
+		if err != nil || stopped {
+			return err
+		}
+
+		for _, word := range words {
+			if !yield(word, overlay[word]) {
+				return nil
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,453 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// active segment of the write-ahead log, rotated segments are named
+	// LogFile.<seq of their last record>
+	LogFile = "wordcounts.wal"
+
+	// record frame: payload length (4 bytes) + CRC-32C of the payload (4 bytes)
+	walFrameSize = 8
+
+	// first byte of an encrypted record payload, plain ones are JSON objects
+	walEncrypted = 0x00
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is a single delta accepted by CountWords.
+type walRecord struct {
+	Seq uint64 `json:"seq"`
+	// term of the leader when the delta was accepted, missing in records
+	// written before terms
+	Term    uint64         `json:"term,omitempty"`
+	Updates map[string]int `json:"updates"`
+}
+
+// wal is an append-only log of the deltas applied on the leader. Appends are
+// group committed: any number of writers can append while a single fsync
+// makes all of them durable. The log is rotated on every snapshot so that
+// segments only covered by old generations can be dropped.
+type wal struct {
+	rootDir string
+	keyring *Keyring
+	file    *os.File
+	lock    sync.Mutex // guards file writes, size, written and failed
+	size    int64
+	// seq of the last record written to the log
+	written uint64
+	// set once an fsync failed, the log refuses any further record as
+	// whatever was written since the previous fsync may or may not be on
+	// stable storage
+	failed error
+
+	syncLock sync.Mutex // serializes fsyncs, taken before lock
+	// seq of the last record known to be on stable storage and the size of
+	// the active segment up to it
+	synced     uint64
+	syncedSize int64
+}
+
+// openWAL replays every record with a seq greater than after through apply
+// and opens the log for appending. A torn record at the tail of the active
+// segment (crash in the middle of an append) is discarded. Records are
+// encrypted with keyring when set.
+func openWAL(rootDir string, after uint64, keyring *Keyring, logger *slog.Logger, apply func(rec walRecord) error) (*wal, error) {
+	segments, err := rotatedSegments(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var last uint64
+
+	replay := func(rec walRecord) error {
+		last = rec.Seq
+
+		if rec.Seq <= after {
+			return nil
+		}
+
+		return apply(rec)
+	}
+
+	for _, segment := range segments {
+		file, err := os.Open(segment.name)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := replayWAL(file, keyring, replay)
+		file.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if info, err := os.Stat(segment.name); err == nil && info.Size() != size {
+			logger.Error("!!! WRITE-AHEAD LOG SEGMENT IS CORRUPT, records after the damage are lost !!!",
+				"segment", segment.name, "intact_bytes", size, "size", info.Size())
+		}
+	}
+
+	file, err := os.OpenFile(path.Join(rootDir, LogFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := replayWAL(file, keyring, replay)
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	// drop a torn tail so that new records are appended right after the last
+	// intact one
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	return &wal{
+		rootDir:    rootDir,
+		keyring:    keyring,
+		file:       file,
+		size:       size,
+		written:    last,
+		synced:     last,
+		syncedSize: size,
+	}, nil
+}
+
+// replayWAL returns the size of the intact prefix of the log segment. A record
+// that is intact but can't be decrypted is an error rather than a torn tail.
+func replayWAL(file *os.File, keyring *Keyring, apply func(rec walRecord) error) (int64, error) {
+	reader := bufio.NewReader(file)
+
+	var size int64
+
+	frame := make([]byte, walFrameSize)
+	for {
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			// clean end of log or torn frame header
+			return size, nil
+		}
+
+		length := binary.BigEndian.Uint32(frame[0:4])
+		checksum := binary.BigEndian.Uint32(frame[4:8])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return size, nil
+		}
+
+		if crc32.Checksum(payload, crcTable) != checksum {
+			return size, nil
+		}
+
+		if len(payload) > 0 && payload[0] == walEncrypted {
+			plain, _, err := keyring.open(payload[1:], nil)
+			if err != nil {
+				return size, err
+			}
+
+			payload = plain
+		}
+
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return size, nil
+		}
+
+		if err := apply(rec); err != nil {
+			return size, err
+		}
+
+		size += walFrameSize + int64(length)
+	}
+}
+
+// LogSegmentInfo describes a write-ahead log segment.
+type LogSegmentInfo struct {
+	Records  int
+	FirstSeq uint64
+	LastSeq  uint64
+	Size     int64
+	// bytes up to the end of the last intact record, less than Size when the
+	// segment has a torn or corrupt tail
+	IntactSize int64
+}
+
+// InspectLogSegment reads every record of a write-ahead log segment.
+// Encrypted records need the keyring passed through opts.
+func InspectLogSegment(name string, opts ...Option) (LogSegmentInfo, error) {
+	o := newOptions(opts)
+
+	file, err := os.Open(name)
+	if err != nil {
+		return LogSegmentInfo{}, err
+	}
+	defer file.Close()
+
+	info := LogSegmentInfo{}
+
+	info.IntactSize, err = replayWAL(file, o.keyring, func(rec walRecord) error {
+		if info.Records == 0 {
+			info.FirstSeq = rec.Seq
+		}
+
+		info.LastSeq = rec.Seq
+		info.Records++
+
+		return nil
+	})
+	if err != nil {
+		return LogSegmentInfo{}, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return LogSegmentInfo{}, err
+	}
+
+	info.Size = stat.Size()
+
+	return info, nil
+}
+
+type walSegment struct {
+	name string
+	// seq of the last record in the segment
+	last uint64
+}
+
+// rotatedSegments lists the rotated segments in rootDir, oldest first.
+func rotatedSegments(rootDir string) ([]walSegment, error) {
+	names, err := filepath.Glob(path.Join(rootDir, LogFile+".*"))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []walSegment{}
+	for _, name := range names {
+		last, err := strconv.ParseUint(strings.TrimPrefix(path.Base(name), LogFile+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, walSegment{name: name, last: last})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].last < segments[j].last
+	})
+
+	return segments, nil
+}
+
+// encodeRecord frames rec, encrypted with keyring when set.
+func encodeRecord(rec walRecord, keyring *Keyring) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyring != nil {
+		sealed, err := keyring.seal(payload, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		payload = append([]byte{walEncrypted}, sealed...)
+	}
+
+	data := make([]byte, walFrameSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.Checksum(payload, crcTable))
+	copy(data[walFrameSize:], payload)
+
+	return data, nil
+}
+
+// append writes rec to the log. The record is not durable until sync returns.
+func (w *wal) append(rec walRecord) error {
+	data, err := encodeRecord(rec, w.keyring)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.failed != nil {
+		return w.failed
+	}
+
+	if _, err := w.file.Write(data); err != nil {
+		// don't leave a partial record behind, later appends would end up
+		// after it and be lost on replay
+		if truncErr := w.file.Truncate(w.size); truncErr != nil {
+			return errors.Join(err, truncErr)
+		}
+
+		if _, seekErr := w.file.Seek(w.size, io.SeekStart); seekErr != nil {
+			return errors.Join(err, seekErr)
+		}
+
+		return err
+	}
+
+	w.size += int64(len(data))
+	w.written = rec.Seq
+
+	return nil
+}
+
+// sync makes every record up to seq durable. When the fsync fails the log is
+// failed for good: the records written since the previous fsync are cut off
+// as far as possible and every later append or sync returns the error.
+func (w *wal) sync(seq uint64) error {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+
+	if w.synced >= seq {
+		// already flushed by a concurrent writer
+		return nil
+	}
+
+	w.lock.Lock()
+	written, size, failed := w.written, w.size, w.failed
+	w.lock.Unlock()
+
+	if failed != nil {
+		return failed
+	}
+
+	if err := w.file.Sync(); err != nil {
+		w.lock.Lock()
+		w.fail(err)
+		w.lock.Unlock()
+
+		return err
+	}
+
+	w.synced = written
+	w.syncedSize = size
+
+	return nil
+}
+
+// fail refuses any further record after err. Both the syncLock and the lock
+// must be held.
+func (w *wal) fail(err error) {
+	w.failed = fmt.Errorf("write-ahead log failed: %w", err)
+
+	// best effort, the page cache can't be trusted after a failed fsync
+	if truncErr := w.file.Truncate(w.syncedSize); truncErr == nil {
+		w.size = w.syncedSize
+		w.written = w.synced
+	}
+}
+
+// syncedSeq returns the seq of the last record known to be on stable storage.
+func (w *wal) syncedSeq() uint64 {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+
+	return w.synced
+}
+
+// rotate seals the active segment and starts a new one, so that the sealed
+// segment can be dropped once no snapshot generation needs it anymore.
+func (w *wal) rotate() error {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.failed != nil {
+		return w.failed
+	}
+
+	if w.size == 0 {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		w.fail(err)
+
+		return err
+	}
+
+	w.synced = w.written
+
+	active := path.Join(w.rootDir, LogFile)
+	sealed := fmt.Sprintf("%s.%020d", active, w.written)
+
+	if err := os.Rename(active, sealed); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(active, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w.file.Close()
+
+	w.file = file
+	w.size = 0
+	w.syncedSize = 0
+
+	return syncDir(w.rootDir)
+}
+
+// prune removes the rotated segments whose records are all covered by the
+// snapshot taken at seq.
+func (w *wal) prune(seq uint64) error {
+	segments, err := rotatedSegments(w.rootDir)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if segment.last > seq {
+			break
+		}
+
+		if err := os.Remove(segment.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
@@ -3,6 +3,11 @@ package errors
 import "errors"
 
 var (
-	ErrReplicaNotAlive = errors.New("replica not alive")
-	ErrorOnSync        = errors.New("failed to sync database from leader")
+	ErrReplicaNotAlive    = errors.New("replica not alive")
+	ErrorOnSync           = errors.New("failed to sync database from leader")
+	ErrCorruptSnapshot    = errors.New("snapshot file is corrupt")
+	ErrGenerationNotFound = errors.New("snapshot generation not found")
+	ErrEncryptionKey      = errors.New("encryption key error")
+	ErrPositionTruncated  = errors.New("position is no longer in the changelog")
+	ErrPositionMoved      = errors.New("position moved")
 )
@@ -0,0 +1,1401 @@
+package system_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"memdb/pkg/db"
+	"memdb/pkg/server"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// stubLeader serves /sync from a snapshot the test controls.
+type stubLeader struct {
+	lock sync.Mutex
+	snap db.Snapshot
+}
+
+func (l *stubLeader) set(snap db.Snapshot) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.snap = snap
+}
+
+func (l *stubLeader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if r.URL.Path == "/sync" {
+		w.Header().Set("X-Memdb-Seq", strconv.FormatUint(l.snap.Seq, 10))
+		w.Header().Set("X-Memdb-Term", strconv.FormatUint(l.snap.Term, 10))
+		json.NewEncoder(w).Encode(l.snap.WordCount)
+	}
+}
+
+func pushChange(replicaURL string, change db.Change) error {
+	data, err := json.Marshal(change.Updates)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, replicaURL+"/update", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Memdb-Seq", strconv.FormatUint(change.Seq, 10))
+	req.Header.Set("X-Memdb-Term", strconv.FormatUint(change.Term, 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to push change, status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// listen returns a listener on an ephemeral port of the loopback interface and
+// the base URL it is reached at.
+func listen(t *testing.T) (net.Listener, string) {
+	t.Helper()
+
+	return listenAt(t, "127.0.0.1:0")
+}
+
+// listenAt returns a listener on address, to restart a server at the URL it
+// had.
+func listenAt(t *testing.T, address string) (net.Listener, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	return listener, "http://" + listener.Addr().String()
+}
+
+// healthy tells whether the server at address is up, and synced for a
+// replica.
+func healthy(address string) bool {
+	resp, err := http.Get(address + "/health")
+	if err != nil {
+		return false
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+func TestReplicaUnavailableUntilSynced(t *testing.T) {
+	listener, replicaURL := listen(t)
+
+	leader := &stubLeader{snap: db.Snapshot{Seq: 1, Term: 7, WordCount: map[string]int{"go": 1}}}
+
+	var leaderDown atomic.Bool
+	leaderDown.Store(true)
+
+	leaderServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if leaderDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		leader.ServeHTTP(w, r)
+	}))
+	defer leaderServer.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", leaderServer.URL, logger)
+
+	go replicaServer.Serve(listener)
+	defer replicaServer.Shutdown(context.Background())
+
+	status := func(route string) int {
+		resp, err := http.Get(replicaURL + route)
+		if err != nil {
+			return 0
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	Convey("Given a fresh replica whose leader is not reachable yet", t, func() {
+		So(eventually(func() bool { return status("/health") != 0 }), ShouldBeTrue)
+
+		Convey("It is unhealthy and refuses reads, but accepts updates", func() {
+			So(status("/health"), ShouldEqual, http.StatusServiceUnavailable)
+			So(status("/wordcount?word=go"), ShouldEqual, http.StatusServiceUnavailable)
+			So(pushChange(replicaURL, db.Change{Seq: 2, Term: 7, Updates: map[string]int{"go": 1}}), ShouldBeNil)
+
+			Convey("Once synced it serves the leader state and the updates received meanwhile", func() {
+				leaderDown.Store(false)
+
+				So(eventually(func() bool { return healthy(replicaURL) }), ShouldBeTrue)
+
+				count, err := readWordCount("go", replicaURL)
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestReplicaAppliesChangesInOrder(t *testing.T) {
+	listener, replicaURL := listen(t)
+
+	leader := &stubLeader{snap: db.Snapshot{Seq: 1, Term: 7, WordCount: map[string]int{"go": 1}}}
+	leaderServer := httptest.NewServer(leader)
+	defer leaderServer.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", leaderServer.URL, logger)
+
+	go replicaServer.Serve(listener)
+	defer replicaServer.Shutdown(context.Background())
+
+	if !eventually(func() bool { return healthy(replicaURL) }) {
+		t.Fatalf("replica didn't sync from the leader")
+	}
+
+	Convey("Given a replica synced with the leader", t, func() {
+		Convey("It starts at the leader position", func() {
+			So(replica.Position(), ShouldEqual, 1)
+			So(replica.Term(), ShouldEqual, 7)
+		})
+
+		Convey("Changes arriving early are held back until the missing ones arrive", func() {
+			So(pushChange(replicaURL, db.Change{Seq: 3, Term: 7, Updates: map[string]int{"go": 10}}), ShouldBeNil)
+
+			count, err := readWordCount("go", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			So(pushChange(replicaURL, db.Change{Seq: 2, Term: 7, Updates: map[string]int{"go": 100}}), ShouldBeNil)
+			// retransmitted, already applied
+			So(pushChange(replicaURL, db.Change{Seq: 3, Term: 7, Updates: map[string]int{"go": 10}}), ShouldBeNil)
+
+			count, err = readWordCount("go", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 111)
+			So(replica.Position(), ShouldEqual, 3)
+		})
+
+		Convey("A change that never arrives makes the replica resync", func() {
+			leader.set(db.Snapshot{Seq: 10, Term: 7, WordCount: map[string]int{"go": 500}})
+
+			So(pushChange(replicaURL, db.Change{Seq: 11, Term: 7, Updates: map[string]int{"go": 1}}), ShouldBeNil)
+			So(pushChange(replicaURL, db.Change{Seq: 6, Term: 7, Updates: map[string]int{"go": 1000}}), ShouldBeNil)
+
+			So(eventually(func() bool { return replica.Position() == 11 }), ShouldBeTrue)
+
+			// the snapshot at seq 10 includes seq 6, seq 11 is applied on top of it
+			count, err := readWordCount("go", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 501)
+		})
+
+		Convey("A change from a new term makes the replica resync", func() {
+			leader.set(db.Snapshot{Seq: 12, Term: 8, WordCount: map[string]int{"go": 7}})
+
+			So(pushChange(replicaURL, db.Change{Seq: 13, Term: 8, Updates: map[string]int{"go": 1}}), ShouldBeNil)
+
+			So(eventually(func() bool { return replica.Term() == 8 && replica.Position() == 13 }), ShouldBeTrue)
+
+			count, err := readWordCount("go", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 8)
+		})
+	})
+}
+
+// stubReplica fails the first updates it receives, then records the seqs of
+// the changes it accepts.
+type stubReplica struct {
+	lock     sync.Mutex
+	failures int
+	seqs     []uint64
+	resyncs  int
+	// updates accepted, each one may merge several changes
+	updates int
+}
+
+func (r *stubReplica) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch req.URL.Path {
+	case "/resync":
+		r.resyncs++
+		w.WriteHeader(http.StatusAccepted)
+	case "/update":
+		if r.failures > 0 {
+			r.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		seq, _ := strconv.ParseUint(req.Header.Get("X-Memdb-Seq"), 10, 64)
+
+		first := seq
+		if header := req.Header.Get("X-Memdb-First-Seq"); header != "" {
+			first, _ = strconv.ParseUint(header, 10, 64)
+		}
+
+		for ; first <= seq; first++ {
+			r.seqs = append(r.seqs, first)
+		}
+
+		r.updates++
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (r *stubReplica) received() ([]uint64, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]uint64{}, r.seqs...), r.resyncs
+}
+
+func TestLeaderRetriesReplication(t *testing.T) {
+	listener, address := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	flaky := &stubReplica{failures: 3}
+	flakyServer := httptest.NewServer(flaky)
+	defer flakyServer.Close()
+
+	overflowing := &stubReplica{failures: 1000}
+	overflowingServer := httptest.NewServer(overflowing)
+	defer overflowingServer.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.SetQueueLimit(3)
+	leader.AddReplica(flakyServer.URL)
+	leader.AddReplica(overflowingServer.URL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	for _, phrase := range []string{"hello", "hello world", "world"} {
+		if err := postPhrase(address, phrase); err != nil {
+			t.Fatalf("failed to send phrase: %v", err)
+		}
+	}
+
+	Convey("Given replicas failing to acknowledge updates", t, func() {
+		Convey("Every update is retried until it is acknowledged, in order", func() {
+			So(eventually(func() bool {
+				seqs, _ := flaky.received()
+				return len(seqs) == 3
+			}), ShouldBeTrue)
+
+			seqs, resyncs := flaky.received()
+			So(seqs, ShouldResemble, []uint64{1, 2, 3})
+			So(resyncs, ShouldEqual, 0)
+		})
+
+		Convey("A replica whose queue overflows is asked to resync", func() {
+			// overflows the queue, the resync covers it. The replica only
+			// recovers afterwards so that no retry of the dropped changes
+			// gets through before.
+			So(postPhrase(address, "again"), ShouldBeNil)
+
+			overflowing.lock.Lock()
+			overflowing.failures = 0
+			overflowing.lock.Unlock()
+
+			// sent once the pending retry delay is over
+			So(eventually(func() bool {
+				_, resyncs := overflowing.received()
+				return resyncs > 0
+			}), ShouldBeTrue)
+
+			seqs, resyncs := overflowing.received()
+			So(resyncs, ShouldEqual, 1)
+			So(seqs, ShouldBeEmpty)
+
+			So(postPhrase(address, "once more"), ShouldBeNil)
+
+			So(eventually(func() bool {
+				seqs, _ := overflowing.received()
+				return len(seqs) > 0
+			}), ShouldBeTrue)
+
+			seqs, _ = overflowing.received()
+			So(seqs, ShouldResemble, []uint64{5})
+		})
+	})
+}
+
+func postPhrase(address string, phrase string) error {
+	resp, err := http.PostForm(address+"/post", url.Values{"text": {phrase}})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to send phrase, status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// eventually polls condition for a few seconds.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestLeaderSyncSince(t *testing.T) {
+	listener, address := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger, db.WithChangelogSize(2))
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	for _, phrase := range []string{"hello", "hello world", "world"} {
+		if err := postPhrase(address, phrase); err != nil {
+			t.Fatalf("failed to send phrase: %v", err)
+		}
+	}
+
+	term := strconv.FormatUint(leaderDB.Snapshot().Term, 10)
+
+	Convey("Given a leader keeping its 2 most recent changes", t, func() {
+		Convey("A replica within the window only gets the changes it misses", func() {
+			resp, err := http.Get(address + "/sync?since=1&term=" + term)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/x-memdb-changes+json")
+			So(resp.Header.Get("X-Memdb-Seq"), ShouldEqual, "3")
+
+			var changes []db.Change
+			So(json.NewDecoder(resp.Body).Decode(&changes), ShouldBeNil)
+			So(changes, ShouldHaveLength, 2)
+			So(changes[0].Seq, ShouldEqual, 2)
+			So(changes[0].Updates, ShouldResemble, map[string]int{"hello": 1, "world": 1})
+			So(changes[1].Seq, ShouldEqual, 3)
+		})
+
+		Convey("A replica up to date gets a 304", func() {
+			resp, err := http.Get(address + "/sync?since=3&term=" + term)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, http.StatusNotModified)
+		})
+
+		Convey("A replica past the window or from another term gets a full snapshot", func() {
+			for _, query := range []string{"since=0&term=" + term, "since=2&term=1"} {
+				resp, err := http.Get(address + "/sync?" + query)
+				So(err, ShouldBeNil)
+				defer resp.Body.Close()
+
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(resp.Header.Get("X-Memdb-Seq"), ShouldEqual, "3")
+
+				var wordCount map[string]int
+				So(json.NewDecoder(resp.Body).Decode(&wordCount), ShouldBeNil)
+				So(wordCount, ShouldResemble, map[string]int{"hello": 2, "world": 2})
+			}
+		})
+
+		Convey("An invalid position is refused", func() {
+			resp, err := http.Get(address + "/sync?since=abc")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestReplicaBootstrapUnderConcurrentWrites(t *testing.T) {
+	listener, address := listen(t)
+	replicaListener, replicaURL := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.AddReplica(replicaURL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	writers, writes := 4, 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes)
+
+	for range writers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range writes {
+				if err := postPhrase(address, "bootstrap"); err != nil {
+					errs <- err
+				}
+
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+	}
+
+	// the replica joins while the writes are going on, some of them are
+	// pushed while it downloads its snapshot
+	if !eventually(func() bool { return leaderDB.GetWordCount("bootstrap") >= writers }) {
+		t.Fatalf("no write reached the leader")
+	}
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", address, logger)
+
+	go replicaServer.Serve(replicaListener)
+	defer replicaServer.Shutdown(context.Background())
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("failed to send phrase: %v", err)
+	}
+
+	Convey("Given a replica bootstrapped while the leader is written to", t, func() {
+		Convey("Every write is applied exactly once", func() {
+			So(leaderDB.GetWordCount("bootstrap"), ShouldEqual, writers*writes)
+
+			So(eventually(func() bool {
+				return replica.Position() == leaderDB.Snapshot().Seq
+			}), ShouldBeTrue)
+
+			count, err := readWordCount("bootstrap", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, writers*writes)
+		})
+	})
+}
+
+func TestLeaderAckLevels(t *testing.T) {
+	listener, address := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	up := httptest.NewServer(&stubReplica{})
+	defer up.Close()
+
+	down := httptest.NewServer(&stubReplica{failures: 1000})
+	defer down.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.SetAckTimeout(300 * time.Millisecond)
+	leader.AddReplica(up.URL)
+	leader.AddReplica(down.URL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	Convey("Given a leader with a replica up and a replica down", t, func() {
+		Convey("Writes wait for as many replicas as the ack level requires", func() {
+			for level, acks := range map[string]string{"leader": "0", "one": "1", "quorum": "1"} {
+				status, header, err := postPhraseWithAck(address, "hello", url.Values{"ack": {level}})
+				So(err, ShouldBeNil)
+				So(status, ShouldEqual, http.StatusAccepted)
+				So(header.Get("X-Memdb-Acks"), ShouldEqual, acks)
+			}
+		})
+
+		Convey("A level that can't be met in time is reported", func() {
+			status, header, err := postPhraseWithAck(address, "hello", url.Values{"ack": {"all"}, "ack_timeout": {"200ms"}})
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusGatewayTimeout)
+			So(header.Get("X-Memdb-Acks"), ShouldEqual, "1")
+		})
+
+		Convey("Writes with no ack are persisted before the reply", func() {
+			count := leaderDB.GetWordCount("unacknowledged")
+
+			status, header, err := postPhraseWithAck(address, "unacknowledged", url.Values{"ack": {"none"}})
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusAccepted)
+			So(header.Get("X-Memdb-Acks"), ShouldEqual, "0")
+			So(header.Get("X-Memdb-Seq"), ShouldNotBeEmpty)
+
+			So(leaderDB.GetWordCount("unacknowledged"), ShouldEqual, count+1)
+		})
+
+		Convey("An unknown ack level is refused", func() {
+			status, _, err := postPhraseWithAck(address, "hello", url.Values{"ack": {"most"}})
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func postPhraseWithAck(address string, phrase string, values url.Values) (int, http.Header, error) {
+	values.Set("text", phrase)
+
+	resp, err := http.PostForm(address+"/post", values)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return resp.StatusCode, resp.Header, nil
+}
+
+func TestReplicaIgnoresDuplicateUpdates(t *testing.T) {
+	listener, address := listen(t)
+	replicaListener, replicaURL := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	target, err := url.Parse(replicaURL)
+	if err != nil {
+		t.Fatalf("failed to parse replica URL: %v", err)
+	}
+
+	// forwards updates to the replica but loses the first acks, so that the
+	// leader sends them again
+	var (
+		lock     sync.Mutex
+		lostAcks = 3
+	)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if resp.Request.URL.Path == "/update" && lostAcks > 0 {
+			lostAcks--
+			resp.StatusCode = http.StatusServiceUnavailable
+		}
+
+		return nil
+	}
+
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.AddReplica(proxyServer.URL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", address, logger)
+
+	go replicaServer.Serve(replicaListener)
+	defer replicaServer.Shutdown(context.Background())
+
+	if !eventually(func() bool { return healthy(replicaURL) }) {
+		t.Fatalf("replica didn't sync from the leader")
+	}
+
+	for range 3 {
+		if err := postPhrase(address, "retried"); err != nil {
+			t.Fatalf("failed to send phrase: %v", err)
+		}
+	}
+
+	Convey("Given a replica whose acks get lost", t, func() {
+		Convey("Updates sent again are only applied once", func() {
+			So(eventually(func() bool {
+				lock.Lock()
+				defer lock.Unlock()
+
+				return lostAcks == 0 && replica.Position() == 3
+			}), ShouldBeTrue)
+
+			// every retry is acknowledged
+			So(eventually(func() bool {
+				statuses, err := readReplicaStatuses(address)
+				return err == nil && len(statuses) == 1 && statuses[0].AckedSeq == 3 && statuses[0].QueueDepth == 0
+			}), ShouldBeTrue)
+
+			count, err := readWordCount("retried", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestLeaderBatchesReplication(t *testing.T) {
+	listener, address := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	replica := &stubReplica{}
+	replicaServer := httptest.NewServer(replica)
+	defer replicaServer.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.SetBatching(200*time.Millisecond, 100)
+	leader.AddReplica(replicaServer.URL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	var wg sync.WaitGroup
+
+	for range 20 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := postPhrase(address, "batched"); err != nil {
+				t.Errorf("failed to send phrase: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	Convey("Given concurrent writes on the leader", t, func() {
+		Convey("They are merged into fewer updates to the replica", func() {
+			So(eventually(func() bool {
+				seqs, _ := replica.received()
+				return len(seqs) == 20
+			}), ShouldBeTrue)
+
+			seqs, _ := replica.received()
+			for i, seq := range seqs {
+				So(seq, ShouldEqual, i+1)
+			}
+
+			replica.lock.Lock()
+			updates := replica.updates
+			replica.lock.Unlock()
+
+			So(updates, ShouldBeLessThan, 20)
+		})
+
+		Convey("The batches are counted in the metrics", func() {
+			resp, err := http.Get(address + "/debug/vars")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			var vars struct {
+				Replication map[string]int `json:"replication"`
+			}
+
+			So(json.NewDecoder(resp.Body).Decode(&vars), ShouldBeNil)
+			So(vars.Replication["batches"], ShouldBeGreaterThan, 0)
+			So(vars.Replication["changes"], ShouldBeGreaterThanOrEqualTo, 20)
+		})
+	})
+}
+
+// replicaStatus is an entry of the leader /replicas route.
+type replicaStatus struct {
+	Replica    string `json:"replica"`
+	State      string `json:"state"`
+	Alive      bool   `json:"alive"`
+	AckedSeq   uint64 `json:"acked_seq"`
+	Lag        uint64 `json:"lag"`
+	QueueDepth int    `json:"queue_depth"`
+	LastError  string `json:"last_error"`
+	Errors     int    `json:"errors"`
+}
+
+func readReplicaStatuses(address string) ([]replicaStatus, error) {
+	resp, err := http.Get(address + "/replicas")
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var statuses []replicaStatus
+	err = json.NewDecoder(resp.Body).Decode(&statuses)
+
+	return statuses, err
+}
+
+func TestReplicationStatus(t *testing.T) {
+	listener, address := listen(t)
+	replicaListener, replicaURL := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	down := httptest.NewServer(&stubReplica{failures: 1000})
+	defer down.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.AddReplica(replicaURL)
+	leader.AddReplica(down.URL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", address, logger)
+
+	go replicaServer.Serve(replicaListener)
+	defer replicaServer.Shutdown(context.Background())
+
+	if !eventually(func() bool { return healthy(replicaURL) }) {
+		t.Fatalf("replica didn't sync from the leader")
+	}
+
+	for _, phrase := range []string{"hello", "world"} {
+		if err := postPhrase(address, phrase); err != nil {
+			t.Fatalf("failed to send phrase: %v", err)
+		}
+	}
+
+	Convey("Given a replica up and a replica down", t, func() {
+		Convey("The leader reports how far each one got", func() {
+			So(eventually(func() bool {
+				statuses, err := readReplicaStatuses(address)
+				return err == nil && statuses[0].AckedSeq == 2 && statuses[1].Errors > 0
+			}), ShouldBeTrue)
+
+			statuses, err := readReplicaStatuses(address)
+			So(err, ShouldBeNil)
+			So(statuses, ShouldHaveLength, 2)
+
+			So(statuses[0].Replica, ShouldEqual, replicaURL)
+			So(statuses[0].Alive, ShouldBeTrue)
+			So(statuses[0].Lag, ShouldEqual, 0)
+			So(statuses[0].QueueDepth, ShouldEqual, 0)
+
+			So(statuses[1].Replica, ShouldEqual, down.URL)
+			So(statuses[1].Alive, ShouldBeFalse)
+			So(statuses[1].Lag, ShouldEqual, 2)
+			So(statuses[1].QueueDepth, ShouldEqual, 2)
+			So(statuses[1].LastError, ShouldNotBeEmpty)
+		})
+
+		Convey("The replica reports its own position", func() {
+			resp, err := http.Get(replicaURL + "/status")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			var status struct {
+				Seq              uint64   `json:"seq"`
+				Term             uint64   `json:"term"`
+				StalenessSeconds *float64 `json:"staleness_seconds"`
+			}
+
+			So(json.NewDecoder(resp.Body).Decode(&status), ShouldBeNil)
+			So(status.Seq, ShouldEqual, 2)
+			So(status.Term, ShouldEqual, leaderDB.Term())
+			So(status.StalenessSeconds, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestReplicaJoinsAndLeaves(t *testing.T) {
+	listener, address := listen(t)
+	replicaListener, _ := listen(t)
+
+	// joins by name, to check that its case doesn't matter
+	replicaPort := strconv.Itoa(replicaListener.Addr().(*net.TCPAddr).Port)
+	replicaURL := "http://localhost:" + replicaPort
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	rootDir := t.TempDir()
+	membersFile := path.Join(rootDir, db.MembersFile)
+
+	leaderDB, err := db.NewLeader(rootDir, logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	// started without any replica
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	if err := leader.SetMembersFile(membersFile); err != nil {
+		t.Fatalf("failed to load replicas: %v", err)
+	}
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	if err := postPhrase(address, "before"); err != nil {
+		t.Fatalf("failed to send phrase: %v", err)
+	}
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", address, logger)
+	replicaServer.SetAdvertiseURL(replicaURL)
+
+	go replicaServer.Serve(replicaListener)
+	defer replicaServer.Shutdown(context.Background())
+
+	if !eventually(func() bool { return healthy(replicaURL) }) {
+		t.Fatalf("replica didn't sync from the leader")
+	}
+
+	postMembership := func(route string, replica string) (int, error) {
+		resp, err := http.PostForm(address+route, url.Values{"url": {replica}})
+		if err != nil {
+			return 0, err
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode, nil
+	}
+
+	Convey("Given a replica joining a running leader", t, func() {
+		Convey("It is replicated to and saved as a member", func() {
+			So(postPhrase(address, "after"), ShouldBeNil)
+
+			So(eventually(func() bool {
+				count, err := readWordCount("after", replicaURL)
+				return err == nil && count == 1
+			}), ShouldBeTrue)
+
+			count, err := readWordCount("before", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			members, err := db.LoadMembers(membersFile)
+			So(err, ShouldBeNil)
+			So(members, ShouldResemble, []string{replicaURL})
+
+			// joining again is harmless
+			status, err := postMembership("/replicas/join", replicaURL)
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusOK)
+
+			// whatever the case of the scheme and host
+			status, err = postMembership("/replicas/join", fmt.Sprintf("HTTP://LocalHost:%s/", replicaPort))
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusOK)
+
+			members, err = db.LoadMembers(membersFile)
+			So(err, ShouldBeNil)
+			So(members, ShouldResemble, []string{replicaURL})
+		})
+
+		Convey("Replicas whose URLs only differ by punctuation get their own queue", func() {
+			queueDir := t.TempDir()
+
+			queued := server.NewLeaderServer(leaderDB, "0", logger)
+			queued.SetQueueDir(queueDir)
+
+			// unreachable, so that the changes stay queued
+			So(queued.AddReplica("http://127.0.0.1:1"), ShouldBeTrue)
+			So(queued.AddReplica("http://127.0.0.1_1"), ShouldBeTrue)
+
+			queues, err := filepath.Glob(path.Join(queueDir, "*.queue"))
+			So(err, ShouldBeNil)
+			So(queues, ShouldHaveLength, 2)
+
+			So(queued.RemoveReplica("http://127.0.0.1:1"), ShouldBeTrue)
+			So(queued.RemoveReplica("http://127.0.0.1_1"), ShouldBeTrue)
+		})
+
+		Convey("Invalid or unknown replicas are refused", func() {
+			status, err := postMembership("/replicas/join", "localhost:9999")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			status, err = postMembership("/replicas/leave", "http://localhost:9999")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Once it left, it is not replicated to anymore", func() {
+			status, err := postMembership("/replicas/leave", replicaURL)
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusOK)
+
+			statuses, err := readReplicaStatuses(address)
+			So(err, ShouldBeNil)
+			So(statuses, ShouldBeEmpty)
+
+			// written once the leader forgot the replica, nothing delivers it
+			So(postPhrase(address, "gone"), ShouldBeNil)
+			So(leaderDB.GetWordCount("gone"), ShouldEqual, 1)
+
+			count, err := readWordCount("gone", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+
+			members, err := db.LoadMembers(membersFile)
+			So(err, ShouldBeNil)
+			So(members, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestLeaderEjectsAndReadmitsReplica(t *testing.T) {
+	listener, address := listen(t)
+	replicaListener, replicaURL := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.SetHeartbeat(100*time.Millisecond, 2)
+	leader.AddReplica(replicaURL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", address, logger)
+
+	go replicaServer.Serve(replicaListener)
+
+	if !eventually(func() bool { return healthy(replicaURL) }) {
+		t.Fatalf("replica didn't sync from the leader")
+	}
+
+	readState := func() (string, error) {
+		statuses, err := readReplicaStatuses(address)
+		if err != nil || len(statuses) == 0 {
+			return "", err
+		}
+
+		return statuses[0].State, nil
+	}
+
+	Convey("Given a replica that stops answering", t, func() {
+		So(postPhrase(address, "before"), ShouldBeNil)
+
+		So(eventually(func() bool {
+			count, err := readWordCount("before", replicaURL)
+			return err == nil && count == 1
+		}), ShouldBeTrue)
+
+		So(replicaServer.Shutdown(context.Background()), ShouldBeNil)
+
+		Convey("The leader ejects it and keeps accepting writes", func() {
+			So(eventually(func() bool {
+				state, err := readState()
+				return err == nil && state == "ejected"
+			}), ShouldBeTrue)
+
+			// it doesn't count towards the ack levels anymore
+			status, header, err := postPhraseWithAck(address, "while down", url.Values{"ack": {"all"}})
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusAccepted)
+			So(header.Get("X-Memdb-Acks"), ShouldEqual, "0")
+
+			Convey("Once it is back, it is re-admitted and catches up", func() {
+				replicaListener, _ := listenAt(t, replicaListener.Addr().String())
+
+				replicaServer = server.NewReplicaServer(replica, "0", address, logger)
+
+				go replicaServer.Serve(replicaListener)
+				defer replicaServer.Shutdown(context.Background())
+
+				So(eventually(func() bool {
+					state, err := readState()
+					return err == nil && state == "active"
+				}), ShouldBeTrue)
+
+				So(eventually(func() bool {
+					count, err := readWordCount("down", replicaURL)
+					return err == nil && count == 1
+				}), ShouldBeTrue)
+
+				So(postPhrase(address, "after"), ShouldBeNil)
+
+				So(eventually(func() bool {
+					count, err := readWordCount("after", replicaURL)
+					return err == nil && count == 1
+				}), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestReplicaPullsChanges(t *testing.T) {
+	listener, address := listen(t)
+	replicaListener, replicaURL := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger, db.WithChangelogSize(2))
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	// the leader doesn't know the replica
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	if err := postPhrase(address, "before"); err != nil {
+		t.Fatalf("failed to send phrase: %v", err)
+	}
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", address, logger)
+	replicaServer.SetReplicationMode(server.ReplicationPull)
+
+	go replicaServer.Serve(replicaListener)
+
+	if !eventually(func() bool { return healthy(replicaURL) }) {
+		t.Fatalf("replica didn't sync from the leader")
+	}
+
+	Convey("Given a replica pulling the changes from the leader", t, func() {
+		Convey("It receives the writes as they are made, in order", func() {
+			for i := 0; i < 10; i++ {
+				So(postPhrase(address, "streamed"), ShouldBeNil)
+			}
+
+			So(eventually(func() bool {
+				count, err := readWordCount("streamed", replicaURL)
+				return err == nil && count == 10
+			}), ShouldBeTrue)
+
+			count, err := readWordCount("before", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			So(replica.Position(), ShouldEqual, leaderDB.Position())
+
+			Convey("When it reconnects past the changelog, it resyncs and streams again", func() {
+				So(replicaServer.Shutdown(context.Background()), ShouldBeNil)
+
+				for i := 0; i < 5; i++ {
+					So(postPhrase(address, "missed"), ShouldBeNil)
+				}
+
+				replicaListener, _ := listenAt(t, replicaListener.Addr().String())
+
+				replicaServer = server.NewReplicaServer(replica, "0", address, logger)
+				replicaServer.SetReplicationMode(server.ReplicationPull)
+
+				go replicaServer.Serve(replicaListener)
+				defer replicaServer.Shutdown(context.Background())
+
+				So(eventually(func() bool {
+					count, err := readWordCount("missed", replicaURL)
+					return err == nil && count == 5
+				}), ShouldBeTrue)
+
+				So(postPhrase(address, "after"), ShouldBeNil)
+
+				So(eventually(func() bool {
+					count, err := readWordCount("after", replicaURL)
+					return err == nil && count == 1
+				}), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestReplicaRepairsDrift(t *testing.T) {
+	listener, address := listen(t)
+	replicaListener, replicaURL := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.AddReplica(replicaURL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	replica := db.NewReplica(logger)
+	replicaServer := server.NewReplicaServer(replica, "0", address, logger)
+	replicaServer.SetAntiEntropyInterval(100 * time.Millisecond)
+
+	go replicaServer.Serve(replicaListener)
+	defer replicaServer.Shutdown(context.Background())
+
+	if !eventually(func() bool { return healthy(replicaURL) }) {
+		t.Fatalf("replica didn't sync from the leader")
+	}
+
+	Convey("Given a replica whose word counts drifted from the leader", t, func() {
+		So(postPhrase(address, "hello world"), ShouldBeNil)
+
+		So(eventually(func() bool {
+			count, err := readWordCount("hello", replicaURL)
+			return err == nil && count == 1
+		}), ShouldBeTrue)
+
+		replica.AddWordCount("hello", 5)
+		replica.AddWordCount("stray", 1)
+
+		Convey("The anti-entropy repairs the divergent words", func() {
+			So(eventually(func() bool {
+				hello, err := readWordCount("hello", replicaURL)
+				if err != nil {
+					return false
+				}
+
+				stray, err := readWordCount("stray", replicaURL)
+
+				return err == nil && hello == 1 && stray == 0
+			}), ShouldBeTrue)
+
+			count, err := readWordCount("world", replicaURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("The anti-entropy repairs them while writes keep coming", func() {
+			stop := make(chan struct{})
+			loaded := make(chan int)
+
+			go func() {
+				posted := 0
+
+				defer func() { loaded <- posted }()
+
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					if postPhrase(address, "load") == nil {
+						posted++
+					}
+				}
+			}()
+
+			repaired := eventually(func() bool {
+				hello, err := readWordCount("hello", replicaURL)
+				if err != nil {
+					return false
+				}
+
+				stray, err := readWordCount("stray", replicaURL)
+
+				return err == nil && hello == leaderDB.GetWordCount("hello") && stray == 0
+			})
+
+			close(stop)
+			posted := <-loaded
+
+			So(repaired, ShouldBeTrue)
+			So(posted, ShouldBeGreaterThan, 0)
+
+			// the writes made meanwhile are not mistaken for a drift
+			So(eventually(func() bool {
+				count, err := readWordCount("load", replicaURL)
+				return err == nil && count == posted
+			}), ShouldBeTrue)
+		})
+	})
+}
+
+func TestReplicaServesDownstreamReplicas(t *testing.T) {
+	listener, address := listen(t)
+	middleListener, middleURL := listen(t)
+	downstreamListener, downstreamURL := listen(t)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
+	if err != nil {
+		t.Fatalf("failed to create leader: %v", err)
+	}
+	defer leaderDB.Close()
+
+	// the leader only knows the intermediate replica
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	leader.AddReplica(middleURL)
+
+	go leader.Serve(listener)
+	defer leader.Shutdown(context.Background())
+
+	if err := postPhrase(address, "before"); err != nil {
+		t.Fatalf("failed to send phrase: %v", err)
+	}
+
+	middle := db.NewReplica(logger)
+	middleServer := server.NewReplicaServer(middle, "0", address, logger)
+	middleServer.SetServeDownstream(true)
+
+	go middleServer.Serve(middleListener)
+	defer middleServer.Shutdown(context.Background())
+
+	if !eventually(func() bool { return healthy(middleURL) }) {
+		t.Fatalf("intermediate replica didn't sync from the leader")
+	}
+
+	downstream := db.NewReplica(logger)
+	downstreamServer := server.NewReplicaServer(downstream, "0", middleURL, logger)
+	downstreamServer.SetReplicationMode(server.ReplicationPull)
+
+	go downstreamServer.Serve(downstreamListener)
+	defer downstreamServer.Shutdown(context.Background())
+
+	if !eventually(func() bool { return healthy(downstreamURL) }) {
+		t.Fatalf("downstream replica didn't sync from the intermediate replica")
+	}
+
+	Convey("Given a replica syncing from an intermediate replica", t, func() {
+		Convey("It receives the leader writes through it, in order", func() {
+			for i := 0; i < 10; i++ {
+				So(postPhrase(address, "cascaded"), ShouldBeNil)
+			}
+
+			So(eventually(func() bool {
+				count, err := readWordCount("cascaded", downstreamURL)
+				return err == nil && count == 10
+			}), ShouldBeTrue)
+
+			count, err := readWordCount("before", downstreamURL)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			So(downstream.Position(), ShouldEqual, leaderDB.Position())
+			So(downstream.Term(), ShouldEqual, leaderDB.Term())
+		})
+
+		Convey("Replicas asking the intermediate replica to push the changes are refused", func() {
+			resp, err := http.PostForm(middleURL+"/replicas/join", url.Values{"url": {"http://localhost:9999"}})
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("A replica left in push mode switches to pulling the changes", func() {
+			pushedListener, pushedURL := listen(t)
+
+			pushed := db.NewReplica(logger)
+			pushedServer := server.NewReplicaServer(pushed, "0", middleURL, logger)
+			pushedServer.SetAdvertiseURL(pushedURL)
+
+			go pushedServer.Serve(pushedListener)
+			defer pushedServer.Shutdown(context.Background())
+
+			So(eventually(func() bool {
+				return pushed.Position() == leaderDB.Position()
+			}), ShouldBeTrue)
+
+			So(postPhrase(address, "switched"), ShouldBeNil)
+
+			So(eventually(func() bool {
+				count, err := readWordCount("switched", pushedURL)
+				return err == nil && count == 1
+			}), ShouldBeTrue)
+
+			var status struct {
+				Mode server.ReplicationMode `json:"mode"`
+			}
+
+			resp, err := http.Get(pushedURL + "/status")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			So(json.NewDecoder(resp.Body).Decode(&status), ShouldBeNil)
+			So(status.Mode, ShouldEqual, server.ReplicationPull)
+		})
+	})
+}
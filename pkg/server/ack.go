@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"memdb/pkg/db"
+	"sync"
+	"time"
+)
+
+// AckLevel is how far a write has to go before POST /post replies.
+type AckLevel string
+
+const (
+	// doesn't wait for the replicas either: a write is always in the
+	// write-ahead log before the reply, so that an accepted write is never
+	// lost and writers can't pile up behind the log
+	AckNone AckLevel = "none"
+	// replies once the write is in the leader's write-ahead log
+	AckLeader AckLevel = "leader"
+	// also waits for a replica to acknowledge it
+	AckOne AckLevel = "one"
+	// also waits for a majority of the nodes, the leader included, to
+	// acknowledge it
+	AckQuorum AckLevel = "quorum"
+	// also waits for every replica to acknowledge it
+	AckAll AckLevel = "all"
+
+	// ack level used when neither the request nor the server set one
+	DefaultAckLevel = AckLeader
+	// longest wait for the replicas acknowledgements
+	DefaultAckTimeout = 5 * time.Second
+)
+
+// ParseAckLevel validates an ack level name, an empty name means the default.
+func ParseAckLevel(name string) (AckLevel, error) {
+	switch AckLevel(name) {
+	case "":
+		return DefaultAckLevel, nil
+	case AckNone, AckLeader, AckOne, AckQuorum, AckAll:
+		return AckLevel(name), nil
+	default:
+		return "", fmt.Errorf("unknown ack level %q, expected one of none, leader, one, quorum, all", name)
+	}
+}
+
+// required returns the number of replicas, out of replicas, that must
+// acknowledge a write.
+func (level AckLevel) required(replicas int) int {
+	switch level {
+	case AckOne:
+		return 1
+	case AckQuorum:
+		// a majority of the replicas+1 nodes, less the leader
+		return (replicas + 1) / 2
+	case AckAll:
+		return replicas
+	default:
+		return 0
+	}
+}
+
+// acks counts the replicas that acknowledged the changes writers are waiting
+// on.
+type acks struct {
+	lock    sync.Mutex
+	waiters map[uint64]*ackWaiter
+}
+
+type ackWaiter struct {
+	term     uint64
+	required int
+	acks     int
+	// closed once required acks were counted
+	done chan struct{}
+}
+
+func newAcks() *acks {
+	return &acks{waiters: make(map[uint64]*ackWaiter)}
+}
+
+// wait starts counting the acks of change, it must be called before change is
+// queued for the replicas. The returned channel is closed once required
+// replicas acknowledged it, release stops counting.
+func (a *acks) wait(change db.Change, required int) <-chan struct{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	waiter := &ackWaiter{term: change.Term, required: required, done: make(chan struct{})}
+	a.waiters[change.Seq] = waiter
+
+	return waiter.done
+}
+
+// ack counts a replica that acknowledged change, along with the changes merged
+// into it.
+func (a *acks) ack(change db.Change) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for seq, waiter := range a.waiters {
+		if seq < change.First() || seq > change.Seq || waiter.term != change.Term {
+			continue
+		}
+
+		waiter.acks++
+
+		if waiter.acks == waiter.required {
+			close(waiter.done)
+		}
+	}
+}
+
+// release stops counting the acks of change and returns how many there were.
+func (a *acks) release(change db.Change) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	waiter, ok := a.waiters[change.Seq]
+	if !ok || waiter.term != change.Term {
+		return 0
+	}
+
+	delete(a.waiters, change.Seq)
+
+	return waiter.acks
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how often a replica compares its word counts with the leader ones
+	DefaultAntiEntropyInterval = 1 * time.Minute
+)
+
+// errConflict is returned by getJSON on a 409, when the upstream changelog
+// doesn't reach back to the position of a digest.
+var errConflict = errors.New("position is no longer in the upstream changelog")
+
+// antiEntropyMetrics are published on /debug/vars: the comparisons made and
+// skipped because the changelogs didn't reach back to the replica position, the
+// divergent buckets found and the words repaired.
+var antiEntropyMetrics = expvar.NewMap("anti_entropy")
+
+// digestBuckets are the word counts of some buckets of a digest, at an
+// upstream position.
+type digestBuckets struct {
+	Seq   uint64         `json:"seq"`
+	Term  uint64         `json:"term"`
+	Words map[string]int `json:"words"`
+}
+
+// GET handler replying with the digest of the word counts, the buckets
+// parameter sets their number. With ?seq=<seq>&term=<term> the digest is as
+// of that position, rolled back through the changelog, and a 409 tells that
+// the changelog doesn't reach back to it.
+func (up *upstream) digestHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buckets, err := parseDigestBuckets(r.URL.Query().Get("buckets"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		term, seq, positioned, err := parseDigestPosition(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		up.logger.Info("GET /digest (replica anti-entropy)", "buckets", buckets, "seq", seq)
+
+		var digest db.Digest
+		if positioned {
+			digest, err = up.db.DigestAt(term, seq, buckets)
+		} else {
+			digest, err = up.db.Digest(buckets)
+		}
+
+		if errors.Is(err, dbErrs.ErrPositionTruncated) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			up.logger.Error("failed to compute digest", "error", err)
+
+			http.Error(w, "failed to compute digest", http.StatusInternalServerError)
+
+			return
+		}
+
+		up.writeJSON(w, r, digest)
+	})
+}
+
+// GET handler replying with the word counts in the buckets listed by the ids
+// parameter, comma separated, of a digest of buckets buckets. They are as of
+// the seq and term parameters like /digest, the current position by default.
+func (up *upstream) digestBucketsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buckets, err := parseDigestBuckets(r.URL.Query().Get("buckets"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ids, err := parseBucketIDs(r.URL.Query().Get("ids"), buckets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		term, seq, positioned, err := parseDigestPosition(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !positioned {
+			term, seq = up.db.Term(), up.db.Position()
+		}
+
+		up.logger.Info("GET /digest/buckets (replica anti-entropy repair)", "buckets", len(ids), "seq", seq)
+
+		snap, err := up.db.DigestBuckets(term, seq, buckets, ids)
+		if errors.Is(err, dbErrs.ErrPositionTruncated) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			up.logger.Error("failed to read digest buckets", "error", err)
+
+			http.Error(w, "failed to read digest buckets", http.StatusInternalServerError)
+
+			return
+		}
+
+		up.writeJSON(w, r, digestBuckets{Seq: snap.Seq, Term: snap.Term, Words: snap.WordCount})
+	})
+}
+
+// writeJSON replies with value as JSON, gzip compressed when the client
+// accepts it.
+func (up *upstream) writeJSON(w http.ResponseWriter, r *http.Request, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	if err = writeBody(w, r, "application/json", data); err != nil {
+		up.logger.Error("failed to send response", "error", err)
+	}
+}
+
+// antiEntropy compares the replica word counts with the leader ones every
+// antiEntropyInterval, until the replica is shut down.
+func (sv *ReplicaServer) antiEntropy() {
+	ticker := time.NewTicker(sv.antiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-sv.ctx.Done():
+			return
+		}
+
+		if err := sv.compareWithLeader(); err != nil {
+			antiEntropyMetrics.Add("errors", 1)
+
+			sv.logger.Error("failed to compare word counts with leader", "leader", sv.leader, "error", err)
+		}
+	}
+}
+
+// compareWithLeader compares the digests of the replica and the leader word
+// counts and repairs the words of the buckets that differ. Digests only
+// compare at the same position, so the leader ones are asked for as of the
+// replica position, which both roll back to through their changelog while
+// changes keep arriving. The comparison is skipped when the leader changelog
+// doesn't reach back to it.
+func (sv *ReplicaServer) compareWithLeader() error {
+	if sv.isResyncing() {
+		antiEntropyMetrics.Add("skipped", 1)
+		return nil
+	}
+
+	buckets := db.DefaultDigestBuckets
+
+	local, err := sv.db.Digest(buckets)
+	if err != nil {
+		return err
+	}
+
+	position := url.Values{}
+	position.Set("buckets", strconv.Itoa(buckets))
+	position.Set("seq", strconv.FormatUint(local.Seq, 10))
+	position.Set("term", strconv.FormatUint(local.Term, 10))
+
+	var leader db.Digest
+	if err := sv.getJSON(sv.leader+"/digest?"+position.Encode(), &leader); err != nil {
+		if errors.Is(err, errConflict) {
+			antiEntropyMetrics.Add("skipped", 1)
+
+			sv.logger.Debug("skipping anti-entropy, the leader changelog doesn't reach back to the replica position", "seq", local.Seq)
+
+			return nil
+		}
+
+		return err
+	}
+
+	antiEntropyMetrics.Add("comparisons", 1)
+
+	diff := local.Diff(leader)
+	if len(diff) == 0 {
+		return nil
+	}
+
+	antiEntropyMetrics.Add("divergent_buckets", int64(len(diff)))
+
+	ids := make([]string, len(diff))
+	for i, id := range diff {
+		ids[i] = strconv.Itoa(id)
+	}
+
+	position.Set("ids", strings.Join(ids, ","))
+
+	var words digestBuckets
+	if err := sv.getJSON(sv.leader+"/digest/buckets?"+position.Encode(), &words); err != nil {
+		if errors.Is(err, errConflict) {
+			antiEntropyMetrics.Add("skipped", 1)
+			return nil
+		}
+
+		return err
+	}
+
+	repaired, err := sv.db.Repair(db.Snapshot{Seq: words.Seq, Term: words.Term, WordCount: words.Words}, buckets, diff)
+	if errors.Is(err, dbErrs.ErrPositionMoved) {
+		antiEntropyMetrics.Add("skipped", 1)
+
+		sv.logger.Debug("skipping anti-entropy repair, the replica changelog doesn't reach back to the digest position", "seq", local.Seq)
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	antiEntropyMetrics.Add("repairs", 1)
+	antiEntropyMetrics.Add("repaired_words", int64(repaired))
+
+	sv.logger.Warn("repaired words diverging from the leader", "seq", words.Seq, "buckets", len(diff), "words", repaired)
+
+	return nil
+}
+
+// getJSON decodes the JSON reply of a GET to the leader into value.
+func (sv *ReplicaServer) getJSON(url string, value any) error {
+	resp, err := sv.client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return errConflict
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// parseDigestPosition reads the optional seq and term parameters of a digest
+// request, positioned is false when there are none.
+func parseDigestPosition(r *http.Request) (term uint64, seq uint64, positioned bool, err error) {
+	query := r.URL.Query()
+	if !query.Has("seq") {
+		return 0, 0, false, nil
+	}
+
+	if seq, err = strconv.ParseUint(query.Get("seq"), 10, 64); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid seq %q", query.Get("seq"))
+	}
+
+	if term, err = strconv.ParseUint(query.Get("term"), 10, 64); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid term %q", query.Get("term"))
+	}
+
+	return term, seq, true, nil
+}
+
+// parseDigestBuckets validates the number of buckets of a digest, an empty
+// value means the default.
+func parseDigestBuckets(value string) (int, error) {
+	if value == "" {
+		return db.DefaultDigestBuckets, nil
+	}
+
+	buckets, err := strconv.Atoi(value)
+	if err != nil || buckets <= 0 || buckets > db.MaxDigestBuckets {
+		return 0, fmt.Errorf("invalid buckets %q, expected 1 to %d", value, db.MaxDigestBuckets)
+	}
+
+	return buckets, nil
+}
+
+// parseBucketIDs validates a comma separated list of buckets of a digest of
+// buckets buckets.
+func parseBucketIDs(value string, buckets int) ([]int, error) {
+	if value == "" {
+		return nil, errors.New("missing ids")
+	}
+
+	var ids []int
+
+	for _, field := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(field)
+		if err != nil || id < 0 || id >= buckets {
+			return nil, fmt.Errorf("invalid bucket %q, expected 0 to %d", field, buckets-1)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"memdb/pkg/db"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// bodies smaller than this are not worth compressing
+	minCompressSize = 1024
+
+	// DefaultMaxBodySize is the largest request body accepted, in bytes once
+	// decompressed
+	DefaultMaxBodySize = 64 << 20
+)
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// acceptsGzip reports whether the header value (Accept-Encoding) lists gzip.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+
+	return false
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeBody replies with data, gzip compressed when the client accepts it.
+func writeBody(w http.ResponseWriter, r *http.Request, contentType string, data []byte) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if len(data) >= minCompressSize && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		compressed, err := gzipBytes(data)
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		data = compressed
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+// streamBody replies with the body written by write, gzip compressed when the
+// client accepts it. Unlike writeBody the body is never held in memory, so
+// an error can only be reported by cutting it short.
+func streamBody(w http.ResponseWriter, r *http.Request, contentType string, write func(w io.Writer) error) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.WriteHeader(http.StatusOK)
+
+		buffered := bufio.NewWriter(w)
+		if err := write(buffered); err != nil {
+			return err
+		}
+
+		return buffered.Flush()
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+
+	writer := gzip.NewWriter(w)
+	if err := write(writer); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// writeJSONEntries writes entries as a JSON object of word counts.
+func writeJSONEntries(w io.Writer, entries db.Entries) error {
+	buffered := bufio.NewWriter(w)
+	buffered.WriteByte('{')
+
+	var (
+		line    []byte
+		err     error
+		written int
+	)
+
+	rangeErr := entries(func(word string, count int) bool {
+		line = line[:0]
+		if written > 0 {
+			line = append(line, ',')
+		}
+
+		key, _ := json.Marshal(word)
+		line = append(line, key...)
+		line = append(line, ':')
+		line = strconv.AppendInt(line, int64(count), 10)
+
+		_, err = buffered.Write(line)
+		written++
+
+		return err == nil
+	})
+
+	if rangeErr != nil {
+		return rangeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	buffered.WriteByte('}')
+
+	return buffered.Flush()
+}
+
+// requestBody returns the request body decoded according to its
+// Content-Encoding. Reading more than limit decoded bytes fails with an
+// *http.MaxBytesError, so that a small compressed body can't expand into an
+// unbounded allocation.
+func requestBody(w http.ResponseWriter, r *http.Request, limit int64) (io.ReadCloser, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return http.MaxBytesReader(w, r.Body, limit), nil
+	case "gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		// closing it closes the gzip reader, the body is closed by the server
+		return http.MaxBytesReader(w, reader, limit), nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// bodyTooLarge reports whether err comes from reading past the limit of
+// requestBody.
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+
+	return errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"log/slog"
+	"memdb/pkg/db"
+	"sync"
+	"time"
+)
+
+const (
+	// how long changes are held back waiting for a missing one before the
+	// replica gives up on it and resyncs
+	gapTimeout = 1 * time.Second
+	// most changes held back before the replica resyncs right away
+	maxPendingChanges = 1024
+)
+
+// inbox applies the changes pushed by the leader strictly in seq order, a
+// change merging several being applied at once. Changes arriving ahead of a
+// missing one are held back until it shows up. When it doesn't, or when the leader moved
+// to another term, the replica resyncs and the held back changes that are
+// newer than the snapshot are applied on top of it.
+type inbox struct {
+	db     db.Replica
+	lock   sync.Mutex
+	logger *slog.Logger
+	// changes received ahead of the replica position, by first seq
+	pending map[uint64]db.Change
+	// running while changes are held back
+	gapTimer *time.Timer
+	// position when gapTimer was started
+	gapSeq uint64
+	// term a resync was requested for, so that it is only requested once
+	resyncTerm uint64
+	// requests a full resync from the leader, without blocking
+	resync func(reason string)
+	// called once changes or a snapshot were applied
+	applied func()
+	// when a change or a snapshot was last received from the leader
+	lastUpdate time.Time
+}
+
+func newInbox(replica db.Replica, logger *slog.Logger, resync func(reason string), applied func()) *inbox {
+	return &inbox{
+		db:      replica,
+		logger:  logger,
+		pending: make(map[uint64]db.Change),
+		resync:  resync,
+		applied: applied,
+	}
+}
+
+// push applies change, or holds it back until the changes before it arrive.
+// Changes are identified by their term and seq: the ones already applied or
+// already held back are duplicate deliveries, e.g. retried after their ack
+// was lost, and are dropped.
+func (in *inbox) push(change db.Change) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	seq, term := in.db.Position(), in.db.Term()
+
+	in.lastUpdate = time.Now()
+
+	if change.Term < term {
+		in.logger.Warn("dropping change from an older leader term", "seq", change.Seq, "term", change.Term)
+		return
+	}
+
+	if change.Term > term {
+		// a new history: nothing can be applied until the replica synced to it
+		if held, ok := in.pending[change.First()]; !ok || held.Term <= change.Term {
+			in.pending[change.First()] = change
+		}
+
+		if in.resyncTerm != change.Term {
+			in.resyncTerm = change.Term
+
+			in.logger.Warn("leader term changed, resyncing", "term", term, "leader_term", change.Term)
+			in.resync("leader term changed")
+		}
+
+		return
+	}
+
+	if change.Seq <= seq {
+		in.logger.Debug("dropping change already applied", "seq", change.Seq, "position", seq)
+		return
+	}
+
+	if change.First() <= seq {
+		// merged changes can't be split to apply the missing ones
+		in.logger.Warn("dropping change partially applied, resyncing", "first_seq", change.First(), "seq", change.Seq, "position", seq)
+		in.resync("change partially applied")
+
+		return
+	}
+
+	if held, ok := in.pending[change.First()]; ok && held.Term == change.Term && held.Seq == change.Seq {
+		in.logger.Debug("dropping change already held back", "seq", change.Seq, "position", seq)
+		return
+	}
+
+	in.pending[change.First()] = change
+	in.drain()
+
+	if len(in.pending) > maxPendingChanges {
+		in.logger.Warn("too many changes held back, resyncing", "position", in.db.Position(), "pending", len(in.pending))
+		in.resync("too many changes held back")
+	}
+}
+
+// reset replaces the replica state with a leader snapshot and applies the
+// held back changes that follow it.
+func (in *inbox) reset(snap db.Snapshot) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	if snap.Term == in.db.Term() && snap.Seq < in.db.Position() {
+		// changes pushed while the snapshot was downloaded already moved the
+		// replica past it
+		in.logger.Info("ignoring snapshot older than the replica position", "seq", snap.Seq, "position", in.db.Position())
+	} else {
+		in.db.Reset(snap)
+		in.applied()
+	}
+
+	in.lastUpdate = time.Now()
+	in.resyncTerm = 0
+	in.drain()
+}
+
+// caughtUp records that the leader had no change the replica misses.
+func (in *inbox) caughtUp() {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	in.lastUpdate = time.Now()
+}
+
+// state returns the number of changes held back and when the leader last
+// sent something.
+func (in *inbox) state() (int, time.Time) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	return len(in.pending), in.lastUpdate
+}
+
+// drain applies the held back changes that follow the replica position and
+// drops the ones it went past. The lock must be held.
+func (in *inbox) drain() {
+	seq, term := in.db.Position(), in.db.Term()
+
+	for first, change := range in.pending {
+		if change.Term < term || (change.Term == term && first <= seq) {
+			delete(in.pending, first)
+		}
+	}
+
+	applied := false
+
+	for {
+		change, ok := in.pending[seq+1]
+		if !ok || change.Term != term {
+			break
+		}
+
+		in.db.Apply(change)
+		delete(in.pending, seq+1)
+
+		seq = change.Seq
+		applied = true
+	}
+
+	if applied {
+		in.applied()
+	}
+
+	if len(in.pending) == 0 {
+		in.stopGapTimer()
+		return
+	}
+
+	if in.gapTimer == nil {
+		in.gapSeq = seq
+		in.gapTimer = time.AfterFunc(gapTimeout, in.gapExpired)
+
+		in.logger.Info("holding back changes until the missing ones arrive", "position", seq, "pending", len(in.pending))
+	}
+}
+
+// gapExpired resyncs the replica if it didn't move since the gap opened.
+func (in *inbox) gapExpired() {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	in.gapTimer = nil
+
+	if len(in.pending) == 0 {
+		return
+	}
+
+	seq := in.db.Position()
+	if seq > in.gapSeq {
+		// some changes arrived meanwhile, wait for the rest
+		in.gapSeq = seq
+		in.gapTimer = time.AfterFunc(gapTimeout, in.gapExpired)
+
+		return
+	}
+
+	in.logger.Warn("changes missing from the leader, resyncing", "position", seq, "pending", len(in.pending))
+	in.resync("changes missing")
+}
+
+// stopGapTimer stops waiting for missing changes. The lock must be held.
+func (in *inbox) stopGapTimer() {
+	if in.gapTimer != nil {
+		in.gapTimer.Stop()
+		in.gapTimer = nil
+	}
+}
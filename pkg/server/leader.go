@@ -5,125 +5,541 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"memdb/pkg/db"
+	dbErrs "memdb/pkg/errors"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
-	maxTextLength = 65535
+	defaultMaxTextLength = 65535
+
+	// position in the leader history of a replicated change or of a snapshot,
+	// and the term of that history
+	seqHeader  = "X-Memdb-Seq"
+	termHeader = "X-Memdb-Term"
+
+	// Content-Type of the changes sent by /sync?since=, a JSON array
+	changesContentType = "application/x-memdb-changes+json"
+
+	// number of replicas that acknowledged a write, in the POST /post response
+	acksHeader = "X-Memdb-Acks"
+	// first seq of the changes merged into an update, when there are several
+	firstSeqHeader = "X-Memdb-First-Seq"
+
+	// longest request to a replica, so that a hung one doesn't hold back its
+	// deliveries and heartbeats
+	replicaRequestTimeout = 10 * time.Second
 )
 
 type LeaderServer struct {
-	db       db.Leader
-	port     string
-	replicas []string
-	server   *http.Server
-	logger   *slog.Logger
+	db   db.Leader
+	port string
+	// replicas can join and leave while writes are replicated
+	replicasLock sync.RWMutex
+	replicas     []*outbox
+	// serializes adding and removing replicas, which open and remove their
+	// queue files without holding the replicas lock
+	joinLock sync.Mutex
+	// file the replicas are saved to when they change, not saved when empty
+	membersFile string
+	// serializes writing the members file, which happens without holding
+	// the replicas lock
+	membersLock sync.Mutex
+	server      *http.Server
+	logger      *slog.Logger
+	// longest text accepted by POST /post
+	maxTextLength int
+	// largest snapshot accepted by POST /admin/restore, once decompressed
+	maxBodySize int64
+	// replicas that accept gzip compressed updates
+	gzipReplicas sync.Map
+	// settings of the replication to each replica
+	outboxConfig outboxConfig
+	// directory of the durable replication queues, in memory when empty
+	queueDir  string
+	queueOpts []db.Option
+	// sends the updates, resync requests and heartbeats to the replicas
+	client *http.Client
+	// how far writes go before POST /post replies, unless the request says
+	// otherwise, and the longest wait for the replicas
+	ackLevel   AckLevel
+	ackTimeout time.Duration
+	acks       *acks
+	// serves the replicas syncing from the leader
+	upstream *upstream
 }
 
 func NewLeaderServer(leader db.Leader, port string, logger *slog.Logger) *LeaderServer {
 	return &LeaderServer{
-		db:       leader,
-		port:     port,
-		replicas: []string{},
-		logger:   logger,
+		db:            leader,
+		port:          port,
+		replicas:      []*outbox{},
+		logger:        logger,
+		maxTextLength: defaultMaxTextLength,
+		maxBodySize:   DefaultMaxBodySize,
+		outboxConfig: outboxConfig{
+			queueLimit:        defaultQueueLimit,
+			batchInterval:     DefaultBatchInterval,
+			batchSize:         DefaultBatchSize,
+			heartbeatInterval: DefaultHeartbeatInterval,
+			heartbeatMisses:   DefaultHeartbeatMisses,
+		},
+		client:     &http.Client{Timeout: replicaRequestTimeout},
+		ackLevel:   DefaultAckLevel,
+		ackTimeout: DefaultAckTimeout,
+		acks:       newAcks(),
+		upstream:   newUpstream(leader, logger),
 	}
 }
 
-func (sv *LeaderServer) AddReplica(replica string) {
-	sv.replicas = append(sv.replicas, replica)
+// SetQueueLimit sets the most changes queued for an unreachable replica, past
+// which they are dropped and the replica is asked to fully resync instead.
+// Replicas added afterwards are affected.
+func (sv *LeaderServer) SetQueueLimit(limit int) {
+	sv.outboxConfig.queueLimit = limit
+}
+
+// SetBatching sets how long changes wait to be merged with the next ones into
+// a single update to the replicas, and the most changes merged. Replicas added
+// afterwards are affected.
+func (sv *LeaderServer) SetBatching(interval time.Duration, size int) {
+	sv.outboxConfig.batchInterval = interval
+	sv.outboxConfig.batchSize = size
+}
+
+// SetHeartbeat sets how often the replicas are checked, never when interval
+// is 0, and the checks a replica misses in a row before it is ejected: it
+// isn't sent the writes anymore until it answers again and gets resynced.
+// Replicas added afterwards are affected.
+func (sv *LeaderServer) SetHeartbeat(interval time.Duration, misses int) {
+	sv.outboxConfig.heartbeatInterval = interval
+	sv.outboxConfig.heartbeatMisses = misses
+}
+
+// SetQueueDir keeps the replication queues in files under dir, so that the
+// changes not delivered yet survive a restart. opts carry the keyring the
+// queued changes are encrypted with. Replicas added afterwards are affected.
+func (sv *LeaderServer) SetQueueDir(dir string, opts ...db.Option) {
+	sv.queueDir = dir
+	sv.queueOpts = opts
+}
+
+// SetAckLevel sets how far writes go before POST /post replies, when the
+// request doesn't set the ack parameter.
+func (sv *LeaderServer) SetAckLevel(level AckLevel) {
+	sv.ackLevel = level
 }
 
-// POST handler for counting words
+// SetAckTimeout sets the longest POST /post waits for the replicas, when the
+// request doesn't set the ack_timeout parameter.
+func (sv *LeaderServer) SetAckTimeout(timeout time.Duration) {
+	sv.ackTimeout = timeout
+}
+
+// SetMaxTextLength sets the longest text accepted by POST /post, in bytes.
+func (sv *LeaderServer) SetMaxTextLength(length int) {
+	sv.maxTextLength = length
+}
+
+// SetMaxBodySize sets the largest snapshot accepted by POST /admin/restore, in
+// bytes once decompressed.
+func (sv *LeaderServer) SetMaxBodySize(size int64) {
+	sv.maxBodySize = size
+}
+
+// POST handler for counting words. The ack parameter sets how far the write
+// goes before the reply, see AckLevel, and ack_timeout the longest wait for
+// the replicas. The number of replicas that acknowledged the write is sent in
+// the X-Memdb-Acks header, a 504 means that fewer than requested did in time:
+// the write is not undone and still reaches them later.
 func (sv *LeaderServer) countWordsHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sv.logger.Info("POST /post (count words request)")
 		text := r.FormValue("text")
 
-		if err := validateInput(text); err != nil {
-			http.Error(w, "No text provided", http.StatusBadRequest)
+		if err := validateInput(text, sv.maxTextLength); err != nil {
+			message := "No text provided"
+			if errors.Is(err, http.ErrContentLength) {
+				message = fmt.Sprintf("Text longer than %d bytes", sv.maxTextLength)
+			}
+
+			http.Error(w, message, http.StatusBadRequest)
+
 			return
 		}
 
-		updateBuffer := sv.db.CountWords(text)
+		level := sv.ackLevel
+		if ack := r.FormValue("ack"); ack != "" {
+			var err error
+			if level, err = ParseAckLevel(ack); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
-		go sv.replicate(updateBuffer)
+		timeout := sv.ackTimeout
+		if ackTimeout := r.FormValue("ack_timeout"); ackTimeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(ackTimeout); err != nil || timeout <= 0 {
+				http.Error(w, "invalid ack_timeout", http.StatusBadRequest)
+				return
+			}
+		}
+
+		change, err := sv.db.CountWords(text)
+		if err != nil {
+			sv.logger.Error("failed to persist words", "error", err)
+
+			http.Error(w, "failed to persist words", http.StatusInternalServerError)
+
+			return
+		}
+
+		required := level.required(sv.activeReplicas())
+		if len(change.Updates) == 0 {
+			// nothing to replicate
+			required = 0
+		}
+
+		acks := 0
+
+		if required > 0 {
+			acked := sv.acks.wait(change, required)
+
+			sv.replicate(change)
+
+			select {
+			case <-acked:
+			case <-time.After(timeout):
+			case <-r.Context().Done():
+			}
+
+			acks = sv.acks.release(change)
+		} else {
+			sv.replicate(change)
+		}
+
+		w.Header().Set(seqHeader, strconv.FormatUint(change.Seq, 10))
+		w.Header().Set(acksHeader, strconv.Itoa(acks))
+
+		if acks < required {
+			sv.logger.Warn("write not acknowledged by enough replicas in time", "seq", change.Seq, "level", level, "acks", acks, "required", required)
+
+			http.Error(w, fmt.Sprintf("write acknowledged by %d of the %d replicas required", acks, required), http.StatusGatewayTimeout)
+
+			return
+		}
 
 		w.WriteHeader(http.StatusAccepted)
 	})
 }
 
-func (sv *LeaderServer) replicate(updateBuffer map[string]int) error {
-	if len(updateBuffer) > 0 {
-		sv.logger.Info("replicating to followers", "updateBuffer", updateBuffer)
+// replicate queues change for every replica, each queue is delivered in the
+// background.
+func (sv *LeaderServer) replicate(change db.Change) {
+	sv.upstream.streams.notify()
 
-		data, err := json.Marshal(updateBuffer)
-		if err != nil {
-			sv.logger.Error("error marshaling replication data", "error", err)
-			return err
+	if len(change.Updates) == 0 {
+		return
+	}
+
+	sv.logger.Info("replicating to followers", "seq", change.Seq, "term", change.Term, "updateBuffer", change.Updates)
+
+	for _, replica := range sv.outboxes() {
+		replica.push(change)
+	}
+}
+
+// deliver sends change to the replica, gzip compressed when the replica
+// accepts it.
+func (sv *LeaderServer) deliver(replica string, change db.Change) error {
+	data, err := json.Marshal(change.Updates)
+	if err != nil {
+		return err
+	}
+
+	var gzipped []byte
+	if _, ok := sv.gzipReplicas.Load(replica); ok && len(data) >= minCompressSize {
+		if gzipped, err = gzipBytes(data); err != nil {
+			sv.logger.Error("failed to compress replication data", "error", err)
 		}
+	}
+
+	resp, err := sv.postUpdate(replica, change, data, gzipped)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
 
-		sv.sendToReplicas(data)
+	if resp.StatusCode != http.StatusAccepted {
+		return statusError(resp)
 	}
 
 	return nil
 }
 
-func (sv *LeaderServer) sendToReplicas(data []byte) {
-	done := make(chan struct{})
-	for _, replica := range sv.replicas {
-		replica := replica
-		go func() {
-			// wait for a minimum of one replica to respond
-			defer func() {
-				select {
-				case done <- struct{}{}:
-				default:
-				}
-			}()
-
-			body := bytes.NewReader(data)
-
-			resp, err := http.Post(replica+"/update", "application/json", body)
-			if err != nil {
-				sv.logger.Error("failed to replicate updates to follower", "error", err)
-				return
-			}
+// postUpdate sends an update to the replica, gzip compressed when gzipped is
+// set. Replicas advertise the encodings they accept via the Accept-Encoding
+// response header (RFC 7694), which decides whether the next update to them
+// gets compressed.
+func (sv *LeaderServer) postUpdate(replica string, change db.Change, data []byte, gzipped []byte) (*http.Response, error) {
+	body, encoding := data, ""
+	if gzipped != nil {
+		body, encoding = gzipped, "gzip"
+	}
 
-			if resp.StatusCode != http.StatusAccepted {
-				sv.logger.Error("failed to replicate", "status code", resp.StatusCode)
-			}
-		}()
+	req, err := http.NewRequest(http.MethodPost, replica+"/update", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
 
-	// Wait for one goroutine to respond
-	<-done
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(seqHeader, strconv.FormatUint(change.Seq, 10))
+	req.Header.Set(termHeader, strconv.FormatUint(change.Term, 10))
+	if change.FirstSeq != 0 {
+		req.Header.Set(firstSeqHeader, strconv.FormatUint(change.FirstSeq, 10))
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	resp, err := sv.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if acceptsGzip(resp.Header.Get("Accept-Encoding")) {
+		sv.gzipReplicas.Store(replica, struct{}{})
+	} else {
+		sv.gzipReplicas.Delete(replica)
+	}
+
+	if resp.StatusCode == http.StatusUnsupportedMediaType && encoding != "" {
+		resp.Body.Close()
+
+		return sv.postUpdate(replica, change, data, nil)
+	}
+
+	return resp, nil
 }
 
-// GET handler for replica full sync
-func (sv *LeaderServer) syncReplicaHandler() http.Handler {
+// GET handler reporting the state of the replication to every replica
+func (sv *LeaderServer) replicasHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sv.logger.Info("GET /sync (replica full sync request)")
+		sv.logger.Info("GET /replicas (replication status)")
+
+		term, seq := sv.db.Term(), sv.db.Position()
+
+		replicas := sv.outboxes()
 
-		wordsCounts := sv.db.GetWordsCounts()
+		statuses := make([]replicaStatus, 0, len(replicas))
+		for _, replica := range replicas {
+			statuses = append(statuses, replica.status(term, seq))
+		}
 
-		data, err := json.Marshal(wordsCounts)
+		data, err := json.Marshal(statuses)
 		if err != nil {
-			http.Error(w, "failed to serialize database", http.StatusInternalServerError)
+			http.Error(w, "failed to serialize replicas", http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(seqHeader, strconv.FormatUint(seq, 10))
+		w.Header().Set(termHeader, strconv.FormatUint(term, 10))
 		w.WriteHeader(http.StatusOK)
 
 		if _, err = w.Write(data); err != nil {
-			sv.logger.Error("failed to send sync data to replica", "error", err)
+			sv.logger.Error("failed to send replicas", "error", err)
 		}
 	})
 }
 
+// GET handler listing the retained snapshot generations
+func (sv *LeaderServer) generationsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sv.logger.Info("GET /admin/generations (list snapshot generations)")
+
+		generations, err := sv.db.Generations()
+		if err != nil {
+			sv.logger.Error("failed to list snapshot generations", "error", err)
+
+			http.Error(w, "failed to list snapshot generations", http.StatusInternalServerError)
+
+			return
+		}
+
+		data, err := json.Marshal(generations)
+		if err != nil {
+			http.Error(w, "failed to serialize snapshot generations", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		if _, err = w.Write(data); err != nil {
+			sv.logger.Error("failed to send snapshot generations", "error", err)
+		}
+	})
+}
+
+// POST handler restoring a snapshot generation, the replicas are asked to
+// resync from scratch afterwards.
+func (sv *LeaderServer) restoreGenerationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sv.logger.Info("POST /admin/generations/restore (restore snapshot generation)")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(w, "No generation id provided", http.StatusBadRequest)
+			return
+		}
+
+		if err := sv.db.RestoreGeneration(id); err != nil {
+			sv.logger.Error("failed to restore snapshot generation", "id", id, "error", err)
+
+			if errors.Is(err, dbErrs.ErrGenerationNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			http.Error(w, "failed to restore snapshot generation", http.StatusInternalServerError)
+
+			return
+		}
+
+		sv.resyncReplicas()
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// GET handler streaming a consistent snapshot of the leader, in the snapshot
+// file format
+func (sv *LeaderServer) backupHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sv.logger.Info("GET /admin/backup (online backup)")
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", db.SnapshotContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+			"wordcounts-"+time.Now().UTC().Format("20060102T150405Z")+".db"))
+
+		// nothing is written on failure, so the error status can still be sent
+		if err := sv.db.Backup(w); err != nil {
+			sv.logger.Error("failed to back up database", "error", err)
+
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "failed to back up database", http.StatusInternalServerError)
+		}
+	})
+}
+
+// POST handler replacing the leader state with an uploaded snapshot, the
+// replicas are asked to resync from scratch afterwards.
+func (sv *LeaderServer) restoreHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sv.logger.Info("POST /admin/restore (restore uploaded snapshot)")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := requestBody(w, r, sv.maxBodySize)
+		if err != nil {
+			http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		defer body.Close()
+
+		if err := sv.db.Restore(body); err != nil {
+			sv.logger.Error("failed to restore uploaded snapshot", "error", err)
+
+			if bodyTooLarge(err) {
+				http.Error(w, "snapshot too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			if errors.Is(err, dbErrs.ErrCorruptSnapshot) || errors.Is(err, dbErrs.ErrEncryptionKey) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			http.Error(w, "failed to restore snapshot", http.StatusInternalServerError)
+
+			return
+		}
+
+		sv.resyncReplicas()
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// resyncReplicas asks every replica to drop its state and fully resync, the
+// changes queued for them are dropped.
+func (sv *LeaderServer) resyncReplicas() {
+	// the streams end, the replicas pulling the changes resync when they
+	// reconnect
+	sv.upstream.streams.notify()
+
+	for _, replica := range sv.outboxes() {
+		replica.markResync()
+	}
+}
+
+// requestResync asks the replica to drop its state and fully resync.
+func (sv *LeaderServer) requestResync(replica string) error {
+	resp, err := sv.client.Post(replica+"/resync", "application/json", nil)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// probe checks that the replica is up. A replica still bootstrapping replies
+// with a 503 but buffers the updates meanwhile, it is up.
+func (sv *LeaderServer) probe(replica string) error {
+	resp, err := sv.client.Get(replica + "/health")
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
 func (sv *LeaderServer) healthHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sv.logger.Info("GET /health (health check)")
@@ -132,29 +548,65 @@ func (sv *LeaderServer) healthHandler() http.Handler {
 }
 
 func (sv *LeaderServer) RunServer() {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", sv.port))
+	if err != nil {
+		sv.logger.Error("failed to start server", "error", err)
+		return
+	}
+
+	sv.Serve(listener)
+}
+
+// Serve is RunServer on a listener of the caller, such as one on an ephemeral
+// port.
+func (sv *LeaderServer) Serve(listener net.Listener) {
 	router := http.NewServeMux()
 
 	router.Handle("/health", recoverMiddleware(sv.healthHandler()))
 	router.Handle("/post", recoverMiddleware(sv.countWordsHandler()))
-	router.Handle("/sync", recoverMiddleware(sv.syncReplicaHandler()))
+	sv.upstream.route(router)
+	router.Handle("/admin/generations", recoverMiddleware(sv.generationsHandler()))
+	router.Handle("/admin/generations/restore", recoverMiddleware(sv.restoreGenerationHandler()))
+	router.Handle("/admin/backup", recoverMiddleware(sv.backupHandler()))
+	router.Handle("/admin/restore", recoverMiddleware(sv.restoreHandler()))
+	router.Handle("/replicas", recoverMiddleware(sv.replicasHandler()))
+	router.Handle("/replicas/join", recoverMiddleware(sv.joinHandler()))
+	router.Handle("/replicas/leave", recoverMiddleware(sv.leaveHandler()))
+	router.Handle("/debug/vars", expvar.Handler())
 
 	sv.server = &http.Server{
-		Addr:    fmt.Sprintf(":%s", sv.port),
+		Addr:    listener.Addr().String(),
 		Handler: router,
 	}
 
-	sv.logger.Info("server listening", "port", sv.port)
+	// streams don't end on their own
+	sv.server.RegisterOnShutdown(sv.upstream.streams.close)
+
+	sv.logger.Info("server listening", "address", sv.server.Addr)
 
-	if err := sv.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	if err := sv.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
 		sv.logger.Error("failed to start server", "error", err)
 	}
 }
 
+// Shutdown stops the server and the deliveries to the replicas, durable
+// queues keep the changes not delivered yet.
 func (sv *LeaderServer) Shutdown(ctx context.Context) error {
-	return sv.server.Shutdown(ctx)
+	err := sv.server.Shutdown(ctx)
+
+	for _, replica := range sv.outboxes() {
+		err = errors.Join(err, replica.close())
+	}
+
+	return err
+}
+
+// positionETag identifies the state at seq in term.
+func positionETag(term uint64, seq uint64) string {
+	return fmt.Sprintf(`"%d-%d"`, term, seq)
 }
 
-func validateInput(text string) error {
+func validateInput(text string, maxTextLength int) error {
 	if text == "" {
 		return http.ErrBodyNotAllowed
 	}
@@ -64,7 +64,10 @@ func (sv *LocalReplica) updateHandler() http.Handler {
 		// ignore request just trigger a sync
 		if err := sv.db.Update(); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+
+		w.WriteHeader(http.StatusAccepted)
 	})
 }
 
@@ -81,6 +84,7 @@ func (sv *LocalReplica) RunServer() {
 	router.Handle("/wordcount", recoverMiddleware(sv.getHandler()))
 	router.Handle("/health", recoverMiddleware(sv.healthHandler()))
 	router.Handle("/update", recoverMiddleware(sv.updateHandler()))
+	router.Handle("/resync", recoverMiddleware(sv.updateHandler()))
 
 	sv.server = &http.Server{
 		Addr:    fmt.Sprintf(":%s", sv.port),
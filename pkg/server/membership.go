@@ -0,0 +1,295 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"memdb/pkg/db"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// AddReplica starts replicating to the replica at the given base URL, unless
+// it is already a member. Its queue is read back from the queue directory when
+// one is set. It returns whether the replica was added.
+func (sv *LeaderServer) AddReplica(replica string) bool {
+	replica = canonicalReplica(replica)
+
+	sv.joinLock.Lock()
+	defer sv.joinLock.Unlock()
+
+	sv.replicasLock.RLock()
+	member := sv.member(replica) >= 0
+	sv.replicasLock.RUnlock()
+
+	if member {
+		return false
+	}
+
+	// read back without the replicas lock so that the writes are not held
+	// back by the replay, the join lock keeps the replica from being added
+	// or removed meanwhile
+	queue := db.NewQueue()
+
+	if sv.queueDir != "" {
+		durable, err := sv.openQueue(replica)
+		if err != nil {
+			sv.logger.Error("failed to open replication queue, keeping it in memory", "replica", replica, "error", err)
+		} else {
+			queue = durable
+		}
+	}
+
+	if pending := queue.Len(); pending > 0 {
+		sv.logger.Info("resuming replication queue", "replica", replica, "pending", pending)
+	}
+
+	sv.replicasLock.Lock()
+
+	sv.replicas = append(sv.replicas, newOutbox(replica, queue, sv.outboxConfig, sv.logger,
+		func(change db.Change) error {
+			if err := sv.deliver(replica, change); err != nil {
+				return err
+			}
+
+			sv.acks.ack(change)
+
+			return nil
+		},
+		func() error {
+			return sv.requestResync(replica)
+		},
+		func() error {
+			return sv.probe(replica)
+		},
+	))
+
+	sv.replicasLock.Unlock()
+
+	sv.saveMembers()
+
+	return true
+}
+
+// RemoveReplica stops replicating to the replica at the given base URL and
+// drops the changes queued for it. It returns whether it was a member.
+func (sv *LeaderServer) RemoveReplica(replica string) bool {
+	replica = canonicalReplica(replica)
+
+	sv.joinLock.Lock()
+	defer sv.joinLock.Unlock()
+
+	sv.replicasLock.Lock()
+
+	i := sv.member(replica)
+	if i < 0 {
+		sv.replicasLock.Unlock()
+
+		return false
+	}
+
+	out := sv.replicas[i]
+	sv.replicas = append(sv.replicas[:i:i], sv.replicas[i+1:]...)
+
+	sv.replicasLock.Unlock()
+
+	sv.saveMembers()
+
+	// waits for the delivery in progress, without holding back the writes
+	if err := out.close(); err != nil {
+		sv.logger.Error("failed to close replication queue", "replica", replica, "error", err)
+	}
+
+	sv.gzipReplicas.Delete(replica)
+
+	if sv.queueDir != "" {
+		if err := os.Remove(sv.queuePath(replica)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			sv.logger.Error("failed to remove replication queue", "replica", replica, "error", err)
+		}
+	}
+
+	return true
+}
+
+// SetMembersFile saves the replicas to the file name whenever they change, and
+// adds the ones it already lists. It is meant to be called before the
+// replicas of the command line are added, so that the replicas that joined
+// at runtime are kept across restarts.
+func (sv *LeaderServer) SetMembersFile(name string) error {
+	members, err := db.LoadMembers(name)
+	if err != nil {
+		return err
+	}
+
+	sv.replicasLock.Lock()
+	sv.membersFile = name
+	sv.replicasLock.Unlock()
+
+	for _, replica := range members {
+		sv.AddReplica(replica)
+	}
+
+	return nil
+}
+
+// outboxes returns the replicas at the time of the call.
+func (sv *LeaderServer) outboxes() []*outbox {
+	sv.replicasLock.RLock()
+	defer sv.replicasLock.RUnlock()
+
+	return append([]*outbox{}, sv.replicas...)
+}
+
+// activeReplicas returns the number of replicas that weren't ejected.
+func (sv *LeaderServer) activeReplicas() int {
+	active := 0
+
+	for _, out := range sv.outboxes() {
+		if !out.isEjected() {
+			active++
+		}
+	}
+
+	return active
+}
+
+// member returns the index of replica, -1 when it isn't a member. The
+// replicas lock must be held.
+func (sv *LeaderServer) member(replica string) int {
+	for i, out := range sv.replicas {
+		if out.replica == replica {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// saveMembers writes the replicas to the members file, when there is one.
+// The list is copied under the replicas lock but written without it, so that
+// the writes are not held back by the file sync; it is copied again by every
+// save so that the last one written is always the latest.
+func (sv *LeaderServer) saveMembers() {
+	sv.membersLock.Lock()
+	defer sv.membersLock.Unlock()
+
+	sv.replicasLock.RLock()
+
+	name := sv.membersFile
+
+	members := make([]string, 0, len(sv.replicas))
+	for _, out := range sv.replicas {
+		members = append(members, out.replica)
+	}
+
+	sv.replicasLock.RUnlock()
+
+	if name == "" {
+		return
+	}
+
+	if err := db.SaveMembers(name, members); err != nil {
+		sv.logger.Error("failed to save replicas", "error", err)
+	}
+}
+
+func (sv *LeaderServer) openQueue(replica string) (*db.Queue, error) {
+	if err := os.MkdirAll(sv.queueDir, 0700); err != nil {
+		return nil, err
+	}
+
+	return db.OpenQueue(sv.queuePath(replica), sv.queueOpts...)
+}
+
+// queuePath returns the file of the durable queue of replica, named after the
+// hash of its URL so that distinct URLs never share a file.
+func (sv *LeaderServer) queuePath(replica string) string {
+	sum := sha256.Sum256([]byte(replica))
+
+	return path.Join(sv.queueDir, hex.EncodeToString(sum[:16])+db.QueueSuffix)
+}
+
+// POST handler for a replica to start receiving the updates, the url
+// parameter is the base URL the leader reaches it at. Replies 201 when the
+// replica was added and 200 when it already was a member.
+func (sv *LeaderServer) joinHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		replica, err := replicaURL(r.FormValue("url"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sv.logger.Info("POST /replicas/join (replica joining)", "replica", replica)
+
+		if !sv.AddReplica(replica) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+// POST handler for a replica to stop receiving the updates, the url parameter
+// is the base URL it joined with. Replies 404 when it isn't a member.
+func (sv *LeaderServer) leaveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		replica, err := replicaURL(r.FormValue("url"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sv.logger.Info("POST /replicas/leave (replica leaving)", "replica", replica)
+
+		if !sv.RemoveReplica(replica) {
+			http.Error(w, "not a member", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// replicaURL validates the base URL of a replica and returns it with the
+// scheme and host lowercased and without trailing slash, so that the
+// spellings of a URL are the same member.
+func replicaURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid replica URL %q, expected an absolute http(s) URL", raw)
+	}
+
+	u.Scheme, u.Host = strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid replica URL %q, expected an absolute http(s) URL", raw)
+	}
+
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// canonicalReplica returns the canonical form of a replica URL, see
+// replicaURL, or replica as is when it isn't valid.
+func canonicalReplica(replica string) string {
+	if canonical, err := replicaURL(replica); err == nil {
+		return canonical
+	}
+
+	return replica
+}
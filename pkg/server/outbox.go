@@ -0,0 +1,563 @@
+package server
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"memdb/pkg/db"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueLimit = 10000
+
+	// how long changes are held to be sent along with the next ones, and the
+	// most changes sent at once
+	DefaultBatchInterval = 10 * time.Millisecond
+	DefaultBatchSize     = 1000
+
+	// how often replicas are checked, and the checks missed in a row before
+	// a replica is ejected
+	DefaultHeartbeatInterval = 1 * time.Second
+	DefaultHeartbeatMisses   = 3
+
+	// delays between delivery attempts to an unresponsive replica
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+// outboxConfig are the settings of the replication to a replica.
+type outboxConfig struct {
+	// most changes queued before the replica is resynced instead
+	queueLimit int
+	// how long changes are held to be merged with the next ones, and the most
+	// changes merged
+	batchInterval time.Duration
+	batchSize     int
+	// how often the replica is checked, never when 0, and the checks missed
+	// in a row before it is ejected
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+}
+
+// errRejected is a change the replica refused, sending it again won't help.
+var errRejected = errors.New("change rejected by replica")
+
+// replicationMetrics are published on /debug/vars: the number of batches and
+// changes delivered to the replicas, and the batches by number of changes.
+var replicationMetrics = expvar.NewMap("replication")
+
+// upper bounds of the batch size buckets of replicationMetrics
+var batchSizeBuckets = []int{1, 10, 100, 1000}
+
+// outbox delivers the leader changes to a single replica, in order, retrying
+// each one with exponential backoff until the replica acknowledges it. When
+// more than queueLimit changes pile up, they are dropped and the replica is
+// asked to fully resync instead.
+//
+// Changes are held for up to batchInterval, or until batchSize of them are
+// queued, and the ones queued are merged into a single update.
+//
+// The replica is checked every heartbeatInterval. After heartbeatMisses
+// failed checks in a row it is ejected: the changes are not queued for it
+// anymore, until a check succeeds again and it is asked to resync.
+type outbox struct {
+	replica string
+	queue   *db.Queue
+	config  outboxConfig
+	logger  *slog.Logger
+
+	// delivers a change to the replica
+	send func(change db.Change) error
+	// asks the replica to fully resync
+	resync func() error
+	// checks that the replica is up
+	probe func() error
+
+	lock sync.Mutex
+	// set when the replica must resync before anything else is sent
+	needsResync bool
+	// update being delivered, sent again as is until it is acknowledged
+	batch *db.Change
+	// when the oldest change waiting for the next batch was queued
+	batchStart time.Time
+	// delivery statistics
+	ackedSeq    uint64
+	ackedTerm   uint64
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	errors      uint64
+	// health checks
+	ejected       bool
+	misses        int
+	lastHeartbeat time.Time
+
+	wake    chan struct{}
+	done    chan struct{}
+	workers sync.WaitGroup
+}
+
+func newOutbox(replica string, queue *db.Queue, config outboxConfig, logger *slog.Logger,
+	send func(change db.Change) error, resync func() error, probe func() error) *outbox {
+	out := &outbox{
+		replica: replica,
+		queue:   queue,
+		config:  config,
+		logger:  logger.With("replica", replica),
+		send:    send,
+		resync:  resync,
+		probe:   probe,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	out.workers.Add(1)
+	go out.run()
+
+	if config.heartbeatInterval > 0 {
+		out.workers.Add(1)
+		go out.heartbeat()
+	}
+
+	return out
+}
+
+// push queues change for delivery, unless the outbox was closed or the
+// replica ejected.
+func (out *outbox) push(change db.Change) {
+	select {
+	case <-out.done:
+		return
+	default:
+	}
+
+	if out.queue.Len() >= out.config.queueLimit {
+		out.logger.Warn("replication queue is full, the replica will be resynced", "limit", out.config.queueLimit)
+		out.markResync()
+
+		return
+	}
+
+	out.lock.Lock()
+	if out.ejected {
+		// it resyncs when it is admitted again
+		out.lock.Unlock()
+
+		return
+	}
+
+	if out.queue.Len() == 0 {
+		out.batchStart = time.Now()
+	}
+	out.lock.Unlock()
+
+	if err := out.queue.Push(change); err != nil {
+		out.logger.Error("failed to queue change, the replica will be resynced", "seq", change.Seq, "error", err)
+		out.markResync()
+
+		return
+	}
+
+	out.notify()
+}
+
+// markResync drops the queued changes and asks the replica to fully resync
+// before the next ones are sent.
+func (out *outbox) markResync() {
+	out.lock.Lock()
+	out.needsResync = true
+	out.batch = nil
+	out.lock.Unlock()
+
+	if err := out.queue.Clear(); err != nil {
+		out.logger.Error("failed to clear replication queue", "error", err)
+	}
+
+	out.notify()
+}
+
+func (out *outbox) notify() {
+	select {
+	case out.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (out *outbox) run() {
+	defer out.workers.Done()
+
+	attempt := 0
+
+	for {
+		if delay := out.linger(); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-out.wake:
+			case <-out.done:
+				return
+			}
+
+			continue
+		}
+
+		idle, err := out.deliver()
+
+		switch {
+		case err != nil:
+			delay := retryDelay(attempt)
+			attempt++
+
+			out.logger.Error("failed to replicate to follower, retrying", "attempt", attempt, "delay", delay, "error", err)
+
+			select {
+			case <-time.After(delay):
+			case <-out.done:
+				return
+			}
+		case idle:
+			attempt = 0
+
+			select {
+			case <-out.wake:
+			case <-out.done:
+				return
+			}
+		default:
+			attempt = 0
+
+			select {
+			case <-out.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// linger returns how long to wait for more changes before sending the queued
+// ones.
+func (out *outbox) linger() time.Duration {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	if out.needsResync || out.batch != nil || out.ejected {
+		return 0
+	}
+
+	if queued := out.queue.Len(); queued == 0 || queued >= out.config.batchSize {
+		return 0
+	}
+
+	return out.config.batchInterval - time.Since(out.batchStart)
+}
+
+// deliver makes a single step: the pending resync request or the changes at
+// the head of the queue. idle is set when there was nothing to do.
+func (out *outbox) deliver() (idle bool, err error) {
+	out.lock.Lock()
+	needsResync, ejected := out.needsResync, out.ejected
+	out.lock.Unlock()
+
+	if ejected {
+		return true, nil
+	}
+
+	if needsResync {
+		if err := out.resync(); err != nil {
+			out.recordFailure(err)
+
+			return false, fmt.Errorf("failed to request resync: %w", err)
+		}
+
+		out.lock.Lock()
+		out.needsResync = false
+		out.lastSuccess = time.Now()
+		out.misses = 0
+		out.lock.Unlock()
+
+		out.logger.Info("replica asked to resync")
+
+		return false, nil
+	}
+
+	change, size, ok := out.nextBatch()
+	if !ok {
+		return true, nil
+	}
+
+	// flushes every change queued so far at once rather than one fsync per
+	// push, so that they survive a restart while the replica is unreachable
+	if err := out.queue.Sync(); err != nil {
+		return false, err
+	}
+
+	if err := out.send(change); err != nil {
+		out.recordFailure(err)
+
+		if errors.Is(err, errRejected) {
+			out.logger.Error("replica rejected change, it will be resynced", "seq", change.Seq, "error", err)
+			out.markResync()
+
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	// the changes queued while it was sent already waited, batchStart is left
+	// alone so that they are sent right away
+	out.lock.Lock()
+	out.batch = nil
+	out.ackedSeq, out.ackedTerm = change.Seq, change.Term
+	out.lastSuccess = time.Now()
+	out.misses = 0
+	out.lock.Unlock()
+
+	if err := out.queue.Pop(change); err != nil {
+		out.logger.Error("failed to drop delivered change from the replication queue", "seq", change.Seq, "error", err)
+	}
+
+	recordBatch(size)
+
+	return false, nil
+}
+
+// nextBatch returns the update being delivered, or merges the changes at the
+// head of the queue into a new one. size is the number of changes it holds.
+func (out *outbox) nextBatch() (db.Change, int, bool) {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	if out.batch != nil {
+		return *out.batch, int(out.batch.Seq - out.batch.First() + 1), true
+	}
+
+	changes := out.queue.Peek(out.config.batchSize)
+	if len(changes) == 0 {
+		return db.Change{}, 0, false
+	}
+
+	batch := db.Change{Seq: changes[0].Seq, Term: changes[0].Term, Updates: make(map[string]int)}
+
+	size := 0
+	for _, change := range changes {
+		// seqs only follow each other within a term
+		if change.Term != batch.Term || (size > 0 && change.First() != batch.Seq+1) {
+			break
+		}
+
+		for word, count := range change.Updates {
+			batch.Updates[word] += count
+		}
+
+		batch.Seq = change.Seq
+		size++
+	}
+
+	if size > 1 {
+		batch.FirstSeq = changes[0].First()
+	}
+
+	out.batch = &batch
+
+	return batch, size, true
+}
+
+// isEjected returns whether the replica was ejected for missing the
+// heartbeats.
+func (out *outbox) isEjected() bool {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	return out.ejected
+}
+
+// heartbeat checks the replica every heartbeatInterval, ejecting it once it
+// missed heartbeatMisses checks and admitting it again once it answers.
+func (out *outbox) heartbeat() {
+	defer out.workers.Done()
+
+	ticker := time.NewTicker(out.config.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-out.done:
+			return
+		}
+
+		err := out.probe()
+
+		out.lock.Lock()
+		out.lastHeartbeat = time.Now()
+
+		switch {
+		case err == nil && out.ejected:
+			out.ejected = false
+			out.misses = 0
+			out.lock.Unlock()
+
+			replicationMetrics.Add("readmissions", 1)
+			out.logger.Info("replica is back, admitting it again and resyncing it")
+
+			out.notify()
+
+			continue
+		case err == nil:
+			out.misses = 0
+		case !out.ejected:
+			out.misses++
+
+			if out.misses >= out.config.heartbeatMisses {
+				out.ejected = true
+				out.needsResync = true
+				out.batch = nil
+				out.lock.Unlock()
+
+				replicationMetrics.Add("ejections", 1)
+				out.logger.Warn("replica missed too many heartbeats, ejecting it", "misses", out.config.heartbeatMisses, "error", err)
+
+				if err := out.queue.Clear(); err != nil {
+					out.logger.Error("failed to clear replication queue", "error", err)
+				}
+
+				continue
+			}
+		}
+
+		out.lock.Unlock()
+	}
+}
+
+// recordFailure counts a failed delivery attempt.
+func (out *outbox) recordFailure(err error) {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	out.errors++
+	out.lastFailure = time.Now()
+	out.lastError = err.Error()
+}
+
+// replicaStatus is the state of the replication to a replica, as served by
+// GET /replicas.
+type replicaStatus struct {
+	Replica string `json:"replica"`
+	// active, or ejected while it misses the heartbeats
+	State string `json:"state"`
+	// whether the last delivery attempt succeeded
+	Alive bool `json:"alive"`
+	// position of the last update the replica acknowledged
+	AckedSeq  uint64 `json:"acked_seq"`
+	AckedTerm uint64 `json:"acked_term"`
+	// changes made by the leader since the last acknowledged update
+	Lag         uint64     `json:"lag"`
+	QueueDepth  int        `json:"queue_depth"`
+	NeedsResync bool       `json:"needs_resync"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Errors      uint64     `json:"errors"`
+	// heartbeats missed in a row
+	HeartbeatMisses int        `json:"heartbeat_misses"`
+	LastHeartbeat   *time.Time `json:"last_heartbeat,omitempty"`
+}
+
+// status returns the replication state of the replica, the leader being at
+// seq of term.
+func (out *outbox) status(term uint64, seq uint64) replicaStatus {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	status := replicaStatus{
+		Replica:         out.replica,
+		State:           "active",
+		Alive:           !out.ejected && !out.lastSuccess.IsZero() && out.lastSuccess.After(out.lastFailure),
+		AckedSeq:        out.ackedSeq,
+		AckedTerm:       out.ackedTerm,
+		QueueDepth:      out.queue.Len(),
+		NeedsResync:     out.needsResync,
+		LastError:       out.lastError,
+		Errors:          out.errors,
+		HeartbeatMisses: out.misses,
+	}
+
+	if out.ejected {
+		status.State = "ejected"
+	}
+
+	// seqs of another term can't be compared
+	switch {
+	case out.ackedTerm != term:
+		status.Lag = seq
+	case out.ackedSeq < seq:
+		status.Lag = seq - out.ackedSeq
+	}
+
+	if !out.lastSuccess.IsZero() {
+		lastSuccess := out.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+
+	if !out.lastFailure.IsZero() {
+		lastFailure := out.lastFailure
+		status.LastFailure = &lastFailure
+	}
+
+	if !out.lastHeartbeat.IsZero() {
+		lastHeartbeat := out.lastHeartbeat
+		status.LastHeartbeat = &lastHeartbeat
+	}
+
+	return status
+}
+
+// recordBatch counts a batch of size changes delivered to a replica.
+func recordBatch(size int) {
+	replicationMetrics.Add("batches", 1)
+	replicationMetrics.Add("changes", int64(size))
+
+	bucket := "batch_size_inf"
+	for _, bound := range batchSizeBuckets {
+		if size <= bound {
+			bucket = fmt.Sprintf("batch_size_le_%d", bound)
+			break
+		}
+	}
+
+	replicationMetrics.Add(bucket, 1)
+}
+
+// close stops the deliveries, the changes left are kept by a durable queue.
+func (out *outbox) close() error {
+	close(out.done)
+	out.workers.Wait()
+
+	return out.queue.Close()
+}
+
+// retryDelay is the exponential backoff of the given attempt, with jitter so
+// that the retries of several changes or replicas don't line up.
+func retryDelay(attempt int) time.Duration {
+	delay := maxRetryDelay
+	if attempt < 16 {
+		delay = min(minRetryDelay<<attempt, maxRetryDelay)
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// statusError turns an unexpected replica response into an error.
+func statusError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf("%w: status code %d", errRejected, resp.StatusCode)
+	}
+
+	return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
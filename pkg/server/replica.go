@@ -4,44 +4,257 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"log/slog"
 	"memdb/pkg/db"
 	dbErrs "memdb/pkg/errors"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// longest health check and join request to the leader
+	leaderRequestTimeout = 10 * time.Second
+	// longest sync from the leader, snapshots can take a while to download
+	syncTimeout = 5 * time.Minute
+)
+
 type ReplicaServer struct {
 	leader string
 	db     db.Replica
 	port   string
 	server *http.Server
 	logger *slog.Logger
+	// orders the changes pushed by the leader
+	inbox *inbox
+	// set while a resync runs, resyncAgain when another one was requested
+	// meanwhile
+	resyncLock  sync.Mutex
+	resyncing   bool
+	resyncAgain bool
+	// base URL the replica joins the leader with, it doesn't join when empty
+	advertiseURL string
+	// set once the leader added the replica
+	joined bool
+	// requests to the leader, and the syncs which can take longer
+	client     *http.Client
+	syncClient *http.Client
+	// whether the leader pushes the changes or the replica pulls them, it
+	// switches to pull when the leader refuses to push them
+	modeLock sync.Mutex
+	mode     ReplicationMode
+	// how often the word counts are compared with the leader ones, never
+	// when 0
+	antiEntropyInterval time.Duration
+	// serves the downstream replicas syncing from this one, nil unless
+	// enabled
+	upstream *upstream
+	// largest update accepted, once decompressed
+	maxBodySize int64
+	// set once the replica holds a leader state, resumed from disk or synced:
+	// until then it reports itself unhealthy and refuses reads rather than
+	// serve empty word counts
+	ready atomic.Bool
+	// canceled on shutdown, ends the stream from the leader and the
+	// anti-entropy
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewReplicaServer(replica db.Replica, port string, leader string, logger *slog.Logger) *ReplicaServer {
-	return &ReplicaServer{
-		db:     replica,
-		leader: leader,
-		port:   port,
-		logger: logger,
+	sv := &ReplicaServer{
+		db:                  replica,
+		leader:              leader,
+		port:                port,
+		logger:              logger,
+		client:              &http.Client{Timeout: leaderRequestTimeout},
+		syncClient:          &http.Client{Timeout: syncTimeout},
+		mode:                DefaultReplicationMode,
+		antiEntropyInterval: DefaultAntiEntropyInterval,
+		maxBodySize:         DefaultMaxBodySize,
+	}
+
+	sv.ctx, sv.cancel = context.WithCancel(context.Background())
+
+	sv.inbox = newInbox(replica, logger, sv.scheduleResync, sv.changesApplied)
+
+	return sv
+}
+
+// SetAdvertiseURL makes the replica join the leader with the given base URL,
+// the one the leader reaches it at, before it first syncs.
+func (sv *ReplicaServer) SetAdvertiseURL(advertiseURL string) {
+	sv.advertiseURL = advertiseURL
+}
+
+// SetReplicationMode sets whether the leader pushes the changes to the
+// replica or the replica pulls them from the leader's /stream route. A pulling
+// replica doesn't join the leader.
+func (sv *ReplicaServer) SetReplicationMode(mode ReplicationMode) {
+	sv.modeLock.Lock()
+	defer sv.modeLock.Unlock()
+
+	sv.mode = mode
+}
+
+// replicationMode returns whether the leader pushes the changes or the
+// replica pulls them.
+func (sv *ReplicaServer) replicationMode() ReplicationMode {
+	sv.modeLock.Lock()
+	defer sv.modeLock.Unlock()
+
+	return sv.mode
+}
+
+// switchToPull makes the replica pull the changes from the leader /stream,
+// when the leader refused to push them: a replica serving downstream replicas
+// only streams the changes.
+func (sv *ReplicaServer) switchToPull() {
+	sv.modeLock.Lock()
+	defer sv.modeLock.Unlock()
+
+	if sv.mode == ReplicationPull {
+		return
+	}
+
+	sv.mode = ReplicationPull
+
+	sv.logger.Warn("leader refused to push the changes, pulling them from its /stream instead; set replication_mode = pull",
+		"leader", sv.leader)
+
+	go sv.pull()
+}
+
+// SetAntiEntropyInterval sets how often the replica compares the digest of
+// its word counts with the leader one and repairs the words that differ,
+// never when interval is 0.
+func (sv *ReplicaServer) SetAntiEntropyInterval(interval time.Duration) {
+	sv.antiEntropyInterval = interval
+}
+
+// SetMaxBodySize sets the largest update accepted from the leader, in bytes
+// once decompressed.
+func (sv *ReplicaServer) SetMaxBodySize(size int64) {
+	sv.maxBodySize = size
+}
+
+// SetServeDownstream makes the replica an upstream for other replicas: it
+// serves /sync, /stream and the digests like the leader does, from its own
+// state, so that replicas can be chained into a tree and the leader load
+// doesn't grow with the replicas. Downstream replicas pull the changes, the
+// replica doesn't push them. The replica db keeps a changelog for them to
+// catch up from.
+func (sv *ReplicaServer) SetServeDownstream(enabled bool) {
+	sv.upstream = nil
+	if enabled {
+		sv.upstream = newUpstream(sv.db, sv.logger)
+	}
+}
+
+// changesApplied wakes up the downstream replicas streaming the changes.
+func (sv *ReplicaServer) changesApplied() {
+	if sv.upstream != nil {
+		sv.upstream.streams.notify()
+	}
+}
+
+// join asks the leader to replicate to the replica. It must happen before
+// the replica syncs: the changes made after the snapshot are then pushed to
+// it. Only called from the resync goroutine.
+func (sv *ReplicaServer) join() error {
+	if sv.advertiseURL == "" || sv.joined || sv.replicationMode() == ReplicationPull {
+		return nil
+	}
+
+	resp, err := sv.client.PostForm(sv.leader+"/replicas/join", url.Values{"url": {sv.advertiseURL}})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		// the changes would never be pushed
+		sv.switchToPull()
+
+		return nil
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
 	}
+
+	sv.joined = true
+
+	sv.logger.Info("joined leader", "leader", sv.leader, "url", sv.advertiseURL)
+
+	return nil
 }
 
-func (sv *ReplicaServer) requestLeaderSync() error {
+// syncFromLeader brings the replica up to date with the leader. A replica
+// with a position only asks for the changes made since, the leader replies
+// with a full snapshot when it no longer has all of them, and with a 304 when
+// there are none.
+func (sv *ReplicaServer) syncFromLeader() error {
 	// wait for leader to become available before syncing
 	for {
-		resp, err := http.Get(sv.leader + "/health")
-		if err == nil && resp.StatusCode == http.StatusOK {
-			break
+		resp, err := sv.client.Get(sv.leader + "/health")
+		if err == nil {
+			resp.Body.Close()
+
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
 		}
 
 		sv.logger.Info("waiting for leader to become available...", "leader", sv.leader)
-		time.Sleep(2 * time.Second)
+
+		select {
+		case <-sv.ctx.Done():
+			return sv.ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	if err := sv.join(); err != nil {
+		// tried again on the next resync
+		sv.logger.Error("failed to join leader, no update will be received", "leader", sv.leader, "error", err)
+	}
+
+	position, term := sv.db.Position(), sv.db.Term()
+
+	query := url.Values{}
+	if position > 0 {
+		query.Set("since", strconv.FormatUint(position, 10))
+		query.Set("term", strconv.FormatUint(term, 10))
+	}
+
+	syncURL := sv.leader + "/sync"
+	if len(query) > 0 {
+		syncURL += "?" + query.Encode()
 	}
 
-	resp, err := http.Get(sv.leader + "/sync")
+	req, err := http.NewRequest(http.MethodGet, syncURL, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", db.SnapshotContentType+", application/json")
+	// Accept-Encoding is left to the transport, which asks for gzip and
+	// transparently decompresses the response
+
+	if position > 0 {
+		req.Header.Set("If-None-Match", positionETag(term, position))
+	}
+
+	resp, err := sv.syncClient.Do(req)
 	if err != nil {
 		sv.logger.Error("failed to make GET request to sync from leader", "leader", sv.leader, "error", err)
 
@@ -50,40 +263,198 @@ func (sv *ReplicaServer) requestLeaderSync() error {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		sv.logger.Info("local state is up to date with leader", "leader", sv.leader, "seq", position)
+
+		sv.inbox.caughtUp()
+
+		return nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		sv.logger.Error("failed to sync from leader", "leader", sv.leader, "status_code", resp.StatusCode)
 
 		return dbErrs.ErrorOnSync
 	}
 
-	wordsCounts := make(map[string]int)
+	if resp.Header.Get("Content-Type") == changesContentType {
+		var changes []db.Change
+
+		if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+			sv.logger.Error("failed to decode changes from leader", "leader", sv.leader, "error", err)
+
+			return err
+		}
+
+		for _, change := range changes {
+			sv.inbox.push(change)
+		}
+
+		sv.logger.Info("caught up with leader", "leader", sv.leader, "since", position, "changes", len(changes))
+
+		return nil
+	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&wordsCounts); err != nil {
-		sv.logger.Error("failed to decode sync response from leader", "leader", sv.leader, "status_code", resp.StatusCode)
+	snap, err := decodeSyncResponse(resp)
+	if err != nil {
+		sv.logger.Error("failed to decode sync response from leader", "leader", sv.leader, "error", err)
 
 		return err
 	}
 
-	sv.db.SetWordsCounts(wordsCounts)
+	sv.inbox.reset(snap)
+
+	sv.logger.Info("synced from leader", "leader", sv.leader, "seq", snap.Seq, "term", snap.Term)
 
 	return nil
 }
 
+// scheduleResync fully resyncs from the leader in the background. Resyncs
+// requested while one runs are folded into a single one after it, as the
+// running one may have fetched the leader state from before the request.
+func (sv *ReplicaServer) scheduleResync(reason string) {
+	sv.resyncLock.Lock()
+	defer sv.resyncLock.Unlock()
+
+	if sv.resyncing {
+		sv.resyncAgain = true
+		return
+	}
+
+	sv.resyncing = true
+
+	go func() {
+		for {
+			sv.logger.Info("resyncing from leader", "reason", reason)
+
+			err := sv.syncFromLeader()
+			if err != nil && sv.ctx.Err() == nil {
+				sv.logger.Error("failed to resync from leader", "error", err)
+			}
+
+			if err == nil && !sv.ready.Swap(true) {
+				sv.logger.Info("replica is ready, synced from leader")
+			}
+
+			sv.resyncLock.Lock()
+
+			// no resync requested meanwhile, or shut down
+			if !sv.resyncAgain || sv.ctx.Err() != nil {
+				sv.resyncing = false
+				sv.resyncLock.Unlock()
+
+				return
+			}
+
+			sv.resyncAgain = false
+			sv.resyncLock.Unlock()
+
+			reason = "requested during the previous resync"
+		}
+	}()
+}
+
+// isResyncing returns whether a resync runs.
+func (sv *ReplicaServer) isResyncing() bool {
+	sv.resyncLock.Lock()
+	defer sv.resyncLock.Unlock()
+
+	return sv.resyncing
+}
+
+// decodeSyncResponse reads the snapshot from a /sync response in either the
+// binary snapshot or the JSON format.
+func decodeSyncResponse(resp *http.Response) (db.Snapshot, error) {
+	if resp.Header.Get("Content-Type") != db.SnapshotContentType {
+		snap := db.Snapshot{WordCount: make(map[string]int)}
+
+		if err := json.NewDecoder(resp.Body).Decode(&snap.WordCount); err != nil {
+			return db.Snapshot{}, err
+		}
+
+		// positions are only carried by the headers of the JSON format
+		snap.Seq, _ = strconv.ParseUint(resp.Header.Get(seqHeader), 10, 64)
+		snap.Term, _ = strconv.ParseUint(resp.Header.Get(termHeader), 10, 64)
+
+		return snap, nil
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return db.Snapshot{}, err
+	}
+
+	// the entries are read from the payload when the replica is reset,
+	// rather than loaded in a map first
+	return db.OpenSnapshot(data)
+}
+
 func (sv *ReplicaServer) updateHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// let the leader know it can compress the next updates
+		w.Header().Set("Accept-Encoding", "gzip")
+
+		body, err := requestBody(w, r, sv.maxBodySize)
+		if err != nil {
+			sv.logger.Error("failed to decode update request body", "error", err)
+
+			http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+
+			return
+		}
+
+		defer body.Close()
+
+		seq, err := strconv.ParseUint(r.Header.Get(seqHeader), 10, 64)
+		if err != nil || seq == 0 {
+			http.Error(w, "missing or invalid "+seqHeader+" header", http.StatusBadRequest)
+			return
+		}
+
+		term, err := strconv.ParseUint(r.Header.Get(termHeader), 10, 64)
+		if err != nil {
+			http.Error(w, "missing or invalid "+termHeader+" header", http.StatusBadRequest)
+			return
+		}
+
+		// set when the update merges several changes
+		var firstSeq uint64
+		if header := r.Header.Get(firstSeqHeader); header != "" {
+			firstSeq, err = strconv.ParseUint(header, 10, 64)
+			if err != nil || firstSeq == 0 || firstSeq > seq {
+				http.Error(w, "invalid "+firstSeqHeader+" header", http.StatusBadRequest)
+				return
+			}
+		}
+
 		updates := make(map[string]int)
 
-		if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		if err := json.NewDecoder(body).Decode(&updates); err != nil {
 			sv.logger.Error("failed to serialize sync response body", "error", err)
 
+			if bodyTooLarge(err) {
+				http.Error(w, "update too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
 			http.Error(w, "invalid sync request", http.StatusBadRequest)
 
 			return
 		}
 
-		for key, val := range updates {
-			sv.db.AddWordCount(key, val)
-		}
+		sv.inbox.push(db.Change{Seq: seq, Term: term, FirstSeq: firstSeq, Updates: updates})
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// POST handler for the leader to request a full resync, e.g. after its state
+// was restored from an older snapshot
+func (sv *ReplicaServer) resyncHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sv.logger.Info("POST /resync (full resync request)")
+
+		sv.scheduleResync("requested by leader")
 
 		w.WriteHeader(http.StatusAccepted)
 	})
@@ -91,6 +462,11 @@ func (sv *ReplicaServer) updateHandler() http.Handler {
 
 func (sv *ReplicaServer) getHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sv.ready.Load() {
+			http.Error(w, "replica has not synced from the leader yet", http.StatusServiceUnavailable)
+			return
+		}
+
 		word := r.URL.Query().Get("word")
 		if word == "" {
 			w.WriteHeader(http.StatusBadRequest)
@@ -121,35 +497,146 @@ func (sv *ReplicaServer) getHandler() http.Handler {
 	})
 }
 
+// GET handler reporting the position of the replica and how long ago the
+// leader last sent something
+func (sv *ReplicaServer) statusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pending, lastUpdate := sv.inbox.state()
+
+		status := struct {
+			Leader    string          `json:"leader"`
+			Mode      ReplicationMode `json:"mode"`
+			Seq       uint64          `json:"seq"`
+			Term      uint64          `json:"term"`
+			Pending   int             `json:"pending"`
+			Resyncing bool            `json:"resyncing"`
+			Ready     bool            `json:"ready"`
+			// nothing was received from the leader yet when unset
+			LastUpdate       *time.Time `json:"last_update,omitempty"`
+			StalenessSeconds float64    `json:"staleness_seconds,omitempty"`
+		}{
+			Leader:    sv.leader,
+			Mode:      sv.replicationMode(),
+			Seq:       sv.db.Position(),
+			Term:      sv.db.Term(),
+			Pending:   pending,
+			Resyncing: sv.isResyncing(),
+			Ready:     sv.ready.Load(),
+		}
+
+		if !lastUpdate.IsZero() {
+			status.LastUpdate = &lastUpdate
+			status.StalenessSeconds = time.Since(lastUpdate).Seconds()
+		}
+
+		data, err := json.Marshal(status)
+		if err != nil {
+			http.Error(w, "failed to serialize status", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		if _, err = w.Write(data); err != nil {
+			sv.logger.Error("failed to send status", "error", err)
+		}
+	})
+}
+
+// POST handler refusing the downstream replicas that want the changes pushed,
+// they have to pull them from /stream
+func (sv *ReplicaServer) joinHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sv.logger.Warn("POST /replicas/join (refused, downstream replicas must pull the changes)")
+
+		http.Error(w, "replicas syncing from a replica must pull the changes, set replication_mode = pull", http.StatusConflict)
+	})
+}
+
+// GET handler replying with a 503 until the replica holds a leader state, so
+// that load balancers and downstream replicas wait for its first sync
 func (sv *ReplicaServer) healthHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sv.ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 	})
 }
 
 func (sv *ReplicaServer) RunServer() {
+	// listen before syncing so that no update pushed meanwhile is refused: the
+	// inbox holds them back and applies the ones newer than the snapshot on
+	// top of it, the others are already part of it
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", sv.port))
+	if err != nil {
+		sv.logger.Error("failed to start server", "error", err)
+		return
+	}
+
+	sv.Serve(listener)
+}
+
+// Serve is RunServer on a listener of the caller, such as one on an ephemeral
+// port. It syncs from the leader once the listener accepts connections.
+func (sv *ReplicaServer) Serve(listener net.Listener) {
 	router := http.NewServeMux()
 
 	router.Handle("/health", recoverMiddleware(sv.healthHandler()))
 	router.Handle("/wordcount", recoverMiddleware(sv.getHandler()))
 	router.Handle("/update", recoverMiddleware(sv.updateHandler()))
+	router.Handle("/resync", recoverMiddleware(sv.resyncHandler()))
+	router.Handle("/status", recoverMiddleware(sv.statusHandler()))
+	router.Handle("/debug/vars", expvar.Handler())
+
+	if sv.upstream != nil {
+		sv.upstream.route(router)
+		router.Handle("/replicas/join", recoverMiddleware(sv.joinHandler()))
+	}
 
 	sv.server = &http.Server{
-		Addr:    fmt.Sprintf(":%s", sv.port),
+		Addr:    listener.Addr().String(),
 		Handler: router,
 	}
 
-	if err := sv.requestLeaderSync(); err != nil {
-		sv.logger.Error("failed to sync from leader, running out of sync", "error", err)
+	if sv.upstream != nil {
+		// streams don't end on their own
+		sv.server.RegisterOnShutdown(sv.upstream.streams.close)
 	}
 
-	sv.logger.Info("server listening", "port", sv.port)
+	// read before the first resync, which switches the mode when the leader
+	// refuses the join
+	pulling := sv.replicationMode() == ReplicationPull
+
+	if sv.db.Position() > 0 {
+		// resumed from local state: serve it right away, even if the leader
+		// is down, and catch up in the background
+		sv.ready.Store(true)
+		sv.scheduleResync("catching up from local state")
+	} else {
+		sv.scheduleResync("bootstrapping")
+	}
 
-	if err := sv.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	if pulling {
+		go sv.pull()
+	}
+
+	if sv.antiEntropyInterval > 0 {
+		go sv.antiEntropy()
+	}
+
+	sv.logger.Info("server listening", "address", sv.server.Addr)
+
+	if err := sv.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
 		sv.logger.Error("failed to start server", "error", err)
 	}
 }
 
 func (sv *ReplicaServer) Shutdown(ctx context.Context) error {
+	sv.cancel()
+
 	return sv.server.Shutdown(ctx)
 }
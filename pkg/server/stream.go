@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"memdb/pkg/db"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplicationMode is how a replica receives the leader changes.
+type ReplicationMode string
+
+const (
+	// the leader pushes the changes to the replica's /update route
+	ReplicationPush ReplicationMode = "push"
+	// the replica pulls them from the leader's /stream route, so that the
+	// leader doesn't need to reach it
+	ReplicationPull ReplicationMode = "pull"
+
+	DefaultReplicationMode = ReplicationPush
+
+	// Content-Type of /stream, a JSON change per line
+	streamContentType = "application/x-ndjson"
+	// how often an idle stream sends an empty line, so that it isn't closed
+	// by proxies and the replica can tell the leader is still there
+	streamKeepAlive = 15 * time.Second
+	// how long a replica waits for a line before it reconnects
+	streamIdleTimeout = 3 * streamKeepAlive
+	// longest line of a stream, a change of the longest text fits
+	maxStreamLine = 16 << 20
+)
+
+// errStreamTruncated is a stream position the leader no longer has the
+// changes after.
+var errStreamTruncated = errors.New("stream position is not in the leader changelog")
+
+// ParseReplicationMode validates a replication mode name, an empty name means
+// the default.
+func ParseReplicationMode(name string) (ReplicationMode, error) {
+	switch ReplicationMode(name) {
+	case "":
+		return DefaultReplicationMode, nil
+	case ReplicationPush, ReplicationPull:
+		return ReplicationMode(name), nil
+	default:
+		return "", fmt.Errorf("unknown replication mode %q, expected push or pull", name)
+	}
+}
+
+// broadcast wakes up the streams waiting for new changes.
+type broadcast struct {
+	lock sync.Mutex
+	// closed and replaced on every notify
+	wake chan struct{}
+	// closed when the streams must end
+	done chan struct{}
+	once sync.Once
+}
+
+func newBroadcast() *broadcast {
+	return &broadcast{wake: make(chan struct{}), done: make(chan struct{})}
+}
+
+// wait returns a channel closed on the next notify, it must be called before
+// looking for the changes so that none is missed.
+func (b *broadcast) wait() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.wake
+}
+
+// notify wakes up the streams.
+func (b *broadcast) notify() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// close ends the streams.
+func (b *broadcast) close() {
+	b.once.Do(func() {
+		close(b.done)
+	})
+}
+
+// GET handler streaming the changes made after the since position of term,
+// then every new one as it is made, as a JSON change per line. Replies 410
+// when the node no longer has all the changes after the position: the
+// replica syncs from /sync first. The stream ends when the node moves to
+// another term, the replica reconnects and gets a 410 then.
+func (up *upstream) streamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seq, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "missing or invalid since position", http.StatusBadRequest)
+			return
+		}
+
+		term, _ := strconv.ParseUint(r.URL.Query().Get("term"), 10, 64)
+
+		wake := up.streams.wait()
+
+		changes, err := up.db.ChangesSince(term, seq)
+		if err != nil {
+			up.logger.Info("stream position is not in the changelog", "since", seq, "term", term, "error", err)
+
+			http.Error(w, errStreamTruncated.Error(), http.StatusGone)
+
+			return
+		}
+
+		up.logger.Info("GET /stream (replica streaming changes)", "since", seq, "term", term)
+
+		replicationMetrics.Add("streams", 1)
+		defer replicationMetrics.Add("streams", -1)
+
+		flusher, _ := w.(http.Flusher)
+
+		w.Header().Set("Content-Type", streamContentType)
+		w.Header().Set(seqHeader, strconv.FormatUint(seq, 10))
+		w.Header().Set(termHeader, strconv.FormatUint(term, 10))
+		w.WriteHeader(http.StatusOK)
+
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+
+		encoder := json.NewEncoder(w)
+
+		for {
+			for _, change := range changes {
+				if err := encoder.Encode(change); err != nil {
+					up.logger.Info("replica stream closed", "seq", seq, "error", err)
+					return
+				}
+
+				seq = change.Seq
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			select {
+			case <-wake:
+			case <-keepAlive.C:
+				if _, err := w.Write([]byte("\n")); err != nil {
+					return
+				}
+
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			case <-up.streams.done:
+				return
+			}
+
+			wake = up.streams.wait()
+
+			if changes, err = up.db.ChangesSince(term, seq); err != nil {
+				// the replica was too slow or the node moved to another
+				// term, it resumes from /sync
+				up.logger.Info("ending replica stream", "seq", seq, "term", term, "error", err)
+				return
+			}
+		}
+	})
+}
+
+// pull streams the leader changes into the inbox until the replica is shut
+// down, reconnecting from the replica position whenever the stream ends.
+func (sv *ReplicaServer) pull() {
+	attempt := 0
+
+	for {
+		select {
+		case <-sv.ctx.Done():
+			return
+		default:
+		}
+
+		if sv.isResyncing() {
+			// the stream resumes from the position the resync reaches
+			time.Sleep(minRetryDelay)
+			continue
+		}
+
+		err := sv.stream()
+
+		switch {
+		case sv.ctx.Err() != nil:
+			return
+		case errors.Is(err, errStreamTruncated):
+			sv.logger.Warn("leader no longer has the changes to stream, resyncing", "leader", sv.leader)
+			sv.scheduleResync("stream position truncated")
+
+			attempt = 0
+
+			continue
+		case err != nil:
+			sv.logger.Error("stream from leader failed, reconnecting", "leader", sv.leader, "error", err)
+		default:
+			sv.logger.Info("stream from leader ended, reconnecting", "leader", sv.leader)
+
+			attempt = 0
+		}
+
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-sv.ctx.Done():
+			return
+		}
+
+		attempt++
+	}
+}
+
+// stream reads the leader changes from the replica position on, until the
+// leader ends the stream or stays silent for streamIdleTimeout.
+func (sv *ReplicaServer) stream() error {
+	ctx, cancel := context.WithCancel(sv.ctx)
+	defer cancel()
+
+	position, term := sv.db.Position(), sv.db.Term()
+
+	query := url.Values{}
+	query.Set("since", strconv.FormatUint(position, 10))
+	query.Set("term", strconv.FormatUint(term, 10))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sv.leader+"/stream?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	// no client timeout, it would cut the stream: the idle timer ends it
+	// when the leader goes silent instead
+	idle := time.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errStreamTruncated
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	sv.logger.Info("streaming from leader", "leader", sv.leader, "since", position, "term", term)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxStreamLine)
+
+	for scanner.Scan() {
+		idle.Reset(streamIdleTimeout)
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			// keep-alive
+			continue
+		}
+
+		var change db.Change
+		if err := json.Unmarshal(line, &change); err != nil {
+			return fmt.Errorf("invalid change from leader: %w", err)
+		}
+
+		sv.inbox.push(change)
+	}
+
+	if ctx.Err() != nil && sv.ctx.Err() == nil {
+		return errors.New("leader stream went silent")
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"memdb/pkg/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// a full sync holds a frozen view of the engine while it is written: a
+	// replica that stops reading it for syncStallTimeout, or is still reading
+	// it after syncWriteTimeout, gets a truncated body and the view is
+	// released
+	syncStallTimeout = 30 * time.Second
+	syncWriteTimeout = syncTimeout
+)
+
+// upstream serves the routes replicas sync from: /sync, /stream and the
+// digests of the anti-entropy. It is served by the leader, and by the
+// replicas serving downstream replicas so that replication forms a tree.
+type upstream struct {
+	db     db.Upstream
+	logger *slog.Logger
+	// wakes up the replicas streaming the changes
+	streams *broadcast
+}
+
+func newUpstream(source db.Upstream, logger *slog.Logger) *upstream {
+	return &upstream{db: source, logger: logger, streams: newBroadcast()}
+}
+
+// route serves the upstream routes on router.
+func (up *upstream) route(router *http.ServeMux) {
+	router.Handle("/sync", recoverMiddleware(up.syncReplicaHandler()))
+	router.Handle("/stream", recoverMiddleware(up.streamHandler()))
+	router.Handle("/digest", recoverMiddleware(up.digestHandler()))
+	router.Handle("/digest/buckets", recoverMiddleware(up.digestBucketsHandler()))
+}
+
+// GET handler for replica sync, replies with a binary snapshot when the
+// replica accepts it and with a JSON map otherwise. The ETag is the term and
+// position of the snapshot, a replica resuming from local state sends it back
+// through If-None-Match and gets a 304 when it is up to date.
+//
+// With ?since=<seq>&term=<term> only the changes made after that position are
+// sent, as long as the node still has all of them; it falls back to a full
+// snapshot otherwise.
+func (up *upstream) syncReplicaHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if since := r.URL.Query().Get("since"); since != "" {
+			seq, err := strconv.ParseUint(since, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid since position", http.StatusBadRequest)
+				return
+			}
+
+			term, _ := strconv.ParseUint(r.URL.Query().Get("term"), 10, 64)
+
+			changes, err := up.db.ChangesSince(term, seq)
+			if err == nil {
+				up.logger.Info("GET /sync (replica incremental sync request)", "since", seq, "changes", len(changes))
+
+				up.sendChanges(w, r, term, seq, changes)
+
+				return
+			}
+
+			up.logger.Info("position is not in the changelog, sending a full snapshot", "since", seq, "term", term, "error", err)
+		}
+
+		up.logger.Info("GET /sync (replica full sync request)")
+
+		// streamed from the node engine rather than copied, so that a full
+		// sync doesn't need memory for the whole vocabulary
+		snap, release := up.db.View()
+		defer release()
+
+		etag := positionETag(snap.Term, snap.Seq)
+		w.Header().Set("ETag", etag)
+		w.Header().Set(seqHeader, strconv.FormatUint(snap.Seq, 10))
+		w.Header().Set(termHeader, strconv.FormatUint(snap.Term, 10))
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		write := func(body io.Writer) error {
+			return writeJSONEntries(body, snap.Entries())
+		}
+
+		contentType := "application/json"
+		if strings.Contains(r.Header.Get("Accept"), db.SnapshotContentType) {
+			contentType = db.SnapshotContentType
+			write = func(body io.Writer) error {
+				return up.db.WriteSnapshot(body, snap)
+			}
+		}
+
+		body := newDeadlineWriter(w, syncStallTimeout, time.Now().Add(syncWriteTimeout))
+		defer body.clear()
+
+		// the status is sent by then, a truncated body fails the replica
+		// checks
+		if err := streamBody(body, r, contentType, write); err != nil {
+			up.logger.Error("failed to send sync data to replica", "error", err)
+		}
+	})
+}
+
+// deadlineWriter pushes the write deadline of a response forward on every
+// write, by stall and up to last, so that a client that stops reading makes
+// the writes fail rather than hold the handler.
+type deadlineWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	stall      time.Duration
+	last       time.Time
+}
+
+func newDeadlineWriter(w http.ResponseWriter, stall time.Duration, last time.Time) *deadlineWriter {
+	return &deadlineWriter{ResponseWriter: w, controller: http.NewResponseController(w), stall: stall, last: last}
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	deadline := time.Now().Add(w.stall)
+	if deadline.After(w.last) {
+		deadline = w.last
+	}
+
+	if err := w.controller.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return 0, err
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// clear removes the deadline, which would otherwise outlive the response on a
+// kept-alive connection.
+func (w *deadlineWriter) clear() {
+	w.controller.SetWriteDeadline(time.Time{})
+}
+
+// sendChanges replies to an incremental sync from position seq of term with
+// the changes made since, in seq order, and with a 304 when there are none.
+func (up *upstream) sendChanges(w http.ResponseWriter, r *http.Request, term uint64, seq uint64, changes []db.Change) {
+	if len(changes) > 0 {
+		seq = changes[len(changes)-1].Seq
+	}
+
+	w.Header().Set("ETag", positionETag(term, seq))
+	w.Header().Set(seqHeader, strconv.FormatUint(seq, 10))
+	w.Header().Set(termHeader, strconv.FormatUint(term, 10))
+
+	if len(changes) == 0 {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := json.Marshal(changes)
+	if err != nil {
+		http.Error(w, "failed to serialize changes", http.StatusInternalServerError)
+		return
+	}
+
+	if err = writeBody(w, r, changesContentType, data); err != nil {
+		up.logger.Error("failed to send changes to replica", "error", err)
+	}
+}
@@ -8,73 +8,67 @@ import (
 	"memdb/pkg/db"
 	"memdb/pkg/server"
 	"net/http"
-	"net/url"
 	"os"
 	"testing"
-	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
-var (
-	leaderPort    = "9090"
-	leaderAddress = fmt.Sprintf("http://localhost:%s", leaderPort)
+// startServers starts a leader and three replicas on ephemeral ports and
+// returns their addresses once the replicas are synced.
+func startServers(t *testing.T) (string, []string, func()) {
+	t.Helper()
 
-	replicasPort = []string{"9091", "9092", "9093"}
-)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-// Start the server in a separate goroutine
-func startServers() func() {
-	tmpDir, err := os.CreateTemp("/tmp", "memdb-*")
+	leaderDB, err := db.NewLeader(t.TempDir(), logger)
 	if err != nil {
-		panic(err)
+		t.Fatalf("failed to create leader: %v", err)
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	listener, leaderAddress := listen(t)
 
-	leaderDB := db.NewLeader(tmpDir.Name(), logger)
+	leader := server.NewLeaderServer(leaderDB, "0", logger)
+	go leader.Serve(listener)
 
-	leader := server.NewLeaderServer(leaderDB, leaderPort, logger)
-	go func() {
-		leader.RunServer()
-	}()
+	replicas := []*server.ReplicaServer{}
+	replicaAddresses := []string{}
 
-	time.Sleep(1 * time.Second)
+	for i := 0; i < 3; i++ {
+		replicaListener, replicaAddress := listen(t)
 
-	replicas := []*server.ReplicaServer{}
-	for _, port := range replicasPort {
 		replicaDB := db.NewReplica(logger)
-		replicaServer := server.NewReplicaServer(replicaDB, port, leaderAddress, logger)
+		replicaServer := server.NewReplicaServer(replicaDB, "0", leaderAddress, logger)
 
 		replicas = append(replicas, replicaServer)
+		replicaAddresses = append(replicaAddresses, replicaAddress)
+
+		leader.AddReplica(replicaAddress)
 
-		leader.AddReplica(fmt.Sprintf("http://localhost:%s", port))
+		go replicaServer.Serve(replicaListener)
+	}
 
-		go func() {
-			replicaServer.RunServer()
-		}()
+	for _, address := range replicaAddresses {
+		if !eventually(func() bool { return healthy(address) }) {
+			t.Fatalf("replica %s didn't sync from the leader", address)
+		}
 	}
 
-	return func() {
+	return leaderAddress, replicaAddresses, func() {
 		leader.Shutdown(context.Background())
+		leaderDB.Close()
 		for _, replica := range replicas {
 			replica.Shutdown(context.Background())
 		}
-		// cleanup
-		os.RemoveAll(tmpDir.Name())
 	}
 }
 
 // Test suite for system testing without mocking
 func TestSystem(t *testing.T) {
-	// Start the leader server in a separate goroutine
-	cleanup := startServers()
+	leaderAddress, replicaAddresses, cleanup := startServers(t)
 
 	defer cleanup()
 
-	// Give the server some time to start
-	time.Sleep(1 * time.Second)
-
 	phrases := []string{
 		"hello world",
 		"world of go",
@@ -82,19 +76,31 @@ func TestSystem(t *testing.T) {
 		"hello distributed world",
 	}
 
-	// Send multiple phrases using the sendPhrase function
 	for _, phrase := range phrases {
-		err := sendPhrase(phrase)
+		err := postPhrase(leaderAddress, phrase)
 		if err != nil {
 			t.Fatalf("failed to send phrase: %v", err)
 		}
 	}
 
-	time.Sleep(2 * time.Second) // wait for replicating b/c of eventual consistency
+	// wait for replicating b/c of eventual consistency, the last phrase
+	// reached every replica once its words did
+	replicated := eventually(func() bool {
+		for _, address := range replicaAddresses {
+			if count, err := readWordCount("hello", address); err != nil || count != 2 {
+				return false
+			}
+		}
+
+		return true
+	})
+	if !replicated {
+		t.Fatalf("phrases were not replicated")
+	}
 
 	Convey("When phrases are sent to the server", t, func() {
 		Convey("The word count for 'hello' should be correct, leader", func() {
-			db, err := getLeaderDatabse()
+			db, err := getLeaderDatabse(leaderAddress)
 			So(err, ShouldBeNil)
 
 			So(db["hello"], ShouldEqual, 2)
@@ -103,59 +109,57 @@ func TestSystem(t *testing.T) {
 			So(db["go"], ShouldEqual, 1)
 		})
 
-		// wait for replicating b/c of eventual consistency
-		// time.Sleep(1 * time.Second)
 		Convey("The word count for 'hello' should be correct", func() {
-			for _, replicaPort := range replicasPort {
-				count, err := readWordCount("hello", replicaPort)
+			for _, address := range replicaAddresses {
+				count, err := readWordCount("hello", address)
 				So(err, ShouldBeNil)
 				So(count, ShouldEqual, 2)
 			}
 		})
 
 		Convey("The word count for 'world' should be correct", func() {
-			for _, replicaPort := range replicasPort {
-				count, err := readWordCount("world", replicaPort)
+			for _, address := range replicaAddresses {
+				count, err := readWordCount("world", address)
 				So(err, ShouldBeNil)
 				So(count, ShouldEqual, 3)
 			}
 		})
 
 		Convey("The word count for 'distributed' should be correct", func() {
-			for _, replicaPort := range replicasPort {
-				count, err := readWordCount("distributed", replicaPort)
+			for _, address := range replicaAddresses {
+				count, err := readWordCount("distributed", address)
 				So(err, ShouldBeNil)
 				So(count, ShouldEqual, 2)
 			}
 		})
 
 		Convey("The word count for 'go' should be correct", func() {
-			for _, replicaPort := range replicasPort {
-				count, err := readWordCount("go", replicaPort)
+			for _, address := range replicaAddresses {
+				count, err := readWordCount("go", address)
 				So(err, ShouldBeNil)
 				So(count, ShouldEqual, 1)
 			}
 		})
 
 		Convey("The word count for 'systems' should be correct", func() {
-			for _, replicaPort := range replicasPort {
-				count, err := readWordCount("systems", replicaPort)
+			for _, address := range replicaAddresses {
+				count, err := readWordCount("systems", address)
 				So(err, ShouldBeNil)
 				So(count, ShouldEqual, 1)
 			}
 		})
 
 		Convey("The word count for 'awesome' should be correct", func() {
-			for _, replicaPort := range replicasPort {
-				count, err := readWordCount("awesome", replicaPort)
+			for _, address := range replicaAddresses {
+				count, err := readWordCount("awesome", address)
 				So(err, ShouldBeNil)
 				So(count, ShouldEqual, 1)
 			}
 		})
 
 		Convey("The word count for 'of' should be correct", func() {
-			for _, replicaPort := range replicasPort {
-				count, err := readWordCount("of", replicaPort)
+			for _, address := range replicaAddresses {
+				count, err := readWordCount("of", address)
 				So(err, ShouldBeNil)
 				So(count, ShouldEqual, 1)
 			}
@@ -163,26 +167,8 @@ func TestSystem(t *testing.T) {
 	})
 }
 
-func sendPhrase(phrase string) error {
-	data := url.Values{}
-	data.Set("text", phrase)
-
-	resp, err := http.PostForm(fmt.Sprintf("%s/post", leaderAddress), data)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("failed to send phrase, status code: %d", resp.StatusCode)
-	}
-
-	return nil
-}
-
-func readWordCount(word string, replicaPort string) (int, error) {
-	queryURL := fmt.Sprintf("http://localhost:%s/wordcount?word=%s", replicaPort, word)
+func readWordCount(word string, address string) (int, error) {
+	queryURL := fmt.Sprintf("%s/wordcount?word=%s", address, word)
 
 	resp, err := http.Get(queryURL)
 	if err != nil {
@@ -208,7 +194,7 @@ func readWordCount(word string, replicaPort string) (int, error) {
 	return count, nil
 }
 
-func getLeaderDatabse() (map[string]int, error) {
+func getLeaderDatabse(leaderAddress string) (map[string]int, error) {
 	queryURL := fmt.Sprintf("%s/sync", leaderAddress)
 
 	resp, err := http.Get(queryURL)